@@ -6,6 +6,9 @@ import (
 	"math/rand"
 	// "os"
 	"github.com/ilnaes/gopad-old/src"
+	"github.com/ilnaes/gopad-old/src/term"
+	"strconv"
+	"strings"
 	"time"
 	// "sync"
 )
@@ -13,26 +16,123 @@ import (
 func main() {
 	rand.Seed(time.Now().UnixNano())
 	user := flag.Int("u", -1, "userid")
+	name := flag.String("name", "", "name to show other users")
+	color := flag.Int("color", 0, "color to ask for, 0 for any free one")
 	server := flag.String("s", "localhost", "server address")
-	me := flag.Int("m", -1, "me")
+	me := flag.Int("m", -1, "index of this replica in -peers, by default the one on -p")
 	port := flag.Int("p", gopad.Port, "port")
 	reboot := flag.Bool("r", false, "a bool")
+	dir := flag.String("d", ".", "directory for paxos log and server state")
+	multi := flag.Bool("l", true, "use multi-paxos with a stable leader")
+	peers := flag.String("peers", "localhost:6060,localhost:6061,localhost:6062", "initial replicas")
+	join := flag.String("j", "", "join a running cluster as this address")
+	add := flag.String("add", "", "replicas to add, through the server at -s")
+	remove := flag.String("remove", "", "replicas to remove, through the server at -s")
+	wire := flag.Int("w", 1, "log entry version to write, 0 while older replicas are running")
+	crdt := flag.Bool("crdt", false, "switch the document to CRDT mode, through the server at -s")
+	doc := flag.String("doc", gopad.MainDoc, "document to edit, the server's own if empty")
+	create := flag.String("create", "", "create a document, through the server at -s")
+	rename := flag.String("rename", "", "rename a document to -to, through the server at -s")
+	to := flag.String("to", "", "new name for -rename")
+	del := flag.String("delete", "", "delete a document, through the server at -s")
+	list := flag.Bool("list", false, "list documents on the server at -s")
+	saveDir := flag.String("savedir", "", "directory to save documents other than the main one in")
+	autosave := flag.Duration("autosave", 30*time.Second, "how often to save changed documents, 0 for never")
+	maxUsers := flag.Int("maxusers", 0, "most users in a document, -1 for no limit.  with -create, for just that document")
+	timeout := flag.Duration("timeout", 2*time.Minute, "end sessions not heard from for this long, 0 for never")
 
 	flag.Parse()
 	args := flag.Args()
 
 	// var b chan (int)
-	host := "localhost"
+	servers := strings.Split(*peers, ",")
 
-	if *user == -1 {
+	srv := fmt.Sprintf("%s:%d", *server, *port)
+
+	if *crdt {
+		reply, ok := gopad.SetDocMode(srv, *doc, gopad.ModeCRDT)
+		if !ok {
+			fmt.Println("Couldn't reach server")
+		} else {
+			fmt.Println(reply.Err)
+		}
+	} else if *create != "" || *rename != "" || *del != "" {
+		ch := gopad.DocChange{Kind: gopad.DocCreate, Name: *create}
+		if *maxUsers != 0 {
+			ch.MaxUsers = *maxUsers
+		}
+		if *rename != "" {
+			ch = gopad.DocChange{Kind: gopad.DocRename, Name: *rename, To: *to}
+		} else if *del != "" {
+			ch = gopad.DocChange{Kind: gopad.DocDelete, Name: *del}
+		}
+		reply, ok := gopad.ChangeDoc(srv, ch)
+		if !ok {
+			fmt.Println("Couldn't reach server")
+		} else {
+			fmt.Println(reply.Err)
+		}
+	} else if *list {
+		reply, ok := gopad.ListDocsAt(srv)
+		if !ok {
+			fmt.Println("Couldn't reach server")
+		} else {
+			for _, name := range reply.Names {
+				if name == gopad.MainDoc {
+					name = "(main)"
+				}
+				fmt.Println(name)
+			}
+		}
+	} else if *add != "" || *remove != "" {
+		var a, r []string
+		if *add != "" {
+			a = strings.Split(*add, ",")
+		}
+		if *remove != "" {
+			r = strings.Split(*remove, ",")
+		}
+		reply, ok := gopad.ChangeMembers(srv, a, r)
+		if !ok {
+			fmt.Println("Couldn't reach server")
+		} else {
+			fmt.Printf("%s: config %d from instance %d\n", reply.Err, reply.Num, reply.From)
+		}
+	} else if *user == -1 {
 		file := ""
 		if len(args) > 0 {
 			file = args[0]
 		}
 
-		servers := []string{host + ":6060", host + ":6061", host + ":6062"}
-
-		s1 := gopad.NewServer(file, *reboot, *port, servers, *me)
+		var s1 *gopad.Server
+		if *join != "" {
+			s1 = gopad.JoinServer(*port, *join, servers, *dir)
+		} else {
+			if *me == -1 {
+				// the replica in -peers on our port
+				for i, addr := range servers {
+					if strings.HasSuffix(addr, ":"+strconv.Itoa(*port)) {
+						*me = i
+					}
+				}
+			}
+			if *me < 0 || *me >= len(servers) {
+				fmt.Printf("No replica %d in -peers, use -m to say which of the %d is us.\n", *me, len(servers))
+				return
+			}
+			s1 = gopad.NewServer(file, *reboot, *port, servers, *me, *dir)
+		}
+		s1.SetMulti(*multi)
+		s1.SetSaveDir(*saveDir)
+		s1.SetAutosave(*autosave)
+		s1.SetSessionTimeout(*timeout)
+		if *maxUsers != 0 {
+			s1.SetMaxUsers(*maxUsers)
+		}
+		if err := s1.SetWireVersion(*wire); err != nil {
+			fmt.Println(err)
+			return
+		}
 		s1.Start()
 		// s2 := gopad.NewServer(file, *reboot, 6061, servers, 1)
 		// go s2.Start()
@@ -46,7 +146,18 @@ func main() {
 		if *user < 0 {
 			fmt.Println("User id is mandatory!  Use -u flag.")
 		} else {
-			gopad.StartClient(*user, *server, *port, false)
+			// start at -s:-p and fail over to the other replicas
+			first := *server + ":" + strconv.Itoa(*port)
+			replicas := []string{first}
+			for _, addr := range servers {
+				if addr != first {
+					replicas = append(replicas, addr)
+				}
+			}
+			c := gopad.NewClient(*user, *doc, replicas)
+			c.SetName(*name)
+			c.SetColor(*color)
+			term.StartClient(c, false)
 		}
 	}
 }
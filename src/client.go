@@ -1,520 +1,835 @@
 package gopad
 
-// Most of these are based on a version of antirez's kilo given by
-// https://viewsourcecode.org/snaptoken/kilo/ as well as the editbox demo of termbox-go
+// The client, without a screen.
+//
+// A Client joins a document on the replicas, sends our edits and cursor
+// moves and keeps a copy of the document with everyone's edits and our
+// own pending ones.  The terminal editor (package term) is one user of it,
+// formatters and bots that join a session are others.
 
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/nsf/termbox-go"
 	"log"
 	"math/rand"
+	"sort"
 	// "os"
 	// "net/rpc"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	pushDelay = 250 * time.Millisecond
 	pullDelay = 250 * time.Millisecond
+	flushWait = 2 * time.Second // most Close waits for pending ops
+	retryMax  = 4 * time.Second // longest wait between resends of a batch
 	// pushDelay = 1 * time.Second
 	// pullDelay = 1 * time.Second
 )
 
-type gopad struct {
-	filename   string
-	srv        string
-	id         int
-	screenrows int
-	screencols int
-	rowoff     int
-	coloff     int
-	doc        Doc
-	tempdoc    Doc
-	mu         sync.Mutex
-	status     string
+type Client struct {
+	docname string   // document on the servers
+	servers []string // every replica, we talk to one at a time
+	cur     int32    // index of the one we're using
+	id      int
+	name    string
+	color   int
+	doc     Doc // what the replicas committed
+	tempdoc Doc // and our pending ops on top
+	mu      sync.Mutex
+	status  string // last thing that happened to the connection
+	net     Transport
+	dead    int32
+	joined  bool          // Init went through
+	changed chan struct{} // closed when tempdoc changes
 
 	selfOps []Op
 	opNum   uint32
+	sent    uint32 // last Seq in the batch we sent
+
+	// ModeCRDT
+	crdtOps []Op   // not seen back from a replica yet
+	crdtNum uint32 // Seq of our last CRDT op
+	merged  uint32 // replica we're talking to took ops up to here
 	session uint32
+	markID  ElemID // rune our mark is after
+	marked  bool
+
+	undos [][]Op // our ops, a key press at a time, see undo.go
+	redos [][]Op
 
-	tempRUsers map[int]int // renderX for each tempPos
-	numusers   int
+	numusers int
+	active   map[int]time.Time // when we last saw each user do something
 }
 
-func StartClient(user int, server string, port int, testing bool) {
-	var gp gopad
-	gp.id = user
-	gp.srv = server + ":" + strconv.Itoa(port)
-	gp.tempRUsers = make(map[int]int)
-	gp.session = rand.Uint32()
+// NewClient makes a client editing document doc as user through
+// servers, starting with the first and moving on to the next whenever
+// one stops answering.  Nothing happens until Connect.
+func NewClient(user int, doc string, servers []string) *Client {
+	return &Client{
+		id:      user,
+		docname: doc,
+		servers: servers,
+		session: rand.Uint32(),
+		net:     conns,
+		changed: make(chan struct{}),
+		active:  make(map[int]time.Time),
+	}
+}
 
-	gp.editorOpen(gp.srv)
+// SetName sets the name others see us by.  Must be called before
+// Connect.
+func (c *Client) SetName(name string) {
+	c.name = name
+}
 
-	err := termbox.Init()
-	if err != nil {
-		panic(err)
-	}
-	defer termbox.Close()
-	if !testing {
-		termbox.SetInputMode(termbox.InputEsc)
-		termbox.SetOutputMode(termbox.Output256)
-	}
-
-	gp.initEditor()
-
-	go gp.push()
-	go gp.pull(testing)
-
-mainloop:
-	for {
-		gp.refreshScreen()
-		ev := termbox.PollEvent()
-		gp.status = fmt.Sprintf("%v", ev.Key)
-
-		switch ev.Type {
-		case termbox.EventKey:
-			gp.mu.Lock()
-			switch ev.Key {
-			case termbox.KeyCtrlC:
-				break mainloop
-			case termbox.KeyCtrlS:
-				gp.mu.Unlock()
-				if gp.filename == "" {
-					file, ok := gp.editorPrompt("Save as (ESC to cancel): ", gp.filename)
-					if ok {
-						gp.filename = file
-					} else {
-						gp.status = ""
-						break
-					}
-				}
-				gp.mu.Lock()
+// SetColor asks for a color from 1 up, which we get if nobody has it.
+// Must be called before Connect.
+func (c *Client) SetColor(color int) {
+	c.color = color
+}
 
-				if gp.tempdoc.write(gp.filename) {
-					gp.status = "Saved!"
-				}
-			case termbox.KeyArrowLeft,
-				termbox.KeyArrowRight,
-				termbox.KeyArrowUp,
-				termbox.KeyArrowDown,
-				termbox.KeyHome,
-				termbox.KeyEnd:
-				gp.logOp([]Op{Op{Type: Move, Move: ev.Key, View: gp.doc.View, Client: gp.id}})
-			// case termbox.KeyPgup, termbox.KeyPgdn:
-			// 	for times := gp.screenrows; times > 0; times-- {
-			// 		var x termbox.Key
-			// 		if ev.Key == termbox.KeyPgdn {
-			// 			x = termbox.KeyArrowDown
-			// 		} else {
-			// 			x = termbox.KeyArrowUp
-			// 		}
-			// 		gp.editorMoveCursor(x, &gp.pos, true, true)
-			// 	}
-			case termbox.KeyBackspace, termbox.KeyBackspace2:
-				gp.logOp([]Op{Op{Type: Delete, View: gp.doc.View, Client: gp.id}})
-			case termbox.KeyDelete, termbox.KeyCtrlD:
-				gp.logOp([]Op{
-					Op{Type: Move, Move: termbox.KeyArrowRight, View: gp.doc.View, Client: gp.id},
-					Op{Type: Delete, View: gp.doc.View, Client: gp.id},
-				})
-			case termbox.KeyTab:
-				gp.logOp([]Op{Op{Type: Insert, Data: '\t', View: gp.doc.View, Client: gp.id}})
-			case termbox.KeySpace:
-				gp.logOp([]Op{Op{Type: Insert, Data: ' ', View: gp.doc.View, Client: gp.id}})
-			case termbox.KeyEnter:
-				gp.logOp([]Op{Op{Type: Newline, View: gp.doc.View, Client: gp.id}})
-			default:
-				if ev.Ch != 0 {
-					gp.logOp([]Op{Op{Type: Insert, Data: ev.Ch, View: gp.doc.View, Client: gp.id}})
-				}
-			}
-			gp.mu.Unlock()
-		case termbox.EventError:
-			panic(ev.Err)
-		}
+// Connect joins the document and starts sending our edits and getting
+// everyone else's.  It keeps trying while no replica answers, and fails
+// if there's no such document.
+func (c *Client) Connect() error {
+	if err := c.editorOpen(); err != nil {
+		return err
 	}
+	go c.push()
+	go c.pull()
+	return nil
 }
 
-func (gp *gopad) logOp(ops []Op) {
-	for _, op := range ops {
-		gp.opNum++
-		op.Seq = gp.opNum
-		op.Session = gp.session
-		gp.selfOps = append(gp.selfOps, op)
-		gp.tempdoc.apply(op, true)
+// Close leaves the document and stops talking to the replicas.  It
+// waits a little for them to take our last edits, any they haven't by
+// then are lost.
+func (c *Client) Close() {
+	if c.isdead() {
+		return
+	}
+	c.mu.Lock()
+	joined := c.joined
+	c.mu.Unlock()
+	if joined {
+		c.flush()
 	}
+	atomic.StoreInt32(&c.dead, 1)
+	if joined {
+		// if this doesn't get through, the replicas end our session
+		// once they stop hearing from us
+		var reply LeaveReply
+		c.call("Server.Leave", LeaveArg{Client: c.id, Session: c.session, Doc: c.docname}, &reply)
+	}
+
+	c.mu.Lock()
+	c.wake()
+	c.mu.Unlock()
 }
 
-// push commits to server
-func (gp *gopad) push() {
-	for {
-		gp.mu.Lock()
-		if len(gp.selfOps) == 0 {
-			// no new ops
-			gp.mu.Unlock()
-			time.Sleep(pushDelay)
-			continue
+// wait up to flushWait for the replicas to take our pending ops
+func (c *Client) flush() {
+	for start := time.Now(); time.Since(start) < flushWait; time.Sleep(pushDelay / 5) {
+		c.mu.Lock()
+		done := len(c.selfOps) == 0 && len(c.crdtOps) == 0
+		c.mu.Unlock()
+		if done {
+			return
 		}
-		// prepare and send new ops
-		buf, err := json.Marshal(gp.selfOps)
-		if err != nil {
-			log.Println("Couldn't marshal commits", err)
-			gp.mu.Unlock()
-			time.Sleep(pushDelay)
-			continue
-		}
-		gp.mu.Unlock()
-
-		done := false
-		for !done {
-			var reply OpReply
-			ok := call(gp.srv, "Server.Handle", OpArg{Data: buf, Xid: rand.Int63()}, &reply, false)
+	}
+}
 
-			if ok && reply.Err == "OK" {
-				done = true
-			}
-		}
-		time.Sleep(pushDelay)
+// tell the user if the replicas ended our session.  holds c.mu
+func (c *Client) checkSession() {
+	if _, ok := c.doc.Colors[c.id]; !ok && c.joined {
+		c.status = "Session timed out, reconnect to keep editing"
 	}
 }
 
-// pulls commited operations from server
-func (gp *gopad) pull(testing bool) {
-	for {
-		var reply QueryReply
-		gp.mu.Lock()
-		ok := call(gp.srv, "Server.Query", QueryArg{View: gp.doc.View, Client: gp.id}, &reply, false)
+func (c *Client) isdead() bool {
+	return atomic.LoadInt32(&c.dead) != 0
+}
 
-		if ok && reply.Err == "OK" {
-			var commits []Op
-			json.Unmarshal(reply.Data, &commits)
+// ID is the user we edit as.
+func (c *Client) ID() int {
+	return c.id
+}
 
-			if len(commits) > 0 {
-				// apply commited ops
+// Changed is closed the next time the document, a cursor or Status
+// changes.  Call it again for the time after that.
+func (c *Client) Changed() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changed
+}
 
-				oldPoint := gp.doc.UserSeqs[gp.id]
-				gp.applyCommits(commits, 0, 0)
+// wake up whoever waits on Changed.  holds c.mu
+func (c *Client) wake() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
 
-				// cut off commiteds
-				if gp.doc.UserSeqs[gp.id] > oldPoint {
-					gp.selfOps = gp.selfOps[gp.doc.UserSeqs[gp.id]-oldPoint:]
-				}
+// Snapshot is a copy of the document as we see it, with our edits the
+// replicas haven't committed yet.
+func (c *Client) Snapshot() Doc {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *c.tempdoc.dup()
+}
 
-				gp.tempdoc = *gp.doc.dup()
-				for k, v := range gp.doc.UserPos {
-					gp.tempdoc.UserPos[k] = v
-				}
-				// apply ops not yet commited
-				for _, op := range gp.selfOps {
-					gp.tempdoc.apply(op, true)
-				}
+// Committed is a copy of the document as the replicas last told us.
+func (c *Client) Committed() Doc {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *c.doc.dup()
+}
 
-				gp.mu.Unlock()
-				if !testing {
-					gp.refreshScreen()
-				}
-			} else {
-				gp.mu.Unlock()
-				time.Sleep(pullDelay)
-			}
-		} else {
-			gp.mu.Unlock()
-			time.Sleep(pullDelay)
-		}
+// Text is the document as we see it.
+func (c *Client) Text() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tempdoc.String()
+}
+
+// Cursor is our cursor's offset.
+func (c *Client) Cursor() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tempdoc.Offset(c.tempdoc.UserPos[c.id])
+}
+
+// Cursors are the offsets of everyone's cursors, ours included.
+func (c *Client) Cursors() map[int]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cursors := make(map[int]int)
+	for user, pos := range c.tempdoc.UserPos {
+		cursors[user] = c.tempdoc.Offset(pos)
 	}
+	return cursors
 }
 
-// apply ops and returns true if a certain Init op was found
-func (gp *gopad) applyCommits(commits []Op, session uint32, ck int) bool {
-	res := false
+// Selection is the offsets we have selected, false if nothing.
+func (c *Client) Selection() (lo int, hi int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tempdoc.Selection(c.id)
+}
 
-	for _, op := range commits {
-		// gp.status = fmt.Sprintf("%d %v", gp.doc.Seqs[op.Client], commits)
-		if gp.doc.apply(op, false) {
-			// apply op and update commitpoint
+// Status is the last thing that happened to the connection, like
+// switching replicas.
+func (c *Client) Status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
 
-			if op.Type == Init {
-				if gp.doc.UserSeqs[op.Client] == 1 {
-					gp.numusers++
-				}
+// Presence is what we know about someone in the document.
+type Presence struct {
+	User  int
+	Name  string
+	Color int
+	Line  int           // row their cursor is on, from 0
+	Idle  time.Duration // since we last saw them do something
+}
 
-				if op.Session == session && op.Client == ck {
-					res = true
-				}
-			}
-		}
+// Roster is everyone in the document, by user id.
+func (c *Client) Roster() []Presence {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var users []int
+	for user := range c.tempdoc.Colors {
+		users = append(users, user)
 	}
-
-	return res
+	sort.Ints(users)
+
+	var roster []Presence
+	for _, user := range users {
+		roster = append(roster, Presence{
+			User:  user,
+			Name:  c.tempdoc.userName(user),
+			Color: c.tempdoc.Colors[user],
+			Line:  c.tempdoc.UserPos[user].Y,
+			Idle:  time.Since(c.active[user]),
+		})
+	}
+	return roster
 }
 
-/*** file i/o ***/
+// do f under c.mu and tell whoever's waiting
+func (c *Client) edit(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f()
+	c.active[c.id] = time.Now()
+	c.wake()
+}
 
-// get file from server
-func (gp *gopad) editorOpen(server string) {
-	var reply InitReply
-	for {
-		ok := call(server, "Server.Init", InitArg{Client: gp.id, Session: gp.session}, &reply, false)
-		if ok {
-			if reply.Err == "OK" {
-				err := bytesToDoc(reply.Doc, &gp.doc)
-				if err != nil {
-					log.Fatal("Couldn't decode document")
-				}
+// Type types ch at our cursor, or over what we have selected.
+func (c *Client) Type(ch rune) {
+	c.edit(func() { c.typeRune(ch) })
+}
 
-				// process updates until relevant Init
-				done := false
-				for !done {
-					var reply QueryReply
-					ok := call(gp.srv, "Server.Query", QueryArg{View: gp.doc.View, Client: gp.id}, &reply, false)
+// InsertText puts text in at our cursor, or over what we have selected,
+// as one edit.
+func (c *Client) InsertText(text string) {
+	c.edit(func() { c.insertText(text) })
+}
 
-					if ok && reply.Err == "OK" {
-						// apply commited ops
-						var commits []Op
-						json.Unmarshal(reply.Data, &commits)
+// Backspace deletes what we have selected, or the rune before the cursor.
+func (c *Client) Backspace() {
+	c.edit(func() {
+		if !c.deleteSelection() {
+			c.logEdit(DeleteAt, -1, 0)
+		}
+	})
+}
 
-						if len(commits) > 0 {
-							done = gp.applyCommits(commits, gp.session, gp.id)
-						}
-					} else {
-						time.Sleep(pullDelay)
-					}
-				}
+// Delete deletes what we have selected, or the rune after the cursor.
+func (c *Client) Delete() {
+	c.edit(func() {
+		if !c.deleteSelection() {
+			c.logEdit(DeleteAt, 0, 0)
+		}
+	})
+}
 
-				gp.tempdoc = *gp.doc.dup()
-				gp.opNum = gp.doc.UserSeqs[gp.id]
-				gp.numusers = len(gp.doc.UserPos)
+// Indent indents the rows we have selected by a tab, or takes one
+// level of indent away from them.  false if nothing is selected.
+func (c *Client) Indent(out bool) bool {
+	var ok bool
+	c.edit(func() { ok = c.indent(out) })
+	return ok
+}
 
-				// update positions
-				for user, pos := range gp.doc.UserPos {
-					gp.tempRUsers[user] = editorRowCxToRx(&gp.tempdoc.Rows[pos.Y], pos.X)
-				}
-				break
-			} else {
-				time.Sleep(time.Second)
+// Edit makes edits one after the other, at offsets in the document as we
+// see it, and undoes them as one.  Edits that don't fit are dropped.
+func (c *Client) Edit(edits ...Edit) {
+	c.edit(func() {
+		var fit []Edit
+		doc := c.tempdoc.dup()
+		for _, e := range edits {
+			if doc.applyEdit(e, c.id, true) {
+				fit = append(fit, e)
 			}
-
-		} else {
-			log.Fatal("Not ok call")
 		}
-	}
+		c.logEdits(fit)
+	})
 }
 
-func (gp *gopad) editorPrompt(msg, file string) (string, bool) {
-	gp.status = msg
-
-	for {
-		gp.refreshScreen()
+// Move moves our cursor, by one of the Move motions.
+func (c *Client) Move(motion int) {
+	c.edit(func() { c.move(motion) })
+}
 
-		switch ev := termbox.PollEvent(); ev.Type {
-		case termbox.EventKey:
-			switch ev.Key {
-			case termbox.KeyBackspace, termbox.KeyBackspace2:
-				file = file[:len(file)-1]
-				gp.status = msg + file
-			case termbox.KeyEsc:
-				return "", false
-			case termbox.KeyEnter:
-				return file, true
-			default:
-				if ev.Ch != 0 {
-					file += string(ev.Ch)
-					gp.status = msg + file
-				}
+// MoveTo moves our cursor to offset at.
+func (c *Client) MoveTo(at int) {
+	c.edit(func() {
+		if c.tempdoc.Mode == ModeCRDT {
+			if pos, ok := c.tempdoc.posAt(at); ok {
+				c.tempdoc.UserPos[c.id] = pos
+				c.tempdoc.Anchors[c.id] = c.tempdoc.Text.idBefore(at)
 			}
-		case termbox.EventError:
-			panic(ev.Err)
+			return
 		}
-	}
+		c.logOp([]Op{Op{Type: Move, Motion: MoveTo, At: at, View: c.doc.View, Client: c.id}})
+	})
 }
 
-/*** output ***/
+// SetMark sets our mark at offset at, so we select from there to the
+// cursor.  -1 clears it.
+func (c *Client) SetMark(at int) {
+	c.edit(func() { c.setMark(at) })
+}
 
-func (gp *gopad) editorScroll() {
+// ToggleMark sets our mark at the cursor, or clears it.
+func (c *Client) ToggleMark() {
+	c.edit(func() { c.toggleMark() })
+}
 
-	for id, pos := range gp.tempdoc.UserPos {
-		gp.tempRUsers[id] = 0
-		if pos.Y < len(gp.tempdoc.Rows) {
-			gp.tempRUsers[id] = editorRowCxToRx(&gp.tempdoc.Rows[pos.Y], pos.X)
-		}
+// Save asks the replicas to save what's committed.
+func (c *Client) Save() error {
+	var reply SaveReply
+	if !c.call("Server.Save", SaveArg{Doc: c.docname}, &reply) {
+		return fmt.Errorf("no answer from %s", c.servers[int(atomic.LoadInt32(&c.cur))%len(c.servers)])
 	}
-
-	pos := gp.tempdoc.UserPos[gp.id]
-	// reposition up
-
-	if pos.Y < gp.rowoff {
-		gp.rowoff = pos.Y
+	if reply.Err != "OK" {
+		return fmt.Errorf("couldn't save: %s", reply.Err)
 	}
+	return nil
+}
 
-	// reposition down
-	if pos.Y >= gp.rowoff+gp.screenrows {
-		gp.rowoff = pos.Y - gp.screenrows + 1
+// log a positional op at our cursor, moved by delta.  ops that don't
+// fit the document are dropped here so the replicas never see them
+func (c *Client) logEdit(typ int, delta int, ch rune) {
+	at := c.tempdoc.Offset(c.tempdoc.UserPos[c.id]) + delta
+	end := at
+	if typ == DeleteAt {
+		end++
+	}
+	if _, ok := c.tempdoc.posAt(end); !ok || at < 0 {
+		return
 	}
+	if c.tempdoc.Mode == ModeCRDT {
+		c.remember([]Op{c.logCRDT(typ, at, ch)})
+		return
+	}
+	c.logOp([]Op{Op{Type: typ, At: at, Data: ch, View: c.doc.View, Client: c.id}})
+	c.remember([]Op{c.selfOps[len(c.selfOps)-1]})
+}
 
-	if gp.tempRUsers[gp.id] < gp.coloff {
-		gp.coloff = gp.tempRUsers[gp.id]
+// type ch at our cursor, or over what we have selected
+func (c *Client) typeRune(ch rune) {
+	if !c.replaceSelection(string(ch)) {
+		c.logEdit(InsertAt, 0, ch)
 	}
+}
 
-	if gp.tempRUsers[gp.id] >= gp.coloff+gp.screencols {
-		gp.coloff = gp.tempRUsers[gp.id] - gp.screencols + 1
+// log the CRDT op for a positional edit at offset at
+func (c *Client) logCRDT(typ int, at int, ch rune) Op {
+	var op Op
+	if typ == InsertAt {
+		op.Type = CrdtInsert
+		op.ID = ElemID{Clock: c.tempdoc.Text.Clock + 1, Client: c.id}
+		op.Ref = c.tempdoc.Text.idBefore(at)
+		op.Data = ch
+	} else {
+		op.Type = CrdtDelete
+		op.ID, _ = c.tempdoc.Text.idAt(at)
+		// for undo
+		op.Data = c.tempdoc.runeAt(at)
 	}
+	return c.logCRDTOp(op)
 }
 
-// draw a row
-func (gp *gopad) drawRows() {
-	const coldef = termbox.ColorDefault
+// log CRDT op, which gets our next Seq
+func (c *Client) logCRDTOp(op Op) Op {
+	op.Client = c.id
+	op.Session = c.session
+	c.crdtNum++
+	op.Seq = c.crdtNum
+	c.crdtOps = append(c.crdtOps, op)
+	c.tempdoc.apply(op, true)
+	c.crdtMark()
+	return op
+}
 
-	i := 0
-	for ; i < gp.screenrows; i++ {
-		filerow := i + gp.rowoff
-		if filerow < len(gp.tempdoc.Rows) {
+// move our cursor
+func (c *Client) move(motion int) {
+	if c.tempdoc.Mode == ModeCRDT {
+		c.moveLocal(motion)
+	} else {
+		c.logOp([]Op{Op{Type: Move, Motion: motion, Move: motionKeys[motion], View: c.doc.View, Client: c.id}})
+	}
+}
 
-			row := gp.tempdoc.Rows[filerow].renderRow()
+// in ModeCRDT cursor moves stay with us
+func (c *Client) moveLocal(motion int) {
+	editorMoveCursor(&c.tempdoc, c.id, motion)
+	at := c.tempdoc.Offset(c.tempdoc.UserPos[c.id])
+	c.tempdoc.Anchors[c.id] = c.tempdoc.Text.idBefore(at)
+}
 
-			// draw gutters
-			termbox.SetCell(0, i, '~', coldef, coldef)
+func (c *Client) logOp(ops []Op) {
+	for _, op := range ops {
+		c.opNum++
+		op.Seq = c.opNum
+		op.Session = c.session
+		c.selfOps = append(c.selfOps, op)
+		c.tempdoc.apply(op, true)
+	}
+}
 
-			if len(row.Chars) > 0 {
-				for k, s := range row.Chars {
-					if k >= gp.coloff {
-						bg := termbox.ColorDefault
+// replica we're talking to and its index
+func (c *Client) server() (string, int32) {
+	i := atomic.LoadInt32(&c.cur)
+	return c.servers[int(i)%len(c.servers)], i
+}
 
-						// draw other cursors
-						for user, pos := range gp.tempdoc.UserPos {
-							if user != gp.id {
-								if gp.tempRUsers[user]-gp.coloff == k && pos.Y == filerow {
-									bg = CURSORS[gp.doc.Colors[user]]
-								}
-							}
-						}
+// give up on replica i and move on to the next.  the session lives in
+// the replicated log, so the next one can pick up where we were.  takes
+// c.mu
+func (c *Client) failover(i int32) {
+	if len(c.servers) > 1 && atomic.CompareAndSwapInt32(&c.cur, i, (i+1)%int32(len(c.servers))) {
+		// the next one may not have our CRDT ops yet
+		atomic.StoreUint32(&c.merged, 0)
+
+		c.mu.Lock()
+		c.status = "Switched to " + c.servers[(i+1)%int32(len(c.servers))]
+		c.wake()
+		c.mu.Unlock()
+	}
+}
 
-						if row.Temp[k] {
-							// is temp char?
-							termbox.SetCell(k+1-gp.coloff, i, s, 251, bg)
-						} else {
+// call the current replica, failing over if it doesn't answer.  don't
+// hold c.mu
+func (c *Client) call(rpcname string, args interface{}, reply interface{}) bool {
+	srv, i := c.server()
+	if !c.net.Call(srv, rpcname, args, reply, false) {
+		c.failover(i)
+		return false
+	}
+	return true
+}
 
-							// select color based on author
-							auth := row.Author[k]
-							color := COLORS[auth]
-							termbox.SetCell(k+1-gp.coloff, i, s, color, bg)
-						}
-						if k+1 > gp.screencols {
-							break
-						}
-					}
-				}
+// push commits to server
+func (c *Client) push() {
+	for !c.isdead() {
+		c.mu.Lock()
+		if c.doc.Mode == ModeCRDT {
+			c.pushCRDT()
+			time.Sleep(pushDelay)
+			continue
+		}
+		if len(c.selfOps) == 0 || c.doc.UserSeqs[c.id] < c.sent {
+			// no new ops, or we haven't seen the last batch commit.
+			// one batch at a time keeps the transforms simple (ot.go)
+			c.mu.Unlock()
+			time.Sleep(pushDelay)
+			continue
+		}
+		// prepare and send new ops, which apply on top of c.doc
+		buf, err := json.Marshal(c.selfOps)
+		if err != nil {
+			log.Println("Couldn't marshal commits", err)
+			c.mu.Unlock()
+			time.Sleep(pushDelay)
+			continue
+		}
+		c.sent = c.selfOps[len(c.selfOps)-1].Seq
+		c.mu.Unlock()
 
-				end := len(gp.tempdoc.Rows[filerow].Chars)
-				endR := len(row.Chars)
+		// resend everything unacknowledged until some replica takes it.
+		// replicas drop ops they already have.
+		wait := pushDelay
+		for !c.isdead() {
+			var reply OpReply
+			ok := c.call("Server.Handle", OpArg{Data: buf, Xid: rand.Int63(), Doc: c.docname}, &reply)
+			if ok && reply.Err == "OK" {
+				break
+			}
 
-				// at endpoint?
-				if endR >= gp.coloff && endR < gp.coloff+gp.screencols {
-					for user, pos := range gp.tempdoc.UserPos {
-						if user != gp.id {
-							if pos.X == end && pos.Y == filerow {
-								termbox.SetCell(endR-gp.coloff+1, i, ' ', 0, CURSORS[gp.doc.Colors[user]])
-							}
-						}
-					}
-				}
-			} else if gp.coloff == 0 {
-				// draw cursor on empty line
-				for user, pos := range gp.tempdoc.UserPos {
-					if user != gp.id {
-						if pos.Y == filerow {
-							termbox.SetCell(1, i, ' ', 0, CURSORS[gp.doc.Colors[user]])
-						}
-					}
-				}
+			// the replica hasn't caught up with our earlier ops, or
+			// nobody answers and the pool is backing off from them all
+			time.Sleep(wait)
+			if wait < retryMax {
+				wait *= 2
 			}
-		} else {
-			termbox.SetCell(0, i, '~', coldef, coldef)
 		}
+		time.Sleep(pushDelay)
 	}
 }
 
-func (gp *gopad) editorDrawStatusBar() {
-	i := gp.screenrows
+// send the CRDT ops the replica hasn't taken.  they wait here for as
+// long as we can't reach anyone.  unlocks c.mu
+func (c *Client) pushCRDT() {
+	merged := atomic.LoadUint32(&c.merged)
+	var ops []Op
+	for _, op := range c.crdtOps {
+		if op.Seq > merged {
+			ops = append(ops, op)
+		}
+	}
+	c.mu.Unlock()
+	if len(ops) == 0 {
+		return
+	}
 
-	bg := termbox.ColorWhite
+	buf, err := json.Marshal(ops)
+	if err != nil {
+		log.Println("Couldn't marshal commits", err)
+		return
+	}
+	var reply MergeReply
+	if c.call("Server.Merge", MergeArg{Data: buf, Doc: c.docname}, &reply) && reply.Err == "OK" {
+		atomic.CompareAndSwapUint32(&c.merged, merged, ops[len(ops)-1].Seq)
+	}
+}
 
-	if gp.doc.Colors[gp.id] != 0 {
-		bg = COLORS[gp.doc.Colors[gp.id]]
+// pull CRDT ops we haven't seen, returns false if it couldn't
+func (c *Client) pullCRDT() bool {
+	c.mu.Lock()
+	have := make(map[int]uint32)
+	for k, v := range c.doc.CrdtSeqs {
+		have[k] = v
 	}
-	var j int
+	c.mu.Unlock()
 
-	for _, c := range gp.status {
-		termbox.SetCell(j, i, c, termbox.ColorBlack, bg)
-		j++
+	var reply SyncReply
+	if !c.call("Server.Sync", SyncArg{Have: have, Wait: true, Doc: c.docname, Client: c.id}, &reply) || reply.Err != "OK" {
+		c.lost(reply.Err)
+		return false
+	}
+	var ops []Op
+	json.Unmarshal(reply.Data, &ops)
+
+	c.mu.Lock()
+	// who's here, as the replica has it
+	c.doc.Colors = make(map[int]int)
+	for k, v := range reply.Colors {
+		c.doc.Colors[k] = v
+	}
+	c.doc.Names = reply.Names
+	for user := range c.doc.Anchors {
+		if _, ok := c.doc.Colors[user]; !ok {
+			delete(c.doc.Anchors, user)
+			delete(c.doc.UserPos, user)
+			delete(c.doc.Marks, user)
+		}
+	}
+	c.checkSession()
+	c.numusers = len(c.doc.Colors)
+	c.doc.Saved = reply.Saved
+	for _, op := range ops {
+		c.doc.apply(op, false)
+		c.active[op.Client] = time.Now()
 	}
 
-	// draw status bar
-	for ; j < gp.screencols+1; j++ {
-		termbox.SetCell(j, i, ' ', termbox.ColorBlack, bg)
+	// cut off ours that made it
+	n := c.doc.CrdtSeqs[c.id]
+	for len(c.crdtOps) > 0 && c.crdtOps[0].Seq <= n {
+		c.crdtOps = c.crdtOps[1:]
 	}
 
+	// our cursor is ours
+	anchor, ok := c.tempdoc.Anchors[c.id]
+	c.tempdoc = *c.doc.dup()
+	if ok {
+		c.tempdoc.Anchors[c.id] = anchor
+	}
+	for _, op := range c.crdtOps {
+		c.tempdoc.apply(op, true)
+	}
+	c.tempdoc.crdtRows()
+	c.crdtMark()
+	c.wake()
+	c.mu.Unlock()
+	return true
 }
 
-func (gp *gopad) refreshScreen() {
-	// gp.status = fmt.Sprintf("%v", gp.tempRUsers)
-	gp.mu.Lock()
-	const coldef = termbox.ColorDefault
-	termbox.Clear(coldef, coldef)
-	gp.initEditor()
+// tell the user if the document went away under us
+func (c *Client) lost(err Err) {
+	if err == "NoDoc" {
+		c.mu.Lock()
+		c.status = "Document was renamed or deleted"
+		c.wake()
+		c.mu.Unlock()
+	}
+}
+
+// streams commited operations from server.  each Subscribe comes back as
+// soon as there's something past our view, so the next one picks up
+// where it left off.
+func (c *Client) pull() {
+	for !c.isdead() {
+		c.mu.Lock()
+		view := c.doc.View
+		mode := c.doc.Mode
+		c.mu.Unlock()
+
+		if mode == ModeCRDT {
+			if !c.pullCRDT() {
+				time.Sleep(pullDelay)
+			}
+			continue
+		}
+
+		// only we move c.doc, so view is still ours when it returns
+		var reply QueryReply
+		ok := c.call("Server.Subscribe", SubscribeArg{View: view, Client: c.id, Doc: c.docname}, &reply)
+		c.lost(reply.Err)
+
+		if ok && reply.Err == "BAD" {
+			// this replica is behind what we've already seen
+			_, i := c.server()
+			c.failover(i)
+		}
+
+		if !ok || reply.Err != "OK" {
+			time.Sleep(pullDelay)
+			continue
+		}
+
+		var commits []Op
+		json.Unmarshal(reply.Data, &commits)
+		if len(commits) == 0 {
+			continue
+		}
+
+		// apply commited ops
+		c.mu.Lock()
+		oldPoint := c.doc.UserSeqs[c.id]
+		oldView := c.doc.View
+		c.applyCommits(commits, 0, 0)
+		c.rebase(oldView)
+		c.checkSession()
+
+		// cut off commiteds
+		if c.doc.UserSeqs[c.id] > oldPoint {
+			c.selfOps = c.selfOps[c.doc.UserSeqs[c.id]-oldPoint:]
+		}
+		if c.doc.Mode == ModeCRDT && len(c.selfOps) > 0 {
+			// the replicas turn these into nothing now
+			c.selfOps = nil
+			c.status = "Document switched to CRDT mode, last edits lost"
+		}
 
-	gp.editorScroll()
-	gp.drawRows()
-	gp.editorDrawStatusBar()
+		c.tempdoc = *c.doc.dup()
+		for k, v := range c.doc.UserPos {
+			c.tempdoc.UserPos[k] = v
+		}
+		// apply ops not yet commited
+		for _, op := range c.selfOps {
+			c.tempdoc.apply(op, true)
+		}
 
-	termbox.SetCursor(gp.tempRUsers[gp.id]-gp.coloff+1, gp.tempdoc.UserPos[gp.id].Y-gp.rowoff)
-	termbox.Flush()
-	gp.mu.Unlock()
+		c.wake()
+		c.mu.Unlock()
+	}
 }
 
-/*** init ***/
+// transform pending ops past the edits others committed after view from,
+// the same way the replicas will, so they apply on top of c.doc
+func (c *Client) rebase(from uint32) {
+	var done uint32 // our ops up to here committed before the edit
+	for _, p := range c.doc.History {
+		if p.View <= from {
+			continue
+		}
+		if p.Client == c.id {
+			done = p.Seq
+			continue
+		}
 
-func (gp *gopad) initEditor() {
-	gp.screencols, gp.screenrows = termbox.Size()
-	gp.screenrows--
-	gp.screencols--
+		e := p.Edit
+		past := func(x *Edit) {
+			a := Transform(*x, e)
+			e = Transform(e, *x)
+			x.Type, x.At = a.Type, a.At
+		}
+		for i := range c.selfOps {
+			op := &c.selfOps[i]
+			if op.Seq <= done {
+				continue
+			}
+			switch op.Type {
+			case InsertAt, DeleteAt, InsertText, Select:
+				x := op.edit()
+				past(&x)
+				op.Type, op.At = x.Type, x.At
+			case Move:
+				if op.Motion == MoveTo {
+					x := op.edit()
+					past(&x)
+					op.At = x.At
+				}
+			case Range:
+				op.Edits = append([]Edit{}, op.Edits...)
+				for j := range op.Edits {
+					past(&op.Edits[j])
+				}
+			}
+		}
+	}
+
+	for i := range c.selfOps {
+		c.selfOps[i].View = c.doc.View
+	}
 }
 
-func (row *erow) renderRow() *erow {
-	newrow := erow{}
+// apply ops and returns true if a certain Init op was found
+func (c *Client) applyCommits(commits []Op, session uint32, ck int) bool {
+	res := false
 
-	tabs := 0
-	for i := 0; i < len(row.Chars); i++ {
-		if row.Chars[i] == '\t' {
-			tabs++
+	for _, op := range commits {
+		// c.status = fmt.Sprintf("%d %v", c.doc.Seqs[op.Client], commits)
+		if c.doc.apply(op, false) {
+			// apply op and update commitpoint
+			c.active[op.Client] = time.Now()
+
+			if op.Type == Init {
+				if c.doc.UserSeqs[op.Client] == 1 {
+					c.numusers++
+				}
+
+				if op.Session == session && op.Client == ck {
+					res = true
+				}
+			}
 		}
 	}
-	l := len(row.Chars) + tabs*(TABSTOP-1) + 1
 
-	newrow.Temp = make([]bool, l)
-	newrow.Author = make([]int, l)
+	return res
+}
+
+/*** file i/o ***/
 
-	var sb strings.Builder
-	x := 0
-	for i, r := range row.Chars {
-		if r == '\t' {
-			for {
-				sb.WriteRune(' ')
-				x++
-				if x%TABSTOP == 0 {
-					break
+// get file from a replica
+func (c *Client) editorOpen() error {
+	var reply InitReply
+	for tries := 1; !c.isdead(); tries++ {
+		ok := c.call("Server.Init", InitArg{Client: c.id, Session: c.session, Doc: c.docname, Name: c.name, Color: c.color}, &reply)
+		if ok {
+			if reply.Err == "OK" {
+				err := bytesToDoc(reply.Doc, &c.doc)
+				if err != nil {
+					return fmt.Errorf("couldn't decode document: %v", err)
 				}
+
+				// process updates until relevant Init, unless the
+				// replica applied it before answering
+				done := c.doc.UserSession[c.id] == c.session
+				for !done && !c.isdead() {
+					var reply QueryReply
+					ok := c.call("Server.Subscribe", SubscribeArg{View: c.doc.View, Client: c.id, Doc: c.docname}, &reply)
+
+					if ok && reply.Err == "OK" {
+						// apply commited ops
+						var commits []Op
+						json.Unmarshal(reply.Data, &commits)
+
+						if len(commits) > 0 {
+							done = c.applyCommits(commits, c.session, c.id)
+						}
+					} else {
+						if ok && reply.Err == "BAD" {
+							_, i := c.server()
+							c.failover(i)
+						}
+						time.Sleep(pullDelay)
+					}
+				}
+
+				c.mu.Lock()
+				c.tempdoc = *c.doc.dup()
+				c.opNum = c.doc.UserSeqs[c.id]
+				c.crdtNum = c.doc.CrdtSeqs[c.id]
+				c.numusers = len(c.doc.UserPos)
+				c.joined = true
+				for user := range c.doc.UserSession {
+					if _, ok := c.active[user]; !ok {
+						// as far as we know
+						c.active[user] = time.Now()
+					}
+				}
+				c.wake()
+				c.mu.Unlock()
+				return nil
+			} else if reply.Err == "NoDoc" {
+				return fmt.Errorf("no document %q", c.docname)
+			} else if reply.Err == "Full" {
+				return fmt.Errorf("document %q has as many users as it takes", c.docname)
+			} else {
+				time.Sleep(time.Second)
 			}
-		} else {
-			sb.WriteRune(r)
-			newrow.Temp[x] = row.Temp[i]
-			newrow.Author[x] = row.Author[i]
-			x++
+
+		} else if tries%len(c.servers) == 0 {
+			// tried everyone
+			log.Println("No replica is answering, retrying")
+			time.Sleep(time.Second)
 		}
 	}
-	newrow.Chars = sb.String()
-	return &newrow
+	return fmt.Errorf("closed before connecting")
 }
@@ -0,0 +1,149 @@
+package gopad
+
+// Log entry encoding.
+//
+// The server hands paxos a []byte for every entry:
+//
+//	[1 byte version][1 byte type][8 byte xid][gob payload]
+//
+// The payload is gob of the type's own struct, so fields can be added to
+// Op or ConfigChange without a new version; old replicas ignore the new
+// fields and new replicas see zero values in old entries.  Anything that
+// changes the meaning of an entry needs a new version.
+//
+// Version 0 is how entries went out before this: a bare Paxage sent
+// through gob's interface registry.  We still read those and write them
+// with -w 0, so replicas can be upgraded one at a time.  The RPCs between
+// peers follow the same rule as payloads: fields keep their types and new
+// ones go next to them (DoneArgs.Addr beside the index in Me, Op.Motion
+// beside the termbox key in Move).  Until the last replica is upgraded,
+// clients should stick to ops the older builds know.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+const (
+	wireLegacy  = 0 // bare Paxage
+	wireVersion = 1 // newest version we know how to write
+)
+
+// entry types
+const (
+	entryOps    = 1
+	entryConfig = 2
+	entryMode   = 3
+	entryDocs   = 4
+)
+
+const entryHeader = 10
+
+var errShortEntry = errors.New("codec: short entry")
+
+// EncodeEntry turns p into a paxos value in wire format version.
+func EncodeEntry(p Paxage, version int) (interface{}, error) {
+	if version == wireLegacy {
+		return p, nil
+	}
+	if version != wireVersion {
+		return nil, fmt.Errorf("codec: can't write version %d", version)
+	}
+
+	var tag byte
+	switch p.Payload.(type) {
+	case []Op:
+		tag = entryOps
+	case ConfigChange:
+		tag = entryConfig
+	case ModeChange:
+		tag = entryMode
+	case DocChange:
+		tag = entryDocs
+	default:
+		return nil, fmt.Errorf("codec: can't encode %T", p.Payload)
+	}
+
+	var b bytes.Buffer
+	b.Write([]byte{byte(version), tag})
+	binary.Write(&b, binary.BigEndian, p.Xid)
+	if err := gob.NewEncoder(&b).Encode(p.Payload); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// DecodeEntry turns a decided paxos value back into a Paxage.  It fails
+// on entries written by a newer build than this one.
+func DecodeEntry(v interface{}) (Paxage, error) {
+	switch v := v.(type) {
+	case Paxage:
+		return v, nil
+	case []byte:
+		return decodeEntry(v)
+	default:
+		return Paxage{}, fmt.Errorf("codec: unexpected value %T", v)
+	}
+}
+
+func decodeEntry(buf []byte) (Paxage, error) {
+	var p Paxage
+	if len(buf) < entryHeader {
+		return p, errShortEntry
+	}
+
+	version, tag := int(buf[0]), buf[1]
+	if version > wireVersion {
+		return p, fmt.Errorf("codec: entry version %d is newer than %d", version, wireVersion)
+	}
+	p.Xid = int64(binary.BigEndian.Uint64(buf[2:entryHeader]))
+
+	dec := gob.NewDecoder(bytes.NewReader(buf[entryHeader:]))
+	switch tag {
+	case entryOps:
+		var ops []Op
+		if err := dec.Decode(&ops); err != nil {
+			return p, err
+		}
+		if ops == nil {
+			ops = []Op{}
+		}
+		p.Payload = ops
+	case entryConfig:
+		var ch ConfigChange
+		if err := dec.Decode(&ch); err != nil {
+			return p, err
+		}
+		p.Payload = ch
+	case entryMode:
+		var ch ModeChange
+		if err := dec.Decode(&ch); err != nil {
+			return p, err
+		}
+		p.Payload = ch
+	case entryDocs:
+		var ch DocChange
+		if err := dec.Decode(&ch); err != nil {
+			return p, err
+		}
+		p.Payload = ch
+	default:
+		return p, fmt.Errorf("codec: unknown entry type %d", tag)
+	}
+	return p, nil
+}
+
+// SetWireVersion picks the format for entries this replica proposes.
+// Keep it at 0 until every replica runs a build that reads version 1.
+func (s *Server) SetWireVersion(version int) error {
+	if version < wireLegacy || version > wireVersion {
+		return fmt.Errorf("codec: no wire version %d", version)
+	}
+	s.mu.Lock()
+	s.wire = version
+	s.mu.Unlock()
+	return nil
+}
@@ -3,16 +3,13 @@ package gopad
 import (
 	"bytes"
 	"encoding/gob"
-	"github.com/nsf/termbox-go"
+	"fmt"
+	"github.com/mattn/go-runewidth"
 	"log"
-	"net/rpc"
-	"os"
+	"time"
 )
 
-var COLORS = []termbox.Attribute{16, 10, 11, 15, 0}
-var CURSORS = []termbox.Attribute{253, 211, 121, 124, 0}
-
-const MAXUSERS = 3
+const MAXUSERS = 3 // most users in a document, unless SetMaxUsers says otherwise
 const TABSTOP = 4
 
 const (
@@ -25,13 +22,22 @@ const (
 	Newline
 	Init
 	Move
-	Quit
+	Quit     // a session ended, see session.go
+	InsertAt // positional, see ot.go
+	DeleteAt
+	CrdtInsert // ModeCRDT, see crdt.go
+	CrdtDelete
+	CrdtStart  // the switch to ModeCRDT, committed like other ops
+	Save       // replicas write the document out, see save.go
+	Select     // set or clear a mark, see select.go
+	Range      // several positional edits in one op
+	InsertText // a string at one offset, for pastes
 )
 
 type Err string
 
 type erow struct {
-	Chars  string
+	Chars  []rune // X in a Pos counts these
 	Temp   []bool // really shouldn't be here but whatever
 	Author []int
 }
@@ -44,10 +50,23 @@ type Doc struct {
 	Rows        []erow
 	View        uint32
 	Colors      map[int]int
-	Users       []string    // starting username (not implemented)
-	UserPos     map[int]Pos // position of users in document
+	Names       map[int]string // display name each user gave in Init
+	UserPos     map[int]Pos    // position of users in document
 	UserSeqs    map[int]uint32
 	UserSession map[int]uint32
+	History     []pastEdit // recent edits, to transform ops against
+	HistFrom    uint32     // edits up to this view are forgotten
+
+	Mode     int            // ModeOrdered or ModeCRDT
+	Text     rga            // the text in ModeCRDT, Rows follow it
+	CrdtSeqs map[int]uint32 // CRDT ops applied per user
+	Anchors  map[int]ElemID // rune each user's cursor is after
+
+	Saved uint32 // view of the last Save
+
+	Marks map[int]int // offset of each user's mark, the selection runs to their cursor
+
+	MaxUsers int // most users at once, 0 for the server's limit
 }
 
 // transport version of doc
@@ -62,32 +81,106 @@ type Doc struct {
 // }
 
 type Op struct {
-	Type int
-	Data rune
-	Move termbox.Key
+	Type   int
+	Data   rune
+	Move   uint16 // termbox key for Move, from builds before Motion
+	Motion int    // for Move, see motion.go
+	At     int    // offset for InsertAt and DeleteAt, color asked for in Init
+	ID     ElemID // rune a CrdtInsert makes or a CrdtDelete kills
+	Ref    ElemID // rune a CrdtInsert goes after
+	Edits  []Edit // for Range, made one after the other
+	Text   string // for InsertText, may run over several rows, name for Init
+	Max    int    // most users for Init, 0 for no limit
 	// X, Y   int
 	View    uint32 // last document view seen by user
 	Seq     uint32 // sequential number for each user
 	Client  int
 	Session uint32
+	Doc     string // set by the replica that takes it
 }
 
 type InitArg struct {
 	Client  int
 	Session uint32
+	Doc     string
+	Name    string // to show others, "" for "user <Client>"
+	Color   int    // color wanted, 0 for any free one
 }
 
 type QueryArg struct {
 	View   uint32
 	Client int
+	Doc    string
+}
+
+type SubscribeArg struct {
+	View   uint32
+	Client int
+	Max    int // most ops to send back, 0 for the server's limit
+	Doc    string
+}
+
+type MergeArg struct {
+	Data []byte // json of []Op
+	Doc  string
+}
+
+type SyncArg struct {
+	Have   map[int]uint32 // CRDT ops seen per user
+	Wait   bool           // hold on until there's something new
+	Doc    string
+	Client int // user asking, if Wait.  replicas don't wait
+}
+
+type ModeArg struct {
+	Mode int
+	Doc  string
 }
 
 type OpArg struct {
-	Data []byte
-	Xid  int64
+	Data      []byte
+	Xid       int64
+	Forwarded bool // already passed on by a follower
+	Doc       string
 }
 
-type RecoverArg struct {
+type SaveArg struct {
+	Doc string
+}
+
+type LeaveArg struct {
+	Client  int
+	Session uint32
+	Doc     string
+}
+
+type LeaveReply struct {
+	Err Err
+}
+
+type HeardArg struct {
+	Client int
+	Doc    string
+}
+
+type HeardReply struct {
+	Ago time.Duration // since we last heard from the user
+	Err Err           // "None" if we never have
+}
+
+type DocArg struct {
+	Name     string
+	To       string   // new name, for renames
+	Rows     []string // initial text, for creates
+	MaxUsers int      // for creates, 0 for the server's limit
+}
+
+type SnapshotArg struct {
+}
+
+type ChunkArg struct {
+	Seq    int
+	Offset int
 }
 
 type InitReply struct {
@@ -100,38 +193,64 @@ type OpReply struct {
 	Err Err
 }
 
+type MergeReply struct {
+	Err Err
+}
+
+type SyncReply struct {
+	Data   []byte         // json of []Op
+	Colors map[int]int    // so clients know who's who
+	Names  map[int]string // and what to call them
+	Saved  uint32         // view of the last Save
+	Err    Err
+}
+
+type ModeReply struct {
+	Err Err
+}
+
+type SaveReply struct {
+	View uint32 // the document's view once saved
+	Err  Err
+}
+
+type DocReply struct {
+	Names []string // for ListDocs
+	Err   Err
+}
+
 type QueryReply struct {
 	Data []byte
 	Err  Err
 }
 
-type RecoverReply struct {
-	Srv []byte
-	Px  []byte
-	Doc []byte
-	Err Err
+type SnapshotReply struct {
+	Seq  int
+	Size int
+	Sum  [32]byte
+	Tip  int // first instance the sender has not applied
+	Err  Err
 }
 
-func call(srv string, rpcname string, args interface{}, reply interface{}, verbose bool) bool {
+type ChunkReply struct {
+	Data []byte
+	Err  Err
+}
 
-	// attempt to dial
-	c, err := rpc.Dial("tcp", srv)
-	if err != nil {
-		if verbose {
-			log.Printf("Couldn't connect to %s -- %s\n", srv, rpcname)
-		}
-		return false
-	}
-	defer c.Close()
+type ReconfigArg struct {
+	Add    []string
+	Remove []string
+}
 
-	err = c.Call(rpcname, args, reply)
-	if err != nil {
-		if verbose {
-			log.Println(err)
-		}
-		return false
-	}
-	return true
+type ReconfigReply struct {
+	Num  int // the new config
+	From int // first instance it decides
+	Err  Err
+}
+
+// make an RPC over the shared connection pool
+func call(srv string, rpcname string, args interface{}, reply interface{}, verbose bool) bool {
+	return conns.Call(srv, rpcname, args, reply, verbose)
 }
 
 /*** copy functions ***/
@@ -143,45 +262,79 @@ func (row *erow) copy() *erow {
 	copy(a, row.Author)
 
 	return &erow{
-		Chars:  row.Chars,
+		Chars:  append([]rune{}, row.Chars...),
 		Temp:   t,
 		Author: a,
 	}
 }
 
-// write doc
-func (doc *Doc) write(filename string) bool {
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+// doc as a file
+func (doc *Doc) file() []byte {
+	var b bytes.Buffer
+	for _, row := range doc.Rows {
+		b.WriteString(string(row.Chars) + "\n")
+	}
+	return b.Bytes()
+}
 
-	if err != nil {
-		return false
+// color for a new user, want if it's free, else the lowest free one.
+// colors go from 1 up, clients make up a palette for however many there
+// are
+func (doc *Doc) freeColor(want int) int {
+	taken := make(map[int]bool)
+	for _, color := range doc.Colors {
+		taken[color] = true
 	}
+	if want > 0 && !taken[want] {
+		return want
+	}
+	color := 1
+	for taken[color] {
+		color++
+	}
+	return color
+}
 
-	for _, row := range doc.Rows {
-		f.WriteString(row.Chars + string("\n"))
+// what to call user id
+func (doc *Doc) userName(id int) string {
+	if name := doc.Names[id]; name != "" {
+		return name
 	}
-	f.Close()
-	return true
+	return fmt.Sprintf("user %d", id)
 }
 
 // copies doc
 func (doc *Doc) dup() *Doc {
-	d := Doc{View: doc.View}
+	d := Doc{View: doc.View, HistFrom: doc.HistFrom, Mode: doc.Mode, Text: doc.Text.dup(), Saved: doc.Saved, MaxUsers: doc.MaxUsers}
+	d.History = append([]pastEdit{}, doc.History...)
+	d.CrdtSeqs = make(map[int]uint32)
+	for k, v := range doc.CrdtSeqs {
+		d.CrdtSeqs[k] = v
+	}
+	d.Anchors = make(map[int]ElemID)
+	for k, v := range doc.Anchors {
+		d.Anchors[k] = v
+	}
+	d.Marks = make(map[int]int)
+	for k, v := range doc.Marks {
+		d.Marks[k] = v
+	}
 	d.Rows = make([]erow, len(doc.Rows))
 	for i := 0; i < len(d.Rows); i++ {
 		d.Rows[i] = *doc.Rows[i].copy()
 	}
 
 	d.UserSeqs = make(map[int]uint32)
-	d.Users = make([]string, len(doc.Users))
 	d.Colors = make(map[int]int)
 	d.UserSession = make(map[int]uint32)
 
-	copy(d.Users, doc.Users)
-
 	for k, v := range doc.Colors {
 		d.Colors[k] = v
 	}
+	d.Names = make(map[int]string)
+	for k, v := range doc.Names {
+		d.Names[k] = v
+	}
 
 	for k, v := range doc.UserSeqs {
 		d.UserSeqs[k] = v
@@ -249,7 +402,7 @@ func bytesToDoc(b []byte, d *Doc) error {
 	dec := gob.NewDecoder(buf)
 	err := dec.Decode(d)
 	if err != nil {
-		log.Fatal("decode:", err)
+		log.Println("decode:", err)
 	}
 
 	// d.View = doc.View
@@ -279,30 +432,95 @@ func bytesToDoc(b []byte, d *Doc) error {
 
 // Update commited ops if possible and return whether applied
 func (doc *Doc) apply(op Op, temp bool) bool {
+	if op.Type == CrdtInsert || op.Type == CrdtDelete {
+		return doc.applyCRDT(op, temp)
+	}
+	if op.Type == CrdtStart {
+		doc.startCRDT()
+		doc.View++
+		return true
+	}
+	if op.Type == Save {
+		doc.View++
+		doc.Saved = doc.View
+		return true
+	}
+	if op.Type == Quit {
+		// goes by session, not Seq, like Init
+		if !doc.leave(op.Client, op.Session) {
+			return false
+		}
+		doc.View++
+		return true
+	}
+	if doc.Mode == ModeCRDT && op.Type != Init && op.Type != Move {
+		// the text belongs to the CRDT now, just use up the seq
+		op.Type = noEdit
+	}
+
 	if op.Seq == doc.UserSeqs[op.Client]+1 || (op.Type == Init && op.Session != doc.UserSession[op.Client]) {
 		switch op.Type {
 		case Insert:
+			e := Edit{Type: InsertAt, At: doc.Offset(doc.UserPos[op.Client]), Data: op.Data, Client: op.Client}
+			doc.record(e, e, op)
 			editorInsertRune(doc, op.Client, op.Data, temp)
 			break
+		case InsertAt, DeleteAt, InsertText:
+			doc.applyPositional(op, op.edit(), temp)
+			break
+		case Range:
+			// the cursor moves with the edits like a mark, instead of
+			// jumping to each one
+			at := doc.Offset(doc.UserPos[op.Client])
+			for _, x := range op.Edits {
+				e := doc.applyPositional(op, x, temp)
+				at = Transform(Edit{Type: Select, At: at, Client: op.Client}, e).At
+			}
+			if pos, ok := doc.posAt(at); ok {
+				doc.UserPos[op.Client] = pos
+			}
+			break
+		case Select:
+			doc.setMark(op)
+			break
+		case noEdit:
+			break
 		case Init:
-			if doc.UserSeqs[op.Client] == 0 {
-				doc.Colors[op.Client] = len(doc.Colors) + 1
+			if _, ok := doc.Colors[op.Client]; !ok {
+				if op.Max > 0 && len(doc.Colors) >= op.Max {
+					// somebody else got the last spot first
+					return false
+				}
+				doc.Colors[op.Client] = doc.freeColor(op.At)
 			}
+			if doc.Names == nil {
+				// gob leaves empty maps out
+				doc.Names = make(map[int]string)
+			}
+			doc.Names[op.Client] = op.Text
 			doc.UserPos[op.Client] = Pos{}
+			doc.UserSession[op.Client] = op.Session
 			break
 		case Move:
-			editorMoveCursor(doc, op.Client, op.Move)
+			doc.move(op)
 			break
 		case Delete:
+			if at := doc.Offset(doc.UserPos[op.Client]); at > 0 && doc.UserPos[op.Client].Y < len(doc.Rows) {
+				e := Edit{Type: DeleteAt, At: at - 1, Data: doc.runeAt(at - 1), Client: op.Client}
+				doc.record(e, e, op)
+			}
 			editorDelRune(doc, op.Client)
 			break
 		case Newline:
+			e := Edit{Type: InsertAt, At: doc.Offset(doc.UserPos[op.Client]), Data: '\n', Client: op.Client}
+			doc.record(e, e, op)
 			editorInsertNewLine(doc, op.Client)
 			break
 		default:
 			return false
 		}
 
+		doc.forget(op)
 		doc.View++
 		doc.UserSeqs[op.Client]++
 		return true
@@ -312,7 +530,7 @@ func (doc *Doc) apply(op Op, temp bool) bool {
 
 /*** input ***/
 
-func editorMoveCursor(doc *Doc, id int, key termbox.Key) {
+func editorMoveCursor(doc *Doc, id int, motion int) {
 	pos := doc.UserPos[id]
 	var row *erow
 	if pos.Y < len(doc.Rows) {
@@ -323,45 +541,70 @@ func editorMoveCursor(doc *Doc, id int, key termbox.Key) {
 
 	oldRx := editorRowCxToRx(&doc.Rows[pos.Y], pos.X)
 
-	switch key {
-	case termbox.KeyArrowRight:
+	switch motion {
+	case MoveRight:
 		if row != nil && pos.X < len(row.Chars) {
 			pos.X++
+			// over any combining marks too
+			for pos.X < len(row.Chars) && docWidths.RuneWidth(row.Chars[pos.X]) == 0 {
+				pos.X++
+			}
 		} else if row != nil && pos.X >= len(row.Chars) && pos.Y < len(doc.Rows)-1 {
 			pos.Y++
 			pos.X = 0
 		}
 		doc.UserPos[id] = pos
 		return
-	case termbox.KeyArrowLeft:
+	case MoveLeft:
 		if pos.X != 0 {
 			pos.X--
+			for pos.X > 0 && row != nil && docWidths.RuneWidth(row.Chars[pos.X]) == 0 {
+				pos.X--
+			}
 		} else if pos.Y > 0 {
 			pos.Y--
 			pos.X = len(doc.Rows[pos.Y].Chars)
 		}
 		doc.UserPos[id] = pos
 		return
-	case termbox.KeyArrowDown:
+	case MoveDown:
 		if pos.Y < len(doc.Rows)-1 {
 			pos.Y++
 		}
 		doc.UserPos[id] = pos
-	case termbox.KeyArrowUp:
+	case MoveUp:
 		if pos.Y != 0 {
 			pos.Y--
 		}
 		doc.UserPos[id] = pos
-	case termbox.KeyHome:
+	case MoveLineStart:
 		pos.X = 0
 		doc.UserPos[id] = pos
 		return
-	case termbox.KeyEnd:
+	case MoveLineEnd:
 		if pos.Y < len(doc.Rows) {
 			pos.X = len(doc.Rows[pos.Y].Chars)
 		}
 		doc.UserPos[id] = pos
 		return
+	case MoveWordLeft, MoveWordRight, MoveDocStart, MoveDocEnd:
+		at := doc.Offset(pos)
+		switch motion {
+		case MoveWordLeft:
+			at = doc.wordLeft(at)
+		case MoveWordRight:
+			at = doc.wordRight(at)
+		case MoveDocStart:
+			at = 0
+		case MoveDocEnd:
+			at = doc.size()
+		}
+		if pos, ok := doc.posAt(at); ok {
+			doc.UserPos[id] = pos
+		}
+		return
+	default:
+		return
 	}
 
 	rowlen := 0
@@ -385,7 +628,7 @@ func editorInsertRune(doc *Doc, id int, key rune, temp bool) {
 	pos := doc.UserPos[id]
 
 	if pos.Y == len(doc.Rows) {
-		doc.insertRow(pos.Y, "", []bool{}, []int{})
+		doc.insertRow(pos.Y, []rune{}, []bool{}, []int{})
 	}
 
 	doc.rowInsertRune(pos.X, pos.Y, key, id, temp)
@@ -406,20 +649,7 @@ func editorInsertRune(doc *Doc, id int, key rune, temp bool) {
 
 func editorInsertNewLine(doc *Doc, id int) {
 	pos := doc.UserPos[id]
-
-	if pos.X == 0 {
-		doc.insertRow(pos.Y, "", []bool{}, []int{})
-	} else {
-		row := &doc.Rows[pos.Y]
-		t := make([]bool, len(row.Temp)-pos.X)
-		a := make([]int, len(row.Temp)-pos.X)
-		copy(t, row.Temp[pos.X:])
-		copy(a, row.Author[pos.X:])
-		doc.insertRow(pos.Y+1, row.Chars[pos.X:], t, a)
-		doc.Rows[pos.Y].Chars = row.Chars[:pos.X]
-		doc.Rows[pos.Y].Temp = row.Temp[:pos.X]
-		doc.Rows[pos.Y].Author = row.Author[:pos.X]
-	}
+	doc.splitRow(pos.X, pos.Y)
 
 	for k, npos := range doc.UserPos {
 		// update other positions
@@ -488,13 +718,30 @@ func editorDelRune(doc *Doc, id int) {
 
 /*** row operations ***/
 
-func (doc *Doc) insertRow(at int, ch string, temp []bool, auth []int) {
+func (doc *Doc) insertRow(at int, ch []rune, temp []bool, auth []int) {
 	// doc.Rows = append(doc.Rows, erow{Chars: s})
 	doc.Rows = append(doc.Rows, erow{})
 	copy(doc.Rows[at+1:], doc.Rows[at:])
 	doc.Rows[at] = erow{Chars: ch, Temp: temp, Author: auth}
 }
 
+// break row[aty] in two at position atx
+func (doc *Doc) splitRow(atx, aty int) {
+	if atx == 0 {
+		doc.insertRow(aty, []rune{}, []bool{}, []int{})
+		return
+	}
+	row := &doc.Rows[aty]
+	t := make([]bool, len(row.Temp)-atx)
+	a := make([]int, len(row.Temp)-atx)
+	copy(t, row.Temp[atx:])
+	copy(a, row.Author[atx:])
+	doc.insertRow(aty+1, append([]rune{}, row.Chars[atx:]...), t, a)
+	doc.Rows[aty].Chars = row.Chars[:atx]
+	doc.Rows[aty].Temp = row.Temp[:atx]
+	doc.Rows[aty].Author = row.Author[:atx]
+}
+
 // insert rune into row[aty] at position atx
 func (doc *Doc) rowInsertRune(atx, aty int, key rune, id int, temp bool) {
 	row := &doc.Rows[aty]
@@ -503,10 +750,9 @@ func (doc *Doc) rowInsertRune(atx, aty int, key rune, id int, temp bool) {
 		atx = len(row.Chars)
 	}
 
-	s := row.Chars[0:atx]
-	s += string(key)
-	s += row.Chars[atx:]
-	row.Chars = s
+	row.Chars = append(row.Chars, 0)
+	copy(row.Chars[atx+1:], row.Chars[atx:])
+	row.Chars[atx] = key
 
 	row.Temp = append(row.Temp, false)
 	copy(row.Temp[atx+1:], row.Temp[atx:])
@@ -526,7 +772,7 @@ func (doc *Doc) rowDelRune(atx, aty int) {
 		atx = len(row.Chars)
 	}
 
-	row.Chars = row.Chars[0:atx-1] + row.Chars[atx:]
+	row.Chars = append(row.Chars[0:atx-1], row.Chars[atx:]...)
 	row.Temp = append(row.Temp[0:atx-1], row.Temp[atx:]...)
 	row.Author = append(row.Author[0:atx-1], row.Author[atx:]...)
 }
@@ -536,7 +782,7 @@ func (doc *Doc) editorDelRow(at int) {
 		return
 	}
 
-	doc.Rows[at-1].Chars += doc.Rows[at].Chars
+	doc.Rows[at-1].Chars = append(doc.Rows[at-1].Chars, doc.Rows[at].Chars...)
 	doc.Rows[at-1].Temp = append(doc.Rows[at-1].Temp, doc.Rows[at].Temp...)
 	doc.Rows[at-1].Author = append(doc.Rows[at-1].Author, doc.Rows[at].Author...)
 	copy(doc.Rows[at:], doc.Rows[at+1:])
@@ -545,13 +791,24 @@ func (doc *Doc) editorDelRow(at int) {
 
 /*** tabs ***/
 
+// widths cursor moves go by.  every replica applies them, so they can't
+// depend on the locale, like runewidth's defaults do.  terminals draw with
+// their own
+var docWidths = &runewidth.Condition{EastAsianWidth: false}
+
+// columns rune r takes up on screen when it starts at column rx
+func runeWidth(r rune, rx int) int {
+	if r == '\t' {
+		return TABSTOP - rx%TABSTOP
+	}
+	// wide CJK runes take two, combining marks none
+	return docWidths.RuneWidth(r)
+}
+
 func editorRowCxToRx(row *erow, atx int) int {
 	rx := 0
-	for j := 0; j < atx; j++ {
-		if row.Chars[j] == '\t' {
-			rx += (TABSTOP - 1) - (rx % TABSTOP)
-		}
-		rx++
+	for j := 0; j < atx && j < len(row.Chars); j++ {
+		rx += runeWidth(row.Chars[j], rx)
 	}
 	return rx
 }
@@ -560,10 +817,7 @@ func editorRowRxToCx(row *erow, rx int) int {
 	curRx := 0
 	cx := 0
 	for ; cx < len(row.Chars); cx++ {
-		if row.Chars[cx] == '\t' {
-			curRx += (TABSTOP - 1) - (curRx % TABSTOP)
-		}
-		curRx++
+		curRx += runeWidth(row.Chars[cx], curRx)
 
 		if curRx > rx {
 			return cx
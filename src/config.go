@@ -0,0 +1,256 @@
+package gopad
+
+// Cluster membership.
+//
+// The replica set is kept in the paxos log itself.  A ConfigChange
+// decided in instance i takes effect at instance i+configAlpha, so the
+// config for any instance is fixed by the log before it.  To make sure a
+// proposer knows that config, it never proposes configAlpha or more
+// instances past what the application has applied (see SetApplied).
+//
+// Every member gets an id the first time it is added.  Ids are never
+// reused, and ballots are round*ballotStride + id.
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	configAlpha  = 16      // instances before a config change takes effect
+	ballotStride = 1 << 16 // more than the number of ids ever handed out
+)
+
+type Config struct {
+	Num    int            // configs are numbered 0, 1, 2, ...
+	From   int            // first instance this config decides
+	Peers  map[string]int // address -> id
+	NextID int            // id for the next added peer
+}
+
+// a membership change, agreed on like any other value
+type ConfigChange struct {
+	Num    int // the config this creates
+	Add    []string
+	Remove []string
+}
+
+// the starting config, peers get ids by position
+func initialConfig(peers []string) Config {
+	c := Config{Peers: make(map[string]int), NextID: len(peers)}
+	for i, p := range peers {
+		c.Peers[p] = i
+	}
+	return c
+}
+
+// members in a stable order
+func (c Config) members() []string {
+	var m []string
+	for p := range c.Peers {
+		m = append(m, p)
+	}
+	sort.Strings(m)
+	return m
+}
+
+// the config ch makes when decided in instance seq
+func (c Config) next(ch ConfigChange, seq int) Config {
+	n := Config{Num: c.Num + 1, From: seq + configAlpha, Peers: make(map[string]int), NextID: c.NextID}
+	for p, id := range c.Peers {
+		n.Peers[p] = id
+	}
+	for _, p := range ch.Remove {
+		delete(n.Peers, p)
+	}
+	for _, p := range ch.Add {
+		if _, ok := n.Peers[p]; !ok {
+			n.Peers[p] = n.NextID
+			n.NextID++
+		}
+	}
+	return n
+}
+
+// SetConfigs tells paxos the membership history, oldest first.  Every
+// instance uses the last config whose From is not after it.
+func (px *Paxos) SetConfigs(configs []Config) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.configs = append([]Config(nil), configs...)
+
+	known := map[string]bool{px.me: true}
+	for _, c := range px.configs {
+		for p := range c.Peers {
+			known[p] = true
+			if _, ok := px.DoneSeqs[p]; !ok {
+				// a new peer has nothing to catch up on from before
+				// the change that added it
+				done := c.From - configAlpha
+				if done < -1 {
+					done = -1
+				}
+				px.DoneSeqs[p] = done
+			}
+		}
+	}
+	for p := range px.DoneSeqs {
+		if !known[p] {
+			delete(px.DoneSeqs, p)
+		}
+	}
+}
+
+// SetApplied tells paxos the application has applied every instance
+// below seq, so it knows the config up to seq+configAlpha.  Until this is
+// called there is no limit and the membership must not change.
+func (px *Paxos) SetApplied(seq int) {
+	px.mu.Lock()
+	if seq > px.applied {
+		px.applied = seq
+	}
+	px.mu.Unlock()
+}
+
+// config that decides seq.  must hold px.mu
+func (px *Paxos) configFor(seq int) Config {
+	for i := len(px.configs) - 1; i >= 0; i-- {
+		if px.configs[i].From <= seq {
+			return px.configs[i]
+		}
+	}
+	if len(px.configs) > 0 {
+		return px.configs[0]
+	}
+	return Config{}
+}
+
+// the newest config we know of.  must hold px.mu
+func (px *Paxos) latestConfig() Config {
+	if len(px.configs) == 0 {
+		return Config{}
+	}
+	return px.configs[len(px.configs)-1]
+}
+
+// every peer in any config we know of.  must hold px.mu
+func (px *Paxos) everyone() []string {
+	seen := make(map[string]bool)
+	var all []string
+	for _, c := range px.configs {
+		for _, p := range c.members() {
+			if !seen[p] {
+				seen[p] = true
+				all = append(all, p)
+			}
+		}
+	}
+	return all
+}
+
+// our ballot id, -1 if we were never added.  must hold px.mu
+func (px *Paxos) myID() int {
+	for i := len(px.configs) - 1; i >= 0; i-- {
+		if id, ok := px.configs[i].Peers[px.me]; ok {
+			return id
+		}
+	}
+	return -1
+}
+
+// address of the peer with ballot id, "" if there's none.  must hold
+// px.mu
+func (px *Paxos) peerWithID(id int) string {
+	for i := len(px.configs) - 1; i >= 0; i-- {
+		for p, pid := range px.configs[i].Peers {
+			if pid == id {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// whether we know enough to propose for seq.  must hold px.mu
+func (px *Paxos) canPropose(seq int) bool {
+	if px.myID() < 0 {
+		return false
+	}
+	return px.applied < 0 || seq < px.applied+configAlpha
+}
+
+// Reconfigure adds and removes replicas.  It returns once the change is
+// decided; it takes effect configAlpha instances later.
+func (s *Server) Reconfigure(arg ReconfigArg, reply *ReconfigReply) error {
+	s.mu.Lock()
+	cur := s.Configs[len(s.Configs)-1]
+	ch := ConfigChange{Num: cur.Num + 1, Add: arg.Add, Remove: arg.Remove}
+	next := cur.next(ch, 0)
+	s.mu.Unlock()
+
+	if len(next.Peers) == 0 {
+		reply.Err = "Empty"
+		return nil
+	}
+	if next.NextID >= ballotStride {
+		reply.Err = "TooMany"
+		return nil
+	}
+
+	seq := s.propose(ch)
+
+	// wait until it's applied to see whether it won
+	for {
+		s.mu.Lock()
+		if s.QuerySeq > seq {
+			break
+		}
+		s.mu.Unlock()
+		time.Sleep(updateDelay)
+	}
+	defer s.mu.Unlock()
+
+	for _, c := range s.Configs {
+		if c.Num == ch.Num && c.From == seq+configAlpha {
+			// new members bootstrap from a snapshot that has them in it
+			if err := s.takeSnapshot(); err != nil {
+				log.Println("Couldn't take snapshot", err)
+			}
+			reply.Num = c.Num
+			reply.From = c.From
+			reply.Err = "OK"
+			return nil
+		}
+	}
+	// somebody else changed the config first
+	reply.Err = "Stale"
+	return nil
+}
+
+// ChangeMembers asks the replica at srv to add and remove replicas.
+func ChangeMembers(srv string, add []string, remove []string) (ReconfigReply, bool) {
+	var reply ReconfigReply
+	ok := call(srv, "Server.Reconfigure", ReconfigArg{Add: add, Remove: remove}, &reply, true)
+	return reply, ok
+}
+
+// apply a decided config change.  must hold s.mu
+func (s *Server) applyConfig(ch ConfigChange, seq int) {
+	cur := s.Configs[len(s.Configs)-1]
+	if ch.Num != cur.Num+1 {
+		// proposed against an old config
+		return
+	}
+	next := cur.next(ch, seq)
+	s.Configs = append(s.Configs, next)
+	log.Printf("Config %d from instance %d: %v\n", next.Num, next.From, next.members())
+}
+
+// drop configs no instance we'll still apply uses.  must hold s.mu
+func (s *Server) pruneConfigs() {
+	for len(s.Configs) > 1 && s.Configs[1].From <= s.QuerySeq {
+		s.Configs = s.Configs[1:]
+	}
+}
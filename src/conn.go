@@ -0,0 +1,266 @@
+package gopad
+
+// Long lived RPC connections.
+//
+// Calls used to dial and close a connection per RPC.  Now every peer
+// address gets one *rpc.Client that is shared by all calls to it.  A
+// broken connection is dropped and redialed on the next call, with
+// exponential backoff between failed dials so a dead peer costs nothing.
+// Every call has a timeout so a hung peer can't block its caller.  A call
+// that times out is only given up on, the connection may be fine and
+// other calls still waiting on it.  After hungAfter timeouts in a row
+// with no reply in between, though, the connection is dropped and
+// redialed after a backoff like a broken one.
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	callTimeout = 2 * time.Second
+	minBackoff  = 50 * time.Millisecond
+	maxBackoff  = 5 * time.Second
+	hungAfter   = 3 // timeouts in a row before a connection is dropped
+)
+
+// RPCs that wait for agreement get longer than the default
+var rpcTimeouts = map[string]time.Duration{
+	"Server.Init":        30 * time.Second,
+	"Server.Handle":      30 * time.Second,
+	"Server.Reconfigure": 30 * time.Second,
+	"Server.Subscribe":   subscribeWait + 5*time.Second,
+	"Server.Sync":        subscribeWait + 5*time.Second,
+	"Server.SetMode":     30 * time.Second,
+	"Server.Save":        30 * time.Second,
+}
+
+var errBackoff = errors.New("waiting to redial")
+
+// ConnStats counts what a connection pool has done.
+type ConnStats struct {
+	Dials        int64
+	DialFailures int64
+	Calls        int64
+	CallFailures int64
+	Timeouts     int64
+	Hung         int64         // connections dropped after hungAfter timeouts
+	Latency      time.Duration // total time spent in successful calls
+}
+
+// average latency of a successful call
+func (st ConnStats) AvgLatency() time.Duration {
+	ok := st.Calls - st.CallFailures
+	if ok <= 0 {
+		return 0
+	}
+	return st.Latency / time.Duration(ok)
+}
+
+type peerConn struct {
+	mu       sync.Mutex
+	client   *rpc.Client
+	backoff  time.Duration
+	retry    time.Time // don't redial before this
+	timeouts int       // calls in a row that timed out on client
+}
+
+// ConnPool keeps a connection to each address it calls.
+type ConnPool struct {
+	mu      sync.Mutex
+	conns   map[string]*peerConn
+	timeout time.Duration
+	dial    func(addr string, timeout time.Duration) (net.Conn, error)
+	stats   ConnStats
+}
+
+var conns = NewConnPool(callTimeout, dialTCP)
+
+func dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// NewConnPool makes a pool whose calls time out after timeout, unless
+// they wait for agreement, and that connects with dial.
+func NewConnPool(timeout time.Duration, dial func(addr string, timeout time.Duration) (net.Conn, error)) *ConnPool {
+	return &ConnPool{
+		conns:   make(map[string]*peerConn),
+		timeout: timeout,
+		dial:    dial,
+	}
+}
+
+// RPCStats returns the counters of the shared connection pool.
+func RPCStats() ConnStats {
+	return conns.Stats()
+}
+
+// Stats returns what the pool has done so far.
+func (cm *ConnPool) Stats() ConnStats {
+	return ConnStats{
+		Dials:        atomic.LoadInt64(&cm.stats.Dials),
+		DialFailures: atomic.LoadInt64(&cm.stats.DialFailures),
+		Calls:        atomic.LoadInt64(&cm.stats.Calls),
+		CallFailures: atomic.LoadInt64(&cm.stats.CallFailures),
+		Timeouts:     atomic.LoadInt64(&cm.stats.Timeouts),
+		Hung:         atomic.LoadInt64(&cm.stats.Hung),
+		Latency:      time.Duration(atomic.LoadInt64((*int64)(&cm.stats.Latency))),
+	}
+}
+
+func (cm *ConnPool) peer(srv string) *peerConn {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	pc, ok := cm.conns[srv]
+	if !ok {
+		pc = &peerConn{}
+		cm.conns[srv] = pc
+	}
+	return pc
+}
+
+// get a connected client for srv, dialing if needed
+func (cm *ConnPool) client(srv string, pc *peerConn) (*rpc.Client, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.client != nil {
+		return pc.client, nil
+	}
+	if time.Now().Before(pc.retry) {
+		return nil, errBackoff
+	}
+
+	atomic.AddInt64(&cm.stats.Dials, 1)
+	conn, err := cm.dial(srv, cm.timeout)
+	if err != nil {
+		atomic.AddInt64(&cm.stats.DialFailures, 1)
+		pc.backOff()
+		return nil, err
+	}
+
+	pc.backoff = 0
+	pc.timeouts = 0
+	pc.client = rpc.NewClient(conn)
+	return pc.client, nil
+}
+
+// wait longer before the next dial.  must hold pc.mu
+func (pc *peerConn) backOff() {
+	if pc.backoff == 0 {
+		pc.backoff = minBackoff
+	} else if pc.backoff < maxBackoff {
+		pc.backoff *= 2
+	}
+	pc.retry = time.Now().Add(pc.backoff)
+}
+
+// a call on c timed out.  returns whether that makes hungAfter in a row,
+// in which case c is dropped and redialed after a backoff
+func (pc *peerConn) timedOut(c *rpc.Client) bool {
+	pc.mu.Lock()
+	if pc.client != c {
+		// already dropped
+		pc.mu.Unlock()
+		return false
+	}
+	pc.timeouts++
+	if pc.timeouts < hungAfter {
+		pc.mu.Unlock()
+		return false
+	}
+	pc.client = nil
+	pc.backOff()
+	pc.mu.Unlock()
+	c.Close()
+	return true
+}
+
+// a reply came back on c
+func (pc *peerConn) replied(c *rpc.Client) {
+	pc.mu.Lock()
+	if pc.client == c {
+		pc.timeouts = 0
+	}
+	pc.mu.Unlock()
+}
+
+// forget a broken client so the next call redials
+func (pc *peerConn) drop(c *rpc.Client) {
+	pc.mu.Lock()
+	if pc.client == c {
+		pc.client = nil
+	}
+	pc.mu.Unlock()
+	c.Close()
+}
+
+// Call makes an RPC to srv and returns whether a reply came back.
+func (cm *ConnPool) Call(srv string, rpcname string, args interface{}, reply interface{}, verbose bool) bool {
+	atomic.AddInt64(&cm.stats.Calls, 1)
+	pc := cm.peer(srv)
+
+	c, err := cm.client(srv, pc)
+	if err != nil {
+		atomic.AddInt64(&cm.stats.CallFailures, 1)
+		if verbose && err != errBackoff {
+			log.Printf("Couldn't connect to %s -- %s\n", srv, rpcname)
+		}
+		return false
+	}
+
+	// decode into a fresh reply so a call that times out can't write
+	// into the caller's reply after we've returned
+	tmp := reflect.New(reflect.TypeOf(reply).Elem())
+
+	timeout := cm.timeout
+	if t, ok := rpcTimeouts[rpcname]; ok {
+		timeout = t
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	rc := c.Go(rpcname, args, tmp.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-rc.Done:
+		err = rc.Error
+	case <-timer.C:
+		atomic.AddInt64(&cm.stats.Timeouts, 1)
+		atomic.AddInt64(&cm.stats.CallFailures, 1)
+		if verbose {
+			log.Printf("Timed out calling %s -- %s\n", srv, rpcname)
+		}
+		if pc.timedOut(c) {
+			atomic.AddInt64(&cm.stats.Hung, 1)
+		}
+		return false
+	}
+
+	if _, ok := err.(rpc.ServerError); err == nil || ok {
+		pc.replied(c)
+	}
+	if err != nil {
+		atomic.AddInt64(&cm.stats.CallFailures, 1)
+		if verbose {
+			log.Println(err)
+		}
+		if _, ok := err.(rpc.ServerError); !ok {
+			// connection is broken
+			pc.drop(c)
+		}
+		return false
+	}
+
+	atomic.AddInt64((*int64)(&cm.stats.Latency), int64(time.Since(start)))
+	reflect.ValueOf(reply).Elem().Set(tmp.Elem())
+	return true
+}
@@ -0,0 +1,607 @@
+package gopad
+
+// Sequence CRDT document mode.
+//
+// In ModeCRDT the text is an RGA: every rune ever inserted keeps an
+// ElemID and the ID of the rune it went in after, deletes only mark runes
+// dead, and runes inserted after the same one are ordered newest first.
+// Inserts and deletes skip paxos.  A replica applies one as soon as it
+// has the rune it refers to and the client's earlier ones, so clients can
+// keep editing while cut off from a majority, or from everyone, and
+// replicas end up with the same text whatever order ops reach them in.
+// Replicas pull each other's ops with Sync, and so do clients.  Paxos
+// still orders Init, membership and the switch to ModeCRDT.
+//
+// The switch happens once, through the log, so every replica builds the
+// RGA from the same text.  CRDT ops are durable once a snapshot or
+// another replica has them.
+//
+// Cursor moves aren't sent in this mode; others see your cursor after the
+// last rune you touched.
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	ModeOrdered = iota // paxos orders every op
+	ModeCRDT
+)
+
+const gossipDelay = 100 * time.Millisecond
+
+// ElemID names a rune in a CRDT document: the Lamport clock of its insert
+// and who inserted it.  The zero ElemID is the start of the document.
+type ElemID struct {
+	Clock  uint64
+	Client int
+}
+
+func (a ElemID) newer(b ElemID) bool {
+	return a.Clock > b.Clock || (a.Clock == b.Clock && a.Client > b.Client)
+}
+
+type elem struct {
+	ID   ElemID
+	Data rune
+	Dead bool
+	Temp bool // not back from a replica yet
+}
+
+type rga struct {
+	Elems []elem
+	Clock uint64 // highest clock seen
+
+	index map[ElemID]int // where each rune was, inserts may since have moved it right
+	lines []int          // where the live newlines are, in order
+}
+
+// ModeChange is the paxos payload that switches the document's mode.
+type ModeChange struct {
+	Mode int
+	Doc  string
+}
+
+// index an rga that came from gob or dup
+func (r *rga) reindex() {
+	r.index = make(map[ElemID]int, len(r.Elems))
+	r.lines = nil
+	for i, e := range r.Elems {
+		r.index[e.ID] = i
+		if e.Data == '\n' && !e.Dead {
+			r.lines = append(r.lines, i)
+		}
+	}
+}
+
+func (r *rga) find(id ElemID) (int, bool) {
+	if id == (ElemID{}) {
+		return -1, true
+	}
+	if r.index == nil {
+		r.reindex()
+	}
+	i, ok := r.index[id]
+	if !ok {
+		return 0, false
+	}
+	// runes only ever move right, as others go in before them
+	for r.Elems[i].ID != id {
+		i++
+	}
+	r.index[id] = i
+	return i, true
+}
+
+// insert ch as id after ref and return where it went, -1 if it was
+// already there.  false if ref isn't here yet
+func (r *rga) insert(id ElemID, ref ElemID, ch rune, temp bool) (int, bool) {
+	if _, ok := r.find(id); ok {
+		return -1, true
+	}
+	i, ok := r.find(ref)
+	if !ok {
+		return 0, false
+	}
+
+	// skip runes inserted after ref later than us
+	j := i + 1
+	for j < len(r.Elems) && r.Elems[j].ID.newer(id) {
+		j++
+	}
+	r.Elems = append(r.Elems, elem{})
+	copy(r.Elems[j+1:], r.Elems[j:])
+	r.Elems[j] = elem{ID: id, Data: ch, Temp: temp}
+	r.index[id] = j
+
+	n := sort.SearchInts(r.lines, j)
+	for k := n; k < len(r.lines); k++ {
+		r.lines[k]++
+	}
+	if ch == '\n' {
+		r.lines = append(r.lines, 0)
+		copy(r.lines[n+1:], r.lines[n:])
+		r.lines[n] = j
+	}
+
+	if id.Clock > r.Clock {
+		r.Clock = id.Clock
+	}
+	return j, true
+}
+
+// mark id dead and return where it is, -1 if it already was.  false if
+// id isn't here yet
+func (r *rga) remove(id ElemID) (int, bool) {
+	i, ok := r.find(id)
+	if !ok || i < 0 {
+		return 0, false
+	}
+	if r.Elems[i].Dead {
+		return -1, true
+	}
+	r.Elems[i].Dead = true
+	if r.Elems[i].Data == '\n' {
+		n := sort.SearchInts(r.lines, i)
+		r.lines = append(r.lines[:n], r.lines[n+1:]...)
+	}
+	return i, true
+}
+
+// the row and column of the rune at i, live or not
+func (r *rga) posOf(i int) Pos {
+	y := sort.SearchInts(r.lines, i)
+	start := 0
+	if y > 0 {
+		start = r.lines[y-1] + 1
+	}
+	x := 0
+	for _, e := range r.Elems[start:i] {
+		if !e.Dead {
+			x++
+		}
+	}
+	return Pos{X: x, Y: y}
+}
+
+// the live rune at offset at
+func (r *rga) idAt(at int) (ElemID, bool) {
+	for _, e := range r.Elems {
+		if e.Dead {
+			continue
+		}
+		if at == 0 {
+			return e.ID, true
+		}
+		at--
+	}
+	return ElemID{}, false
+}
+
+// the live rune before offset at, the start for 0
+func (r *rga) idBefore(at int) ElemID {
+	if at <= 0 {
+		return ElemID{}
+	}
+	id, _ := r.idAt(at - 1)
+	return id
+}
+
+// offset just past id, dead or not
+func (r *rga) offsetAfter(id ElemID) int {
+	i, _ := r.find(id)
+	off := 0
+	for j := 0; j <= i; j++ {
+		if !r.Elems[j].Dead {
+			off++
+		}
+	}
+	return off
+}
+
+func (r *rga) dup() rga {
+	return rga{Elems: append([]elem{}, r.Elems...), Clock: r.Clock}
+}
+
+// switch to ModeCRDT, starting the RGA from the current rows
+func (doc *Doc) startCRDT() {
+	if doc.Mode == ModeCRDT {
+		return
+	}
+	doc.Mode = ModeCRDT
+	doc.Text = rga{}
+	doc.CrdtSeqs = make(map[int]uint32)
+	doc.Anchors = make(map[int]ElemID)
+	// marks are kept by the clients from now on
+	doc.Marks = make(map[int]int)
+
+	prev := ElemID{}
+	add := func(ch rune) {
+		id := ElemID{Clock: doc.Text.Clock + 1}
+		doc.Text.insert(id, prev, ch, false)
+		prev = id
+	}
+	for y, row := range doc.Rows {
+		if y > 0 {
+			add('\n')
+		}
+		for _, ch := range row.Chars {
+			add(ch)
+		}
+	}
+	doc.crdtRows()
+}
+
+// apply a CrdtInsert or CrdtDelete.  false if it's a duplicate or
+// something it depends on hasn't been applied
+func (doc *Doc) applyCRDT(op Op, temp bool) bool {
+	if doc.Mode != ModeCRDT || op.Seq != doc.CrdtSeqs[op.Client]+1 {
+		return false
+	}
+	if doc.CrdtSeqs == nil {
+		// gob leaves empty maps out
+		doc.CrdtSeqs = make(map[int]uint32)
+		doc.Anchors = make(map[int]ElemID)
+	}
+
+	var i int
+	var ok bool
+	switch op.Type {
+	case CrdtInsert:
+		i, ok = doc.Text.insert(op.ID, op.Ref, op.Data, temp)
+	case CrdtDelete:
+		i, ok = doc.Text.remove(op.ID)
+	}
+	if !ok {
+		return false
+	}
+
+	doc.CrdtSeqs[op.Client]++
+	doc.Anchors[op.Client] = op.ID
+	if i >= 0 {
+		doc.crdtChange(i, op.Type == CrdtInsert, op.Client)
+	}
+	return true
+}
+
+// what crdtRows would do after the rune at i went in, or died, going
+// only by the row it's in.  client is the one that did it
+func (doc *Doc) crdtChange(i int, inserted bool, client int) {
+	e := doc.Text.Elems[i]
+	pos := doc.Text.posOf(i)
+	at := doc.Offset(pos)
+
+	// where everyone with a rune ends up, worked out on the rows before
+	offs := make(map[int]int)
+	for user, id := range doc.Anchors {
+		upos, ok := doc.UserPos[user]
+		switch {
+		case user == client && inserted:
+			offs[user] = at + 1
+		case user == client:
+			offs[user] = at
+		case !ok:
+			offs[user] = doc.Text.offsetAfter(id)
+		default:
+			// just after their rune, wherever it went
+			off := doc.Offset(upos)
+			if a, _ := doc.Text.find(id); inserted && i < a {
+				off++
+			} else if !inserted && i <= a {
+				off--
+			}
+			offs[user] = off
+		}
+	}
+
+	switch {
+	case inserted && e.Data == '\n':
+		doc.splitRow(pos.X, pos.Y)
+	case inserted:
+		doc.rowInsertRune(pos.X, pos.Y, e.Data, e.ID.Client, e.Temp)
+	case e.Data == '\n':
+		doc.editorDelRow(pos.Y + 1)
+	default:
+		doc.rowDelRune(pos.X+1, pos.Y)
+	}
+
+	for user, off := range offs {
+		doc.UserPos[user], _ = doc.posAt(off)
+	}
+	for user, upos := range doc.UserPos {
+		// keep everyone inside the document
+		if upos.Y >= len(doc.Rows) {
+			upos.Y = len(doc.Rows) - 1
+		}
+		if upos.X > len(doc.Rows[upos.Y].Chars) {
+			upos.X = len(doc.Rows[upos.Y].Chars)
+		}
+		doc.UserPos[user] = upos
+	}
+}
+
+// rebuild the rows and cursors from the RGA
+func (doc *Doc) crdtRows() {
+	rows := []erow{erow{}}
+	for _, e := range doc.Text.Elems {
+		if e.Dead {
+			continue
+		}
+		if e.Data == '\n' {
+			rows = append(rows, erow{})
+			continue
+		}
+		row := &rows[len(rows)-1]
+		row.Chars = append(row.Chars, e.Data)
+		row.Temp = append(row.Temp, e.Temp)
+		row.Author = append(row.Author, doc.Colors[e.ID.Client])
+	}
+	doc.Rows = rows
+
+	for user := range doc.Anchors {
+		if _, ok := doc.UserPos[user]; !ok {
+			doc.UserPos[user] = Pos{}
+		}
+	}
+	for user, pos := range doc.UserPos {
+		if id, ok := doc.Anchors[user]; ok {
+			pos, _ = doc.posAt(doc.Text.offsetAfter(id))
+		}
+		// keep everyone inside the document
+		if pos.Y >= len(doc.Rows) {
+			pos.Y = len(doc.Rows) - 1
+		}
+		if pos.X > len(doc.Rows[pos.Y].Chars) {
+			pos.X = len(doc.Rows[pos.Y].Chars)
+		}
+		doc.UserPos[user] = pos
+	}
+}
+
+// the op a decided mode change commits, so clients switch too.  must
+// hold s.mu
+func (s *Server) modeOps(ch ModeChange) []Op {
+	d, ok := s.docs[ch.Doc]
+	if !ok || ch.Mode != ModeCRDT || d.doc.Mode == ModeCRDT {
+		return nil
+	}
+	log.Printf("Document %q is now a CRDT\n", ch.Doc)
+	return []Op{Op{Type: CrdtStart, Doc: ch.Doc}}
+}
+
+// take ops for d from a client or another replica, holding on to those
+// that can't apply yet.  must hold s.mu
+func (s *Server) merge(d *document, ops []Op) {
+	for _, op := range ops {
+		if op.Seq > d.doc.CrdtSeqs[op.Client] {
+			d.crdtWait = append(d.crdtWait, op)
+		}
+	}
+
+	applied := false
+	for progress := true; progress; {
+		progress = false
+		wait := d.crdtWait[:0]
+		for _, op := range d.crdtWait {
+			if d.doc.applyCRDT(op, false) {
+				d.CrdtLog = append(d.CrdtLog, op)
+				s.crdtApplied++
+				progress = true
+				applied = true
+			} else if op.Seq > d.doc.CrdtSeqs[op.Client] {
+				wait = append(wait, op)
+			}
+		}
+		d.crdtWait = wait
+	}
+
+	if applied {
+		d.wake()
+	}
+}
+
+// Merge takes CRDT ops from a client.
+func (s *Server) Merge(arg MergeArg, reply *MergeReply) error {
+	var ops []Op
+	if err := json.Unmarshal(arg.Data, &ops); err != nil {
+		log.Println("Couldn't unmarshal op", err)
+		reply.Err = "Decode"
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, err := s.document(arg.Doc)
+	if err != "OK" {
+		reply.Err = err
+		return nil
+	}
+	if d.doc.Mode != ModeCRDT {
+		reply.Err = "Mode"
+		return nil
+	}
+	for _, op := range ops {
+		d.hear(op.Client)
+	}
+	s.merge(d, ops)
+	reply.Err = "OK"
+	return nil
+}
+
+// whether d has ops past have
+func (d *document) hasNews(have map[int]uint32) bool {
+	for c, n := range d.doc.CrdtSeqs {
+		if n > have[c] {
+			return true
+		}
+	}
+	return false
+}
+
+// Sync sends the CRDT ops a client or replica doesn't have, going by how
+// many of each client's ops it has seen.  With arg.Wait it is held open,
+// like Subscribe, until there are some.
+func (s *Server) Sync(arg SyncArg, reply *SyncReply) error {
+	timer := time.NewTimer(subscribeWait)
+	defer timer.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, err := s.document(arg.Doc)
+	if err == "OK" && arg.Wait {
+		d.listen(arg.Client)
+		defer d.unlisten(arg.Client)
+	}
+	for waiting := arg.Wait; err == "OK" && waiting && !d.hasNews(arg.Have) && !s.isdead(); {
+		ch := d.committed
+		s.mu.Unlock()
+		select {
+		case <-ch:
+		case <-timer.C:
+			waiting = false
+		}
+		s.mu.Lock()
+		d, err = s.document(arg.Doc)
+	}
+	if err != "OK" {
+		reply.Err = err
+		return nil
+	}
+
+	if d.doc.Mode != ModeCRDT {
+		reply.Err = "Mode"
+		return nil
+	}
+
+	var ops []Op
+	for _, op := range d.CrdtLog {
+		if op.Seq > arg.Have[op.Client] {
+			ops = append(ops, op)
+			if len(ops) == subscribeBatch {
+				break
+			}
+		}
+	}
+	buf, jerr := json.Marshal(ops)
+	if jerr != nil {
+		log.Println("Couldn't send ops", jerr)
+		reply.Err = "Encode"
+		return nil
+	}
+
+	reply.Data = buf
+	reply.Colors = make(map[int]int)
+	for k, v := range d.doc.Colors {
+		reply.Colors[k] = v
+	}
+	reply.Names = make(map[int]string)
+	for k, v := range d.doc.Names {
+		reply.Names[k] = v
+	}
+	reply.Saved = d.doc.Saved
+	reply.Err = "OK"
+	return nil
+}
+
+// pull CRDT ops from a random replica now and then
+func (s *Server) gossip() {
+	for !s.isdead() {
+		time.Sleep(gossipDelay)
+
+		s.mu.Lock()
+		var peers []string
+		for _, p := range s.Configs[len(s.Configs)-1].members() {
+			if p != s.addr {
+				peers = append(peers, p)
+			}
+		}
+		// what we have of each CRDT document
+		haves := make(map[string]map[int]uint32)
+		for name, d := range s.docs {
+			if d.doc.Mode != ModeCRDT {
+				continue
+			}
+			have := make(map[int]uint32)
+			for k, v := range d.doc.CrdtSeqs {
+				have[k] = v
+			}
+			haves[name] = have
+		}
+		s.mu.Unlock()
+
+		if len(peers) == 0 || len(haves) == 0 {
+			continue
+		}
+		peer := peers[rand.Intn(len(peers))]
+		for name, have := range haves {
+			var reply SyncReply
+			if !s.net.Call(peer, "Server.Sync", SyncArg{Have: have, Doc: name}, &reply, false) || reply.Err != "OK" {
+				continue
+			}
+			var ops []Op
+			if err := json.Unmarshal(reply.Data, &ops); err != nil {
+				continue
+			}
+
+			s.mu.Lock()
+			if d, ok := s.docs[name]; ok {
+				s.merge(d, ops)
+			}
+			s.mu.Unlock()
+		}
+
+		s.mu.Lock()
+		if s.crdtApplied != s.crdtSnapped && time.Since(s.snapTime) > snapshotInterval {
+			// nothing else snapshots CRDT ops
+			if err := s.takeSnapshot(); err != nil {
+				log.Println("Couldn't take snapshot", err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// SetMode switches the document to mode through the log.  Only
+// ModeOrdered to ModeCRDT is supported.
+func (s *Server) SetMode(arg ModeArg, reply *ModeReply) error {
+	if arg.Mode != ModeCRDT {
+		reply.Err = "Unsupported"
+		return nil
+	}
+	s.mu.Lock()
+	_, err := s.document(arg.Doc)
+	s.mu.Unlock()
+	if err != "OK" {
+		reply.Err = err
+		return nil
+	}
+
+	seq := s.propose(ModeChange{Mode: arg.Mode, Doc: arg.Doc})
+	if seq < 0 {
+		reply.Err = "Dead"
+		return nil
+	}
+	for {
+		s.mu.Lock()
+		if s.QuerySeq > seq {
+			break
+		}
+		s.mu.Unlock()
+		time.Sleep(updateDelay)
+	}
+	defer s.mu.Unlock()
+
+	reply.Err = "OK"
+	return nil
+}
+
+// SetDocMode asks the replica at srv to switch document doc to mode.
+func SetDocMode(srv string, doc string, mode int) (ModeReply, bool) {
+	var reply ModeReply
+	ok := call(srv, "Server.SetMode", ModeArg{Mode: mode, Doc: doc}, &reply, true)
+	return reply, ok
+}
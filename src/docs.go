@@ -0,0 +1,286 @@
+package gopad
+
+// Documents.
+//
+// A server hosts any number of documents, named by a path like
+// "notes/todo".  The one it was started with is MainDoc.  They all share
+// the paxos log: ops say which document they're for, and creating,
+// renaming and deleting documents go through the log as DocChanges.
+// Each document has its own commit log, user views and discard point.
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// MainDoc is the document a server starts with, and the one clients get
+// if they don't name one.
+const MainDoc = ""
+
+const (
+	DocCreate = iota
+	DocRename
+	DocDelete
+)
+
+// DocChange is the paxos payload that creates, renames or deletes a
+// document.
+type DocChange struct {
+	Kind     int
+	Name     string
+	To       string   // new name for DocRename
+	Rows     []string // text for DocCreate
+	MaxUsers int      // for DocCreate, 0 for the server's limit
+}
+
+// a document and the log clients follow it by
+type document struct {
+	doc          Doc
+	CommitLog    []Op
+	UserViews    map[int]uint32 // last reported view number by user
+	CommitPoint  uint32         // the upper bound of our commit log (in absolute terms)
+	DiscardPoint uint32         // ops below this have been discarded
+	CrdtLog      []Op           // CRDT ops in the order we applied them
+	Created      int            // paxos instance that created it
+
+	crdtWait  []Op              // CRDT ops waiting on ones we don't have
+	savedCrdt int               // len(CrdtLog) at the last Save
+	unwritten []byte            // last Save replayed but not written, see saveDoc
+	committed chan struct{}     // closed whenever CommitPoint moves or CRDT ops apply
+	heard     map[int]time.Time // last time we heard from each user, see session.go
+	listening map[int]int       // Subscribes and Syncs each user has waiting
+}
+
+func newDocument(rows []string, seq int) *document {
+	d := &document{
+		UserViews: make(map[int]uint32),
+		CommitLog: make([]Op, 0),
+		Created:   seq,
+		committed: make(chan struct{}),
+		doc: Doc{
+			UserSeqs:    make(map[int]uint32),
+			UserPos:     make(map[int]Pos),
+			Colors:      make(map[int]int),
+			Names:       make(map[int]string),
+			UserSession: make(map[int]uint32),
+		},
+	}
+
+	for _, row := range rows {
+		d.doc.Rows = append(d.doc.Rows,
+			erow{
+				Chars:  []rune(row),
+				Temp:   make([]bool, len([]rune(row))),
+				Author: make([]int, len([]rune(row))),
+			})
+	}
+	if len(d.doc.Rows) == 0 {
+		// empty first row
+		d.doc.Rows = append(d.doc.Rows,
+			erow{
+				Chars:  []rune{},
+				Temp:   make([]bool, 0),
+				Author: make([]int, 0),
+			})
+	}
+	return d
+}
+
+// wake up subscribers
+func (d *document) wake() {
+	close(d.committed)
+	d.committed = make(chan struct{})
+}
+
+// the oldest view somebody still needs.  if nobody's here, whatever's
+// left, since whoever joins next starts from their Init
+func (d *document) minView() uint32 {
+	if len(d.UserViews) == 0 {
+		return d.DiscardPoint
+	}
+	min := d.CommitPoint
+	for _, v := range d.UserViews {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// drop ops every user has seen
+func (d *document) discard() {
+	if min := d.minView(); d.DiscardPoint < min {
+		d.CommitLog = d.CommitLog[min-d.DiscardPoint:]
+		d.DiscardPoint = min
+	}
+}
+
+// the document called name.  must hold s.mu
+func (s *Server) document(name string) (*document, Err) {
+	d, ok := s.docs[name]
+	if !ok {
+		return nil, "NoDoc"
+	}
+	return d, "OK"
+}
+
+// apply a decided document change.  must hold s.mu
+func (s *Server) applyDocs(ch DocChange, seq int) {
+	d, ok := s.docs[ch.Name]
+	switch ch.Kind {
+	case DocCreate:
+		if ok {
+			return
+		}
+		d = newDocument(ch.Rows, seq)
+		d.doc.MaxUsers = ch.MaxUsers
+		s.docs[ch.Name] = d
+		log.Printf("Created document %q\n", ch.Name)
+	case DocRename:
+		if _, taken := s.docs[ch.To]; !ok || taken || ch.Name == MainDoc || ch.To == MainDoc {
+			return
+		}
+		delete(s.docs, ch.Name)
+		s.docs[ch.To] = d
+		// clients of the old name find out it's gone
+		d.wake()
+		log.Printf("Renamed document %q to %q\n", ch.Name, ch.To)
+	case DocDelete:
+		if !ok || ch.Name == MainDoc {
+			return
+		}
+		delete(s.docs, ch.Name)
+		d.wake()
+		log.Printf("Deleted document %q\n", ch.Name)
+	}
+}
+
+// put ch through the log and wait for it to apply.  returns the
+// instance, -1 if we were killed first
+func (s *Server) changeDocs(ch DocChange) int {
+	seq := s.propose(ch)
+	if seq < 0 {
+		return -1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.waitApplied(seq) {
+		return -1
+	}
+	return seq
+}
+
+// CreateDoc makes an empty document, or one with arg.Rows in it.
+func (s *Server) CreateDoc(arg DocArg, reply *DocReply) error {
+	if !validName(arg.Name) {
+		reply.Err = "Name"
+		return nil
+	}
+	seq := s.changeDocs(DocChange{Kind: DocCreate, Name: arg.Name, Rows: arg.Rows, MaxUsers: arg.MaxUsers})
+	if seq < 0 {
+		reply.Err = "Dead"
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.docs[arg.Name]; ok && d.Created == seq {
+		reply.Err = "OK"
+	} else {
+		reply.Err = "Exists"
+	}
+	return nil
+}
+
+// RenameDoc gives document arg.Name the name arg.To.  Clients using the
+// old name have to reopen it.
+func (s *Server) RenameDoc(arg DocArg, reply *DocReply) error {
+	s.mu.Lock()
+	d, err := s.document(arg.Name)
+	s.mu.Unlock()
+	if err != "OK" {
+		reply.Err = err
+		return nil
+	}
+	if arg.Name == MainDoc || !validName(arg.To) {
+		reply.Err = "Name"
+		return nil
+	}
+
+	if s.changeDocs(DocChange{Kind: DocRename, Name: arg.Name, To: arg.To}) < 0 {
+		reply.Err = "Dead"
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.docs[arg.To] == d {
+		reply.Err = "OK"
+	} else {
+		reply.Err = "Exists"
+	}
+	return nil
+}
+
+// DeleteDoc deletes document arg.Name.  The main document stays.
+func (s *Server) DeleteDoc(arg DocArg, reply *DocReply) error {
+	if arg.Name == MainDoc {
+		reply.Err = "Name"
+		return nil
+	}
+	s.mu.Lock()
+	d, err := s.document(arg.Name)
+	s.mu.Unlock()
+	if err != "OK" {
+		reply.Err = err
+		return nil
+	}
+
+	if s.changeDocs(DocChange{Kind: DocDelete, Name: arg.Name}) < 0 {
+		reply.Err = "Dead"
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.docs[arg.Name] != d {
+		reply.Err = "OK"
+	} else {
+		reply.Err = "NoDoc"
+	}
+	return nil
+}
+
+// ListDocs names the documents this replica has, sorted.
+func (s *Server) ListDocs(arg DocArg, reply *DocReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.docs {
+		reply.Names = append(reply.Names, name)
+	}
+	sort.Strings(reply.Names)
+	reply.Err = "OK"
+	return nil
+}
+
+// ChangeDoc asks the replica at srv to create, rename or delete a
+// document, going by ch.Kind.
+func ChangeDoc(srv string, ch DocChange) (DocReply, bool) {
+	rpcname := map[int]string{
+		DocCreate: "Server.CreateDoc",
+		DocRename: "Server.RenameDoc",
+		DocDelete: "Server.DeleteDoc",
+	}[ch.Kind]
+
+	var reply DocReply
+	ok := call(srv, rpcname, DocArg{Name: ch.Name, To: ch.To, Rows: ch.Rows, MaxUsers: ch.MaxUsers}, &reply, true)
+	return reply, ok
+}
+
+// ListDocsAt asks the replica at srv which documents there are.
+func ListDocsAt(srv string) (DocReply, bool) {
+	var reply DocReply
+	ok := call(srv, "Server.ListDocs", DocArg{}, &reply, true)
+	return reply, ok
+}
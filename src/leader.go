@@ -0,0 +1,332 @@
+package gopad
+
+// Multi-Paxos.
+//
+// One peer runs phase 1 once for every instance from some point on
+// (Lead), after which it only has to send Accepts for new instances.
+// The leader heartbeats everyone; a follower that hasn't heard from it
+// for leaseTimeout campaigns to take over.  Acceptors keep the leader's
+// ballot in Promise, so a deposed leader finds out on its next Accept.
+// Phase 1 only covers instances decided by the config it ran in, so the
+// leader steps down and campaigns again once the membership changes.
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	heartbeatInterval = 100 * time.Millisecond
+	leaseTimeout      = 1 * time.Second
+)
+
+type Proposal struct {
+	N   int
+	Val interface{}
+}
+
+type LeadArgs struct {
+	N    int
+	From int
+	Me   string
+}
+
+type LeadReply struct {
+	OK       bool
+	Num      int
+	Accepted map[int]Proposal    // accepted but maybe not decided, >= From
+	Decided  map[int]interface{} // decided, >= From
+}
+
+type HeartbeatArgs struct {
+	N  int
+	Me string
+	Hi int // leader's Max(), so followers know if they're behind
+}
+
+type HeartbeatReply struct {
+	OK  bool
+	Num int
+}
+
+// SetMulti turns on leader based Multi-Paxos.  Must be called before
+// Run.
+func (px *Paxos) SetMulti(on bool) {
+	px.mu.Lock()
+	px.multi = on
+	px.mu.Unlock()
+}
+
+// Leader returns the address of the peer we believe is leading, or "" if
+// there isn't one or we aren't using a leader.
+func (px *Paxos) Leader() string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if !px.multi || time.Since(px.lastHeard) > leaseTimeout {
+		return ""
+	}
+	return px.leader
+}
+
+// Run does leader election and heartbeats forever.
+func (px *Paxos) Run() {
+	for {
+		px.mu.Lock()
+		multi := px.multi
+		leading := px.leaderN > 0
+		expired := time.Since(px.lastHeard) > leaseTimeout
+		stale := leading && px.configFor(px.firstUndecided()).Num != px.leaderConfig
+		px.mu.Unlock()
+
+		if !multi || px.isdead() {
+			return
+		}
+
+		if stale {
+			// membership changed under us
+			px.stepDown()
+			px.campaign()
+		} else if leading {
+			px.heartbeat()
+		} else if expired {
+			// stagger so peers don't all campaign at once
+			time.Sleep(time.Duration(rand.Int63n(int64(leaseTimeout / 2))))
+			px.campaign()
+		}
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+// returns our ballot if we lead and phase 1 covers seq
+func (px *Paxos) leaderBallot(seq int) (int, bool) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	ok := px.leaderN > 0 && seq >= px.leaderFrom && px.configFor(seq).Num == px.leaderConfig
+	return px.leaderN, ok
+}
+
+func (px *Paxos) stepDown() {
+	px.mu.Lock()
+	px.leaderN = 0
+	if px.leader == px.me {
+		px.leader = ""
+	}
+	px.mu.Unlock()
+}
+
+// first instance we don't know to be decided.  must hold px.mu
+func (px *Paxos) firstUndecided() int {
+	seq := px.Lo
+	for ; seq <= px.Hi; seq++ {
+		if st, ok := px.Stati[seq]; !ok || st != Decided {
+			break
+		}
+	}
+	return seq
+}
+
+// phase 1 for every instance >= args.From
+func (px *Paxos) Lead(args LeadArgs, reply *LeadReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if px.leader != args.Me && px.leader != "" && time.Since(px.lastHeard) < leaseTimeout {
+		// somebody else still holds the lease
+		reply.Num = px.Promise
+		return nil
+	}
+
+	if args.N <= px.Promise {
+		reply.Num = px.Promise
+		return nil
+	}
+	for seq, n := range px.Hiprepare {
+		if seq >= args.From && n >= args.N {
+			reply.Num = n
+			return nil
+		}
+	}
+
+	from := args.From
+	if px.Promise > 0 && px.PromiseFrom < from {
+		// never shrink an earlier promise
+		from = px.PromiseFrom
+	}
+	if err := px.persist(walRecord{Type: walPromise, N: args.N, Seq: from}); err != nil {
+		return err
+	}
+	px.Promise = args.N
+	px.PromiseFrom = from
+
+	reply.Accepted = make(map[int]Proposal)
+	reply.Decided = make(map[int]interface{})
+	for seq, n := range px.Hiaccept {
+		if seq >= args.From {
+			reply.Accepted[seq] = Proposal{n, px.Val[seq]}
+		}
+	}
+	for seq, st := range px.Stati {
+		if seq >= args.From && st == Decided {
+			reply.Decided[seq] = px.Val[seq]
+		}
+	}
+
+	if args.Me != px.me {
+		px.leaderN = 0
+	}
+	px.leader = args.Me
+	px.lastHeard = time.Now()
+	reply.OK = true
+	reply.Num = args.N
+	return nil
+}
+
+func (px *Paxos) Heartbeat(args HeartbeatArgs, reply *HeartbeatReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if args.N < px.Promise {
+		// stale leader
+		reply.Num = px.Promise
+		return nil
+	}
+
+	px.leader = args.Me
+	px.lastHeard = time.Now()
+	if px.Hi < args.Hi {
+		px.Hi = args.Hi
+	}
+	reply.OK = true
+	reply.Num = args.N
+	return nil
+}
+
+type leadResult struct {
+	ok    bool
+	reply LeadReply
+}
+
+func (px *Paxos) heartbeat() {
+	px.mu.Lock()
+	n := px.leaderN
+	hi := px.Hi
+	px.lastHeard = time.Now()
+	peers := px.everyone()
+	px.mu.Unlock()
+
+	for _, server := range peers {
+		if server == px.me {
+			continue
+		}
+
+		go func(server string) {
+			var reply HeartbeatReply
+			ok := px.net.Call(server, "Paxos.Heartbeat", HeartbeatArgs{n, px.me, hi}, &reply, false)
+			if ok && !reply.OK {
+				px.stepDown()
+			}
+		}(server)
+	}
+}
+
+// try to become leader
+func (px *Paxos) campaign() bool {
+	px.mu.Lock()
+	from := px.firstUndecided()
+	if !px.canPropose(from) {
+		px.mu.Unlock()
+		return false
+	}
+	hi := px.Promise
+	for _, n := range px.Hiprepare {
+		if n > hi {
+			hi = n
+		}
+	}
+	n := px.nextBallot(hi)
+	config := px.configFor(from)
+	peers := config.members()
+	px.mu.Unlock()
+
+	granted := 0
+	accepted := make(map[int]Proposal)
+	decided := make(map[int]interface{})
+
+	results := make(chan leadResult, len(peers))
+	for _, server := range peers {
+		go func(server string) {
+			var reply LeadReply
+			ok := true
+
+			if server == px.me {
+				px.Lead(LeadArgs{n, from, px.me}, &reply)
+			} else {
+				ok = px.net.Call(server, "Paxos.Lead", LeadArgs{n, from, px.me}, &reply, false)
+			}
+			results <- leadResult{ok, reply}
+		}(server)
+	}
+
+	for range peers {
+		r := <-results
+		if !r.ok {
+			continue
+		}
+		if !r.reply.OK {
+			return false
+		}
+
+		granted++
+		for seq, p := range r.reply.Accepted {
+			if p.N > accepted[seq].N {
+				accepted[seq] = p
+			}
+		}
+		for seq, v := range r.reply.Decided {
+			decided[seq] = v
+		}
+		if granted > len(peers)/2 {
+			break
+		}
+	}
+
+	if granted <= len(peers)/2 {
+		return false
+	}
+
+	// finish whatever earlier proposers left half done
+	for seq, v := range decided {
+		px.sendDecided(seq, v)
+		delete(accepted, seq)
+	}
+	for seq, p := range accepted {
+		px.mu.Lock()
+		other := px.configFor(seq).Num != config.Num
+		px.mu.Unlock()
+		if other {
+			// our promises don't cover it, ordinary paxos will
+			continue
+		}
+		if !px.sendAccepted(seq, n, p.Val) {
+			return false
+		}
+		px.sendDecided(seq, p.Val)
+	}
+
+	px.mu.Lock()
+	if px.Promise == n {
+		px.leaderN = n
+		px.leaderFrom = from
+		px.leaderConfig = config.Num
+		px.leader = px.me
+		px.lastHeard = time.Now()
+	}
+	leading := px.leaderN == n
+	px.mu.Unlock()
+
+	if leading {
+		px.heartbeat()
+	}
+	return leading
+}
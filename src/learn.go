@@ -0,0 +1,72 @@
+package gopad
+
+// Learner catch-up.
+//
+// Decided is only sent once, so a peer that was partitioned or down when
+// an instance was decided never hears about it.  A peer that knows it is
+// behind (Max() is past what the application is waiting on) asks the
+// others for decided values with CatchUp.  The leader's heartbeats and
+// Learn replies carry Max() so a peer that missed the last few instances
+// finds out too.
+
+import "math/rand"
+
+const learnBatch = 64 // decided values per Learn reply
+
+type LearnArgs struct {
+	From int
+}
+
+type LearnReply struct {
+	Decided map[int]interface{} // some decided instances >= From
+	Hi      int                 // sender's Max()
+}
+
+// hand out decided values from args.From on
+func (px *Paxos) Learn(args LearnArgs, reply *LearnReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	reply.Hi = px.Hi
+	reply.Decided = make(map[int]interface{})
+	for seq := args.From; seq <= px.Hi && len(reply.Decided) < learnBatch; seq++ {
+		if st, ok := px.Stati[seq]; ok && st == Decided {
+			reply.Decided[seq] = px.Val[seq]
+		}
+	}
+	return nil
+}
+
+// CatchUp asks peers for decided values from seq on, and returns whether
+// seq is decided now.  If nobody has decided it the application has to
+// propose something to find out.
+func (px *Paxos) CatchUp(seq int) bool {
+	px.mu.Lock()
+	peers := px.everyone()
+	px.mu.Unlock()
+
+	// spread the load
+	for _, i := range rand.Perm(len(peers)) {
+		server := peers[i]
+		if server == px.me {
+			continue
+		}
+
+		var reply LearnReply
+		if !px.net.Call(server, "Paxos.Learn", LearnArgs{From: seq}, &reply, false) {
+			continue
+		}
+		for s, v := range reply.Decided {
+			px.Decided(DecidedArgs{s, v}, &DecidedReply{})
+		}
+		px.mu.Lock()
+		if px.Hi < reply.Hi {
+			px.Hi = reply.Hi
+		}
+		px.mu.Unlock()
+		if px.isDecided(seq) {
+			return true
+		}
+	}
+	return px.isDecided(seq)
+}
@@ -0,0 +1,93 @@
+package gopad
+
+// Cursor motions.
+//
+// A Move op says how its user's cursor goes, in terms any client can
+// come up with: a step, a jump by word, line or document, or straight
+// to an offset.  The terminal client maps keys onto these.
+
+import "unicode"
+
+const (
+	MoveLeft = iota + 1
+	MoveRight
+	MoveUp   // same screen column, a row up
+	MoveDown // same screen column, a row down
+	MoveWordLeft
+	MoveWordRight
+	MoveLineStart
+	MoveLineEnd
+	MoveDocStart
+	MoveDocEnd
+	MoveTo // to Op.At, transformed like any positional op
+)
+
+// termbox keys older builds send in Op.Move for the motions they have
+var motionKeys = map[int]uint16{
+	MoveLeft:      0xFFFF - 20,
+	MoveRight:     0xFFFF - 21,
+	MoveUp:        0xFFFF - 18,
+	MoveDown:      0xFFFF - 19,
+	MoveLineStart: 0xFFFF - 14, // Home
+	MoveLineEnd:   0xFFFF - 15, // End
+}
+
+// the motion a Move op asks for, by key if it's from an older build
+func (op Op) motion() int {
+	if op.Motion != 0 {
+		return op.Motion
+	}
+	for m, key := range motionKeys {
+		if key == op.Move {
+			return m
+		}
+	}
+	return 0
+}
+
+// move op.Client's cursor the way op says
+func (doc *Doc) move(op Op) {
+	if m := op.motion(); m != MoveTo {
+		editorMoveCursor(doc, op.Client, m)
+		return
+	}
+
+	e := doc.transform(op, op.edit())
+	if e.Type == noEdit {
+		return
+	}
+	if n := doc.size(); e.At > n {
+		e.At = n
+	}
+	if pos, ok := doc.posAt(e.At); ok {
+		doc.UserPos[op.Client] = pos
+	}
+}
+
+// whether r is part of a word, accents included
+func wordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// offset of the start of the word after at, or the end
+func (doc *Doc) wordRight(at int) int {
+	n := doc.size()
+	for at < n && wordRune(doc.runeAt(at)) {
+		at++
+	}
+	for at < n && !wordRune(doc.runeAt(at)) {
+		at++
+	}
+	return at
+}
+
+// offset of the start of the word before at, or the start
+func (doc *Doc) wordLeft(at int) int {
+	for at > 0 && !wordRune(doc.runeAt(at-1)) {
+		at--
+	}
+	for at > 0 && wordRune(doc.runeAt(at-1)) {
+		at--
+	}
+	return at
+}
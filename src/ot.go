@@ -0,0 +1,253 @@
+package gopad
+
+// Operational transformation for positional ops.
+//
+// InsertAt and DeleteAt name an offset into the document, counting each
+// row break as one rune, as the user saw it at op.View plus their own
+// earlier ops.  Doc keeps the last historyMax or so edits it made, whole
+// ops at a time, so when such an op is applied it is first transformed
+// past the edits other users committed after op.View.
+//
+// Clients keep one batch of ops in flight and send the next only after
+// seeing the last one commit, the way ot.js does.  So the edits a batch
+// has to get past all come before it in the log, and the user's own
+// edits after op.View are the batch ops in front of it.  Meanwhile the
+// client transforms its pending ops past whatever else commits, so they
+// always apply on top of its committed doc.
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const historyMax = 1024
+
+// an edit transformed into nothing.  a pending op that becomes one still
+// takes up its Seq
+const noEdit = -1
+
+// Edit is a one rune change to the document, text put in at one place
+// for InsertText, or for Select where a mark goes.
+type Edit struct {
+	Type   int // InsertAt, DeleteAt, InsertText, Select or noEdit
+	At     int // offset, counting each row break as one rune
+	Data   rune
+	Text   string // for InsertText
+	Client int    // breaks ties between inserts in the same place
+}
+
+// an edit doc made
+type pastEdit struct {
+	Edit        // as applied
+	Orig Edit   // as asked for
+	Base uint32 // op.View
+	View uint32 // doc.View after it
+	Seq  uint32
+}
+
+// Transform changes a so it has the same effect after b as it had
+// before, where a and b were made to the same document.  Applying a then
+// Transform(b, a) gives the same document as b then Transform(a, b).
+func Transform(a Edit, b Edit) Edit {
+	if a.Type == noEdit {
+		return a
+	}
+
+	switch b.Type {
+	case InsertAt, InsertText:
+		if a.At > b.At || (a.At == b.At && (!a.inserts() || after(a, b))) {
+			a.At += b.size()
+		}
+	case DeleteAt:
+		if a.At > b.At {
+			a.At--
+		} else if a.At == b.At && a.Type == DeleteAt {
+			// somebody beat us to it
+			a.Type = noEdit
+		}
+	}
+	return a
+}
+
+// whether insert a goes after insert b in the same place
+func after(a Edit, b Edit) bool {
+	if a.Client != b.Client {
+		return a.Client > b.Client
+	}
+	return a.text() >= b.text()
+}
+
+func (e Edit) inserts() bool {
+	return e.Type == InsertAt || e.Type == InsertText
+}
+
+// what an insert puts in
+func (e Edit) text() string {
+	if e.Type == InsertText {
+		return e.Text
+	}
+	return string(e.Data)
+}
+
+// runes an insert puts in
+func (e Edit) size() int {
+	return utf8.RuneCountInString(e.text())
+}
+
+// transform two sequences of edits made to the same document past each
+// other.  a' applies after b and b' after a.
+func transformSeq(a []Edit, b []Edit) ([]Edit, []Edit) {
+	a = append([]Edit{}, a...)
+	b = append([]Edit{}, b...)
+	for i := range a {
+		for j := range b {
+			a[i], b[j] = Transform(a[i], b[j]), Transform(b[j], a[i])
+		}
+	}
+	return a, b
+}
+
+func (op Op) edit() Edit {
+	return Edit{Type: op.Type, At: op.At, Data: op.Data, Text: op.Text, Client: op.Client}
+}
+
+// x, one of op's edits, as an edit to the document as it is now
+func (doc *Doc) transform(op Op, x Edit) Edit {
+	if op.View < doc.HistFrom {
+		// too old to say where it goes
+		return Edit{Type: noEdit}
+	}
+
+	var mine, theirs []Edit
+	for _, p := range doc.History {
+		if p.View <= op.View {
+			continue
+		}
+		if p.Client != op.Client {
+			theirs = append(theirs, p.Edit)
+		} else if p.Base == op.View {
+			// earlier in the same batch
+			mine = append(mine, p.Orig)
+		}
+	}
+
+	a, _ := transformSeq(append(mine, x), theirs)
+	return a[len(a)-1]
+}
+
+// remember edit e made for op, asked for as orig.  marks move past it
+// too
+func (doc *Doc) record(e Edit, orig Edit, op Op) {
+	for user, m := range doc.Marks {
+		doc.Marks[user] = Transform(Edit{Type: Select, At: m, Client: user}, e).At
+	}
+
+	doc.History = append(doc.History, pastEdit{
+		Edit: e,
+		Orig: orig,
+		Base: op.View,
+		View: doc.View + 1,
+		Seq:  op.Seq,
+	})
+}
+
+// forget the oldest edits past historyMax once op is applied.  an op's
+// edits all share a View and go together, so a Range op is never half
+// remembered, and edits after op.View stay for the rest of its batch
+func (doc *Doc) forget(op Op) {
+	n := len(doc.History) - historyMax
+	for n > 0 && (doc.History[n-1].View == doc.History[n].View || doc.History[n-1].View > op.View) {
+		n--
+	}
+	if n > 0 {
+		doc.HistFrom = doc.History[n-1].View
+		doc.History = append([]pastEdit{}, doc.History[n:]...)
+	}
+}
+
+// Offset is how many runes come before pos, counting a newline for
+// each row.
+func (doc *Doc) Offset(pos Pos) int {
+	off := 0
+	for y := 0; y < pos.Y && y < len(doc.Rows); y++ {
+		off += len(doc.Rows[y].Chars) + 1
+	}
+	return off + pos.X
+}
+
+// String is the document's text, rows joined by newlines.
+func (doc *Doc) String() string {
+	var sb strings.Builder
+	for y, row := range doc.Rows {
+		if y > 0 {
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(string(row.Chars))
+	}
+	return sb.String()
+}
+
+// position of offset at, false if it's past the end
+func (doc *Doc) posAt(at int) (Pos, bool) {
+	if at < 0 {
+		return Pos{}, false
+	}
+	for y := range doc.Rows {
+		if at <= len(doc.Rows[y].Chars) {
+			return Pos{X: at, Y: y}, true
+		}
+		at -= len(doc.Rows[y].Chars) + 1
+	}
+	return Pos{}, false
+}
+
+// transform x, one of op's edits, make it and remember it.  returns the
+// edit made
+func (doc *Doc) applyPositional(op Op, x Edit, temp bool) Edit {
+	x.Client = op.Client
+	e := doc.transform(op, x)
+	if e.Type == DeleteAt {
+		// for undo
+		e.Data = doc.runeAt(e.At)
+	}
+	if !doc.applyEdit(e, op.Client, temp) {
+		e.Type = noEdit
+	}
+	doc.record(e, x, op)
+	return e
+}
+
+// make edit e on behalf of user id, moving their cursor to it.  returns
+// false if e doesn't fit the document
+func (doc *Doc) applyEdit(e Edit, id int, temp bool) bool {
+	if len(doc.Rows) == 0 {
+		doc.insertRow(0, []rune{}, []bool{}, []int{})
+	}
+
+	switch e.Type {
+	case InsertAt, InsertText:
+		pos, ok := doc.posAt(e.At)
+		if !ok {
+			return false
+		}
+		doc.UserPos[id] = pos
+		for _, ch := range e.text() {
+			if ch == '\n' {
+				editorInsertNewLine(doc, id)
+			} else {
+				editorInsertRune(doc, id, ch, temp)
+			}
+		}
+	case DeleteAt:
+		// the rune at e.At is the one before e.At+1
+		pos, ok := doc.posAt(e.At + 1)
+		if !ok || e.At < 0 {
+			return false
+		}
+		doc.UserPos[id] = pos
+		editorDelRune(doc, id)
+	default:
+		return false
+	}
+	return true
+}
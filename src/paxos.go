@@ -6,15 +6,21 @@ package gopad
 // a Paxos peer.
 //
 // Manages a Sequence of agreed-on Values.
-// The set of peers is fixed.
+// The set of peers can change through the log itself, see
+// config.go.  Proposal numbers are round*ballotStride + id, so no
+// two peers ever use the same one.
 // Copes with network failures (partition, msg loss, &c).
-// Does not store anything persistently, so cannot handle crash+restart.
+// If SetSave() is called, acceptor state is written to an fsync'd log
+// before any reply goes out, so a peer can crash and restart.
 //
 // The application interface:
 //
-// px = paxos.Make(peers []string, me string)
+// px = MakePaxos(peers []string, me int)
+// px.SetConfigs(configs []Config) -- membership changed
+// px.SetApplied(Seq int) -- application applied everything < Seq
 // px.Start(Seq int, v interface{}) -- start agreement on new instance
 // px.Status(Seq int) (Fate, v interface{}) -- get info about an instance
+// px.Wait(Seq int, timeout) -- wait for an instance to be decided
 // px.Done(Seq int) -- ok to forget all instances <= Seq
 // px.Max() int -- highest instance Seq known, or -1
 // px.Min() int -- instances before this Seq have been forgotten
@@ -24,8 +30,8 @@ import "net"
 
 // import "bytes"
 // import "os"
-import "encoding/json"
 import "sync"
+import "sync/atomic"
 import "fmt"
 import "log"
 import "math/rand"
@@ -49,17 +55,18 @@ const (
 )
 
 type Paxos struct {
-	mu    sync.Mutex
-	l     net.Listener
-	peers []string
-	me    int // index into peers[]
-	// dead       int32 // for testing
+	mu      sync.Mutex
+	l       net.Listener
+	me      string // our address
+	net     Transport
+	configs []Config // membership, oldest first
+	applied int      // application applied everything below this, -1 if not telling
+	dead    int32    // for testing
 	// unreliable int32 // for testing
 
 	// result map[int]interface{}
 	// Your data here.
-	// saveDir string
-	// save    bool
+	wal *wal // acceptor log, nil if not persisting
 
 	// Handler func(int)
 
@@ -69,10 +76,23 @@ type Paxos struct {
 	Hiprepare map[int]int
 	Hiaccept  map[int]int
 	Val       map[int]interface{}
-	DoneSeqs  []int
+	DoneSeqs  map[string]int
 	recovery  bool
 	printing  bool
 	// base      int
+
+	// multi-paxos
+	Promise      int // leader ballot promised for every instance >= PromiseFrom
+	PromiseFrom  int
+	multi        bool
+	oneByOne     bool      // prepares and accepts go to one peer after another
+	leader       string    // peer we think is leading, "" if none
+	leaderN      int       // our ballot if we are leading, 0 if not
+	leaderFrom   int       // phase 1 is done for instances >= this
+	leaderConfig int       // ... that use this config
+	lastHeard    time.Time // last time we heard from the leader
+
+	decided chan struct{} // closed whenever something is decided
 }
 
 type Paxage struct {
@@ -97,8 +117,9 @@ type DecidedArgs struct {
 }
 
 type DoneArgs struct {
-	Num int
-	Me  int
+	Num  int
+	Me   int    // our id, which builds before Addr take for an index into peers
+	Addr string // our address
 }
 
 type PrepareReply struct {
@@ -119,67 +140,127 @@ type DoneReply struct {
 	Num int
 }
 
-// func (px *Paxos) SetSave(dir string) {
-// 	px.save = true
-// 	px.saveDir = dir
-// }
-
-// Recover data from data
-func (px *Paxos) Recover(data []byte) {
-	var p Paxos
-
-	// if disk {
-	// 	file, err := os.Open(px.saveDir)
-	// 	if err == nil {
-	// 		decoder := gob.NewDecoder(file)
-	// 		decoder.Decode(&p)
-	// 	}
-	// 	file.Close()
-	// } else {
-	// decoder := gob.NewDecoder(bytes.NewBufferString(s))
-	// decoder.Decode(&p)
-	if json.Unmarshal(data, &p) != nil {
-		log.Fatal("Bad Paxos decode")
+// SetSave makes the acceptor state durable in the log at path, replaying
+// whatever is already there.  Must be called before serving any RPCs.
+func (px *Paxos) SetSave(path string) error {
+	w, recs, err := openWAL(path)
+	if err != nil {
+		return err
 	}
 
-	// px.base = p.Hi + 1
-	// }
-
 	px.mu.Lock()
-	// px.recovery = !disk
-	px.Stati = p.Stati
-	px.Hiprepare = p.Hiprepare
-	px.Hiaccept = p.Hiaccept
-	px.DoneSeqs = p.DoneSeqs
-	px.Val = p.Val
-	px.Hi = p.Hi
-	px.Lo = p.Lo
+	for _, r := range recs {
+		px.replay(r)
+	}
 	if px.printing && Debug {
-		fmt.Printf("RECOVERING PAXOS!  %d %d\n", px.me, px.Hi)
+		fmt.Printf("REPLAYED %d RECORDS %s %d\n", len(recs), px.me, px.Hi)
 	}
-	px.recovery = false
-
+	px.wal = w
 	px.mu.Unlock()
+
+	// forget whatever was already done before the crash
+	px.updateMin()
+	return nil
 }
 
-// func (px *Paxos) FinishRecovery() {
-// 	px.recovery = false
-// }
+func (px *Paxos) replay(r walRecord) {
+	switch r.Type {
+	case walPrepare:
+		if r.N > px.Hiprepare[r.Seq] {
+			px.Hiprepare[r.Seq] = r.N
+		}
+	case walAccept:
+		px.Hiprepare[r.Seq] = r.N
+		px.Hiaccept[r.Seq] = r.N
+		if st, ok := px.Stati[r.Seq]; !ok || st != Decided {
+			px.Val[r.Seq] = r.Val
+		}
+		if px.Hi < r.Seq {
+			px.Hi = r.Seq
+		}
+	case walDecided:
+		px.Stati[r.Seq] = Decided
+		px.Val[r.Seq] = r.Val
+		if px.Hi < r.Seq {
+			px.Hi = r.Seq
+		}
+	case walDone:
+		if d, ok := px.DoneSeqs[r.Peer]; !ok || d < r.N {
+			px.DoneSeqs[r.Peer] = r.N
+		}
+	case walPromise:
+		px.Promise = r.N
+		px.PromiseFrom = r.Seq
+	case walCheckpoint:
+		st := r.State
+		px.Promise = st.Promise
+		px.PromiseFrom = st.PromiseFrom
+		px.Stati = st.Stati
+		px.Hiprepare = st.Hiprepare
+		px.Hiaccept = st.Hiaccept
+		px.Val = st.Val
+		px.DoneSeqs = st.Done
+		px.Hi = st.Hi
+		px.Lo = st.Lo
+		if px.Stati == nil {
+			px.Stati = make(map[int]Fate)
+		}
+		if px.Hiprepare == nil {
+			px.Hiprepare = make(map[int]int)
+		}
+		if px.Hiaccept == nil {
+			px.Hiaccept = make(map[int]int)
+		}
+		if px.Val == nil {
+			px.Val = make(map[int]interface{})
+		}
+		if px.DoneSeqs == nil {
+			px.DoneSeqs = make(map[string]int)
+		}
+	}
+}
 
-// func (px *Paxos) log() {
-// 	if !px.save {
-// 		return
-// 	}
+// write a record to the acceptor log.  must hold px.mu
+func (px *Paxos) persist(r walRecord) error {
+	if px.wal == nil {
+		return nil
+	}
+	if px.wal.count >= walCompactEvery {
+		// updateMin won't while a peer lags and holds Lo back.  every
+		// record so far is in our state by now, r isn't yet
+		px.compact()
+	}
+	err := px.wal.append(r)
+	if err != nil {
+		log.Println("Couldn't write paxos log", err)
+	}
+	return err
+}
 
-// 	file, err := os.Create(px.saveDir + "-tmp")
-// 	if err != nil {
-// 		fmt.Println("Couldn't open file!")
-// 		return
-// 	}
-// 	encoder := gob.NewEncoder(file)
-// 	encoder.Encode(px)
+// rewrite the acceptor log from current state.  must hold px.mu
+func (px *Paxos) compact() error {
+	if px.wal == nil {
+		return nil
+	}
+	err := px.wal.compact(&walState{
+		Stati:       px.Stati,
+		Hiprepare:   px.Hiprepare,
+		Hiaccept:    px.Hiaccept,
+		Val:         px.Val,
+		Done:        px.DoneSeqs,
+		Hi:          px.Hi,
+		Lo:          px.Lo,
+		Promise:     px.Promise,
+		PromiseFrom: px.PromiseFrom,
+	})
+	if err != nil {
+		log.Println("Couldn't compact paxos log", err)
+	}
+	return err
+}
 
-// 	os.Rename(px.saveDir+"-tmp", px.saveDir)
+// func (px *Paxos) FinishRecovery() {
+// 	px.recovery = false
 // }
 
 func (px *Paxos) Lock() {
@@ -197,9 +278,14 @@ func (px *Paxos) Prepare(args PrepareArgs, reply *PrepareReply) error {
 	if !px.recovery {
 		px.mu.Lock()
 
-		hi, ok := px.Hiprepare[args.Seq]
-		if !ok || args.N > hi {
+		hi := px.promised(args.Seq)
+		if args.N > hi {
 			// if higher prepare then all others
+			err := px.persist(walRecord{Type: walPrepare, Seq: args.Seq, N: args.N})
+			if err != nil {
+				px.mu.Unlock()
+				return err
+			}
 			px.Hiprepare[args.Seq] = args.N
 
 			reply.Accepted = true
@@ -213,7 +299,6 @@ func (px *Paxos) Prepare(args PrepareArgs, reply *PrepareReply) error {
 			} else {
 				reply.High = 0
 			}
-			// px.log()
 			px.mu.Unlock()
 		} else {
 			// reply with higher
@@ -231,16 +316,24 @@ func (px *Paxos) Accept(args AcceptArgs, reply *AcceptReply) error {
 	// }
 	if !px.recovery {
 		px.mu.Lock()
-		hi, ok := px.Hiprepare[args.Seq]
-		if !ok || args.N >= hi {
+		hi := px.promised(args.Seq)
+		if args.N >= hi {
+			err := px.persist(walRecord{Type: walAccept, Seq: args.Seq, N: args.N, Val: args.Val})
+			if err != nil {
+				px.mu.Unlock()
+				return err
+			}
 			px.Hiprepare[args.Seq] = args.N
 			px.Hiaccept[args.Seq] = args.N
-			px.Val[args.Seq] = args.Val
+			if st, ok := px.Stati[args.Seq]; !ok || st != Decided {
+				// a late accept from an earlier round can't change
+				// what was decided
+				px.Val[args.Seq] = args.Val
+			}
 
 			if px.Hi < args.Seq {
 				px.Hi = args.Seq
 			}
-			// px.log()
 			px.mu.Unlock()
 			reply.Num = args.N
 		} else {
@@ -257,9 +350,24 @@ func (px *Paxos) Decided(args DecidedArgs, reply *DecidedReply) error {
 	// if px.printing && Debug {
 	// 	fmt.Printf("DECIDED %d %d %t\n", px.me, args.Seq, px.recovery)
 	// }
+	if st, ok := px.Stati[args.Seq]; (ok && st == Decided) || args.Seq < px.Lo {
+		// already know about it
+		px.mu.Unlock()
+		return nil
+	}
+	err := px.persist(walRecord{Type: walDecided, Seq: args.Seq, Val: args.Val})
+	if err != nil {
+		px.mu.Unlock()
+		return err
+	}
 	px.Stati[args.Seq] = Decided
 	px.Val[args.Seq] = args.Val
-	// px.log()
+	if px.Hi < args.Seq {
+		px.Hi = args.Seq
+	}
+	// wake up anyone in Wait
+	close(px.decided)
+	px.decided = make(chan struct{})
 	px.mu.Unlock()
 
 	// if px.recovery {
@@ -274,136 +382,257 @@ func (px *Paxos) Decided(args DecidedArgs, reply *DecidedReply) error {
 	return nil
 }
 
+// highest ballot promised for seq.  must hold px.mu
+func (px *Paxos) promised(seq int) int {
+	n := px.Hiprepare[seq]
+	if seq >= px.PromiseFrom && px.Promise > n {
+		n = px.Promise
+	}
+	return n
+}
+
+// smallest proposal number of ours that is higher than n.  must hold
+// px.mu and have an id
+func (px *Paxos) nextBallot(n int) int {
+	return (n/ballotStride+1)*ballotStride + px.myID()
+}
+
+// remember a higher proposal number somebody told us about
+func (px *Paxos) sawBallot(seq int, n int) {
+	px.mu.Lock()
+	if px.Hiprepare[seq] < n {
+		px.Hiprepare[seq] = n
+	}
+	px.mu.Unlock()
+}
+
 func (px *Paxos) isDecided(seq int) bool {
 	px.mu.Lock()
-	Val := px.Stati[seq]
+	Val, ok := px.Stati[seq]
 	px.mu.Unlock()
 
-	return Val == Decided
+	return ok && Val == Decided
 }
 
-func (px *Paxos) sendPrepare(Seq int, n int, v interface{}) (bool, int, interface{}) {
+// whether seq is neither decided nor forgotten
+func (px *Paxos) pending(seq int) bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	st, ok := px.Stati[seq]
+	return seq >= px.Lo && (!ok || st == Pending)
+}
+
+type prepareResult struct {
+	ok    bool
+	reply PrepareReply
+}
+
+type acceptResult struct {
+	ok    bool
+	reply AcceptReply
+}
+
+// send prepares to the config for Seq all at once and return as soon as
+// a majority has promised or anyone has refused.  replies that arrive
+// after we return still bump Hiprepare.
+func (px *Paxos) sendPrepare(Seq int, n int, v interface{}) (bool, bool, interface{}) {
+	px.mu.Lock()
+	peers := px.configFor(Seq).members()
+	px.mu.Unlock()
+
 	// take highest prepare number number
 	prepareAccepted := 0
 	currentHigh := 0
 	highest := true
 
+	results := make(chan prepareResult, len(peers))
+
 	// call prepare to all servers
-	for i, server := range px.peers {
-		// if px.printing && Debug {
-		// 	fmt.Printf("SENDING PREPARE %d %d %t\n", px.me, Seq, px.recovery)
-		// }
+	px.fanOut(peers, func(server string) {
 		var reply PrepareReply
 		ok := true
 
-		if i == px.me {
+		if server == px.me {
 			px.Prepare(PrepareArgs{Seq, n}, &reply)
 		} else {
-			ok = call(server, "Paxos.Prepare", PrepareArgs{Seq, n}, &reply, true)
+			ok = px.net.Call(server, "Paxos.Prepare", PrepareArgs{Seq, n}, &reply, true)
 		}
 
-		if i == px.me || ok {
-			if reply.Accepted {
-				// get all accepted prepares
-				prepareAccepted++
+		if ok && !reply.Accepted && reply.Num > 0 {
+			// found a higher prepare number
+			px.sawBallot(Seq, reply.Num)
+		}
+		results <- prepareResult{ok, reply}
+	})
 
-				// had accepted
-				if currentHigh < reply.High {
-					v = reply.Val
-					currentHigh = reply.High
-				}
-			} else if reply.Num > 0 {
-				// found a higher prepare number
-				px.mu.Lock()
-				if px.Hiprepare[Seq] < reply.Num {
-					px.Hiprepare[Seq] = reply.Num
-				}
-				px.mu.Unlock()
-				return false, 0, v
+	for range peers {
+		r := <-results
+		if !r.ok {
+			continue
+		}
+
+		if r.reply.Accepted {
+			// get all accepted prepares
+			prepareAccepted++
+
+			// had accepted
+			if currentHigh < r.reply.High {
+				v = r.reply.Val
+				currentHigh = r.reply.High
 			}
+
+			if prepareAccepted > len(peers)/2 {
+				break
+			}
+		} else if r.reply.Num > 0 {
+			return false, false, v
 		}
 	}
 
-	return highest, prepareAccepted, v
+	return highest, prepareAccepted > len(peers)/2, v
 }
 
 func (px *Paxos) propose(Seq int, v interface{}) {
 	px.mu.Lock()
-	px.Stati[Seq] = Pending
-	px.mu.Unlock()
-
+	if _, ok := px.Stati[Seq]; !ok {
+		px.Stati[Seq] = Pending
+	}
 	if px.Hi < Seq {
 		px.Hi = Seq
 	}
+	px.mu.Unlock()
 
-	// while not decided
-	for !px.isDecided(Seq) {
-		if px.printing && px.me == 2 {
-			fmt.Printf("PROPOSE %d %d %t --- ", px.me, Seq, px.recovery)
+	// while not decided.  it may have been since Start looked, and
+	// proposing again could get a different value through a leader
+	for px.pending(Seq) && !px.isdead() {
+		if px.printing {
+			fmt.Printf("PROPOSE %s %d %t --- ", px.me, Seq, px.recovery)
 			fmt.Println(v)
 		}
+
+		px.mu.Lock()
+		ready := px.canPropose(Seq)
+		px.mu.Unlock()
+		if !ready {
+			// don't know who decides Seq yet
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		if n, ok := px.leaderBallot(Seq); ok {
+			// leading, so phase 1 is already done
+			if px.sendAccepted(Seq, n, v) {
+				px.sendDecided(Seq, v)
+			} else {
+				px.stepDown()
+			}
+			continue
+		}
+
 		px.mu.Lock()
-		n := px.Hiprepare[Seq] + 1
+		n := px.nextBallot(px.promised(Seq))
 		px.mu.Unlock()
-		highest, prepareAccepted, newv := px.sendPrepare(Seq, n, v)
+		highest, majority, newv := px.sendPrepare(Seq, n, v)
 
 		// prepare not accepted
-		if !highest || prepareAccepted <= len(px.peers)/2 {
+		if !highest || !majority {
 			time.Sleep(time.Duration(rand.Int63n(20)) * time.Millisecond)
 			continue
 		} else {
 			v = newv
 		}
 
-		acceptAccepted := px.sendAccepted(Seq, n, v)
-
 		// accept not accepted
-		if acceptAccepted <= len(px.peers)/2 {
+		if !px.sendAccepted(Seq, n, v) {
 			time.Sleep(time.Duration(rand.Int63n(20)) * time.Millisecond)
 			continue
 		}
 
-		// send decided
-		for i, server := range px.peers {
-			var reply DecidedReply
+		px.sendDecided(Seq, v)
+	}
+}
 
-			if i == px.me {
-				// local call self
-				px.Decided(DecidedArgs{Seq, v}, &reply)
-			} else {
-				// RPC call others
-				call(server, "Paxos.Decided", DecidedArgs{Seq, v}, &reply, true)
-			}
+// run f for each of peers, all at once unless SetFanOut turned that off
+func (px *Paxos) fanOut(peers []string, f func(server string)) {
+	px.mu.Lock()
+	oneByOne := px.oneByOne
+	px.mu.Unlock()
+
+	for _, server := range peers {
+		if oneByOne {
+			f(server)
+		} else {
+			go f(server)
 		}
 	}
 }
 
-func (px *Paxos) sendAccepted(Seq int, n int, v interface{}) int {
+// SetFanOut says whether prepares and accepts go to every peer at once,
+// the default, or to one after another, waiting for each reply.
+func (px *Paxos) SetFanOut(on bool) {
+	px.mu.Lock()
+	px.oneByOne = !on
+	px.mu.Unlock()
+}
+
+// tell everyone in any config.  only waits for ourselves
+func (px *Paxos) sendDecided(Seq int, v interface{}) {
+	var reply DecidedReply
+	px.Decided(DecidedArgs{Seq, v}, &reply)
+
+	px.mu.Lock()
+	peers := px.everyone()
+	px.mu.Unlock()
+
+	for _, server := range peers {
+		if server != px.me {
+			go px.net.Call(server, "Paxos.Decided", DecidedArgs{Seq, v}, &DecidedReply{}, true)
+		}
+	}
+}
+
+// send accepts to the config for Seq all at once and return whether a
+// majority accepted, as soon as it has
+func (px *Paxos) sendAccepted(Seq int, n int, v interface{}) bool {
+	px.mu.Lock()
+	peers := px.configFor(Seq).members()
+	px.mu.Unlock()
+
 	acceptAccepted := 0
 
+	results := make(chan acceptResult, len(peers))
+
 	// send accept
-	for i, server := range px.peers {
+	px.fanOut(peers, func(server string) {
 		var reply AcceptReply
 		ok := true
 
-		if i == px.me {
+		if server == px.me {
 			// local call self
 			px.Accept(AcceptArgs{Seq, n, v}, &reply)
 		} else {
 			// RPC call others
-			//fmt.Printf("ACCEPT %d:  %d to %d\n",Seq,px.me,i)
-			ok = call(server, "Paxos.Accept", AcceptArgs{Seq, n, v}, &reply, true)
+			ok = px.net.Call(server, "Paxos.Accept", AcceptArgs{Seq, n, v}, &reply, true)
 		}
 
-		if ok {
-			if reply.Num == n {
-				// get all accepted accepts
-				acceptAccepted++
+		if ok && reply.Num > n {
+			px.sawBallot(Seq, reply.Num)
+		}
+		results <- acceptResult{ok, reply}
+	})
+
+	for range peers {
+		r := <-results
+		if r.ok && r.reply.Num == n {
+			// get all accepted accepts
+			acceptAccepted++
+			if acceptAccepted > len(peers)/2 {
+				break
 			}
 		}
 	}
 
-	return acceptAccepted
+	return acceptAccepted > len(peers)/2
 }
 
 func fateString(f Fate) string {
@@ -430,8 +659,8 @@ func (px *Paxos) Start(seq int, v interface{}) {
 	px.mu.Lock()
 	s, ok := px.Stati[seq]
 	// fmt.Printf("STILL GOING! %d %#v\n", seq, v)
-	if px.printing && px.me == 2 && Debug {
-		fmt.Printf("START %d %d %t --- %s ", px.me, seq, px.recovery, fateString(s))
+	if px.printing && Debug {
+		fmt.Printf("START %s %d %t --- %s ", px.me, seq, px.recovery, fateString(s))
 		fmt.Println(v)
 	}
 
@@ -489,9 +718,15 @@ func (px *Paxos) updateMin() {
 	defer px.mu.Unlock()
 	newmin := px.DoneSeqs[px.me]
 
-	for i := 0; i < len(px.peers); i++ {
-		if newmin > px.DoneSeqs[i] {
-			newmin = px.DoneSeqs[i]
+	// only current members still need old instances.  one we haven't
+	// heard from yet may need all of them
+	for p := range px.latestConfig().Peers {
+		d, ok := px.DoneSeqs[p]
+		if !ok {
+			d = -1
+		}
+		if newmin > d {
+			newmin = d
 		}
 	}
 
@@ -507,13 +742,24 @@ func (px *Paxos) updateMin() {
 				px.Stati[key] = Forgotten
 			}
 		}
-		// px.log()
+
+		if px.wal != nil && px.wal.count > walCompactEvery {
+			px.compact()
+		}
 	}
 }
 
 func (px *Paxos) ReplyDone(args DoneArgs, reply *DoneReply) error {
 	px.mu.Lock()
-	px.DoneSeqs[args.Me] = args.Num
+	peer := args.Addr
+	if peer == "" {
+		// from an older build
+		peer = px.peerWithID(args.Me)
+	}
+	if d, ok := px.DoneSeqs[peer]; peer != "" && (!ok || d < args.Num) {
+		px.persist(walRecord{Type: walDone, Peer: peer, N: args.Num})
+		px.DoneSeqs[peer] = args.Num
+	}
 	reply.Num = px.DoneSeqs[px.me]
 	px.mu.Unlock()
 	px.updateMin()
@@ -522,14 +768,25 @@ func (px *Paxos) ReplyDone(args DoneArgs, reply *DoneReply) error {
 }
 
 func (px *Paxos) propDone() {
-	for i, server := range px.peers {
+	px.mu.Lock()
+	peers := px.everyone()
+	px.mu.Unlock()
+
+	for _, server := range peers {
 		var reply DoneReply
 
-		if i != px.me {
-			ok := call(server, "Paxos.ReplyDone", DoneArgs{px.DoneSeqs[px.me], px.me}, &reply, true)
+		if server != px.me {
+			px.mu.Lock()
+			args := DoneArgs{px.DoneSeqs[px.me], px.myID(), px.me}
+			px.mu.Unlock()
+
+			ok := px.net.Call(server, "Paxos.ReplyDone", args, &reply, true)
 			if ok {
 				px.mu.Lock()
-				px.DoneSeqs[i] = reply.Num
+				if d, ok := px.DoneSeqs[server]; !ok || d < reply.Num {
+					px.persist(walRecord{Type: walDone, Peer: server, N: reply.Num})
+					px.DoneSeqs[server] = reply.Num
+				}
 				px.mu.Unlock()
 			}
 		}
@@ -547,12 +804,38 @@ func (px *Paxos) Done(seq int) {
 	// fmt.Printf("DONE %d: %d\n", px.me, seq)
 	px.mu.Lock()
 	if px.DoneSeqs[px.me] < seq {
+		px.persist(walRecord{Type: walDone, Peer: px.me, N: seq})
 		px.DoneSeqs[px.me] = seq
 	}
 	px.mu.Unlock()
 	px.propDone()
 }
 
+//
+// Wait blocks until seq is no longer pending or
+// timeout has passed, whichever is first.
+//
+func (px *Paxos) Wait(seq int, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		px.mu.Lock()
+		st, ok := px.Stati[seq]
+		ch := px.decided
+		px.mu.Unlock()
+
+		if ok && st != Pending {
+			return
+		}
+		select {
+		case <-ch:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
 //
 // the application wants to know whether this
 // peer thinks an instance has been decided,
@@ -560,7 +843,7 @@ func (px *Paxos) Done(seq int) {
 // should just inspect the local peer state;
 // it should not contact other Paxos peers.
 //
-func (px *Paxos) status(Seq int) (Fate, interface{}) {
+func (px *Paxos) Status(Seq int) (Fate, interface{}) {
 	// Your code here.
 	px.mu.Lock()
 	defer px.mu.Unlock()
@@ -577,15 +860,42 @@ func (px *Paxos) status(Seq int) (Fate, interface{}) {
 	return Val, nil
 }
 
+//
+// tell the peer to shut itself down.
+// for testing.
+//
+func (px *Paxos) Kill() {
+	atomic.StoreInt32(&px.dead, 1)
+}
+
+func (px *Paxos) isdead() bool {
+	return atomic.LoadInt32(&px.dead) != 0
+}
+
 //
 // the application wants to create a paxos peer.
 // the ports of all the paxos peers (including this one)
 // are in peers[]. this servers port is peers[me].
 //
-func makePaxos(peers []string, me int) *Paxos {
+func MakePaxos(peers []string, me int) *Paxos {
+	self := ""
+	if me >= 0 && me < len(peers) {
+		self = peers[me]
+	}
+	return NewPaxos(self, []Config{initialConfig(peers)})
+}
+
+//
+// make a paxos peer at address self with a known membership
+// history.  a peer joining an existing cluster passes nil and
+// learns the configs later through SetConfigs.
+//
+func NewPaxos(self string, configs []Config) *Paxos {
 	px := &Paxos{}
-	px.peers = peers
-	px.me = me
+	px.me = self
+	px.net = conns
+	px.applied = -1
+	px.decided = make(chan struct{})
 
 	// Your initialization code here.
 	px.Stati = make(map[int]Fate)
@@ -593,12 +903,11 @@ func makePaxos(peers []string, me int) *Paxos {
 	px.Hiprepare = make(map[int]int)
 	px.Hiaccept = make(map[int]int)
 	px.Val = make(map[int]interface{})
+	px.DoneSeqs = map[string]int{self: -1}
 	px.Hi = 0
 	px.Lo = 0
 
-	for i := 0; i < len(peers); i++ {
-		px.DoneSeqs = append(px.DoneSeqs, -1)
-	}
+	px.SetConfigs(configs)
 
 	return px
 }
@@ -0,0 +1,159 @@
+package gopad
+
+// Saving documents.
+//
+// A Save op goes through the log like any other, and every replica
+// writes the document out when it applies one, so they all save the same
+// text.  Besides users asking with Save, a replica puts one in now and
+// then for documents that changed (SetAutosave).  The main document goes
+// to the file the server was started with, others under the directory
+// given to SetSaveDir.
+//
+// In ModeCRDT the text doesn't move with the log, so each replica writes
+// whatever it has merged by then.
+//
+// A replica replaying the log after a restart, or catching up to its
+// peers, goes through Saves that are older than what it may have on disk
+// already.  It only writes the last of them, once it's caught up.
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const autosaveEvery = 30 * time.Second
+
+// SetSaveDir has documents other than the main one saved under dir.  Must
+// be called before Start.
+func (s *Server) SetSaveDir(dir string) {
+	s.saveDir = dir
+}
+
+// SetAutosave has the replicas save changed documents every so often, or
+// never for 0.  Must be called before Start.
+func (s *Server) SetAutosave(every time.Duration) {
+	s.autosaveEvery = every
+}
+
+// where document name is saved, "" for nowhere
+func (s *Server) docPath(name string) string {
+	if name == MainDoc {
+		return s.fname
+	}
+	if s.saveDir == "" {
+		return ""
+	}
+	return filepath.Join(s.saveDir, filepath.FromSlash(name))
+}
+
+// whether name can be a document, and a file under the save directory
+func validName(name string) bool {
+	if name == MainDoc || strings.HasPrefix(name, "/") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// write d out for an applied Save.  must hold s.mu
+func (s *Server) saveDoc(name string, d *document) {
+	d.savedCrdt = len(d.CrdtLog)
+	if s.QuerySeq < s.replayTo {
+		d.unwritten = d.doc.file()
+		return
+	}
+	s.writeDoc(name, d.doc.file())
+}
+
+// write the last Save of each document that replaying went through.
+// must hold s.mu
+func (s *Server) writeReplayed() {
+	for name, d := range s.docs {
+		if d.unwritten != nil {
+			s.writeDoc(name, d.unwritten)
+			d.unwritten = nil
+		}
+	}
+}
+
+func (s *Server) writeDoc(name string, data []byte) {
+	path := s.docPath(name)
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		log.Println("Couldn't save", path, err)
+		return
+	}
+	if err := writeFileSync(path, data); err != nil {
+		log.Println("Couldn't save", path, err)
+	}
+}
+
+// Save saves document arg.Doc on every replica and says at which view.
+func (s *Server) Save(arg SaveArg, reply *SaveReply) error {
+	s.mu.Lock()
+	_, err := s.document(arg.Doc)
+	s.mu.Unlock()
+	if err != "OK" {
+		reply.Err = err
+		return nil
+	}
+
+	seq := s.propose([]Op{Op{Type: Save, Doc: arg.Doc}})
+	if seq < 0 {
+		reply.Err = "Dead"
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.waitApplied(seq) {
+		reply.Err = "Dead"
+		return nil
+	}
+	d, err := s.document(arg.Doc)
+	if err == "OK" {
+		reply.View = d.doc.Saved
+	}
+	reply.Err = err
+	return nil
+}
+
+// whether we're the replica that puts in autosaves: the leader, or the
+// first member without one.  must hold s.mu
+func (s *Server) autosaver() bool {
+	if leader := s.px.Leader(); leader != "" {
+		return leader == s.addr
+	}
+	m := s.Configs[len(s.Configs)-1].members()
+	return len(m) > 0 && m[0] == s.addr
+}
+
+// save documents that changed since they were last saved
+func (s *Server) autosave() {
+	for !s.isdead() && s.autosaveEvery > 0 {
+		time.Sleep(s.autosaveEvery)
+
+		var changed []string
+		s.mu.Lock()
+		if s.autosaver() {
+			for name, d := range s.docs {
+				if d.doc.Saved != d.doc.View || d.savedCrdt != len(d.CrdtLog) {
+					changed = append(changed, name)
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		for _, name := range changed {
+			s.propose([]Op{Op{Type: Save, Doc: name}})
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package gopad
+
+// Selections.
+//
+// Each user has a mark, and their selection runs from it to their
+// cursor.  In ModeOrdered the mark is set with a Select op through the
+// log, so everyone sees everyone's selection, and edits move it the way
+// they move a cursor.  Deleting, replacing or indenting a selection is a
+// single Range op holding the positional edits, made one after the other,
+// instead of an op per rune.  In ModeCRDT the mark stays with us like
+// cursor moves do, and a range edit is a CRDT op per rune.
+
+// set or clear op.Client's mark
+func (doc *Doc) setMark(op Op) {
+	if doc.Marks == nil {
+		// gob leaves empty maps out
+		doc.Marks = make(map[int]int)
+	}
+	if op.At < 0 {
+		delete(doc.Marks, op.Client)
+		return
+	}
+	e := doc.transform(op, op.edit())
+	if e.Type == noEdit {
+		return
+	}
+	if n := doc.size(); e.At > n {
+		e.At = n
+	}
+	doc.Marks[op.Client] = e.At
+}
+
+// number of runes in the document, counting row breaks
+func (doc *Doc) size() int {
+	last := len(doc.Rows) - 1
+	if last < 0 {
+		return 0
+	}
+	return doc.Offset(Pos{Y: last, X: len(doc.Rows[last].Chars)})
+}
+
+// Selection is the offsets user has selected, from lo up to hi, or false
+// if nothing.
+func (doc *Doc) Selection(user int) (lo int, hi int, ok bool) {
+	mark, ok := doc.Marks[user]
+	if !ok {
+		return 0, 0, false
+	}
+	cur := doc.Offset(doc.UserPos[user])
+	if mark > cur {
+		return cur, mark, true
+	}
+	return mark, cur, mark < cur
+}
+
+// set our mark at the cursor, or clear it
+func (c *Client) toggleMark() {
+	if _, ok := c.tempdoc.Marks[c.id]; ok {
+		c.setMark(-1)
+	} else {
+		c.setMark(c.tempdoc.Offset(c.tempdoc.UserPos[c.id]))
+	}
+}
+
+// set our mark at offset at, clear it for -1
+func (c *Client) setMark(at int) {
+	if c.tempdoc.Mode == ModeCRDT {
+		c.marked = at >= 0
+		c.markID = c.tempdoc.Text.idBefore(at)
+		c.crdtMark()
+		return
+	}
+	if _, ok := c.tempdoc.Marks[c.id]; !ok && at < 0 {
+		return
+	}
+	c.logOp([]Op{Op{Type: Select, At: at, View: c.doc.View, Client: c.id}})
+}
+
+// put our mark in tempdoc, in ModeCRDT it follows the rune it's after
+func (c *Client) crdtMark() {
+	if c.marked {
+		c.tempdoc.Marks[c.id] = c.tempdoc.Text.offsetAfter(c.markID)
+	} else {
+		delete(c.tempdoc.Marks, c.id)
+	}
+}
+
+// log edits, made one after the other, as a single key press
+func (c *Client) logEdits(edits []Edit) {
+	if len(edits) == 0 {
+		return
+	}
+	if c.tempdoc.Mode == ModeCRDT {
+		// our cursor and mark move the way a Range op moves them
+		at := c.tempdoc.Offset(c.tempdoc.UserPos[c.id])
+		mark, marked := c.tempdoc.Marks[c.id]
+		var ops []Op
+		for _, e := range edits {
+			// a rune at a time
+			runes := []Edit{e}
+			if e.Type == InsertText {
+				runes = nil
+				for i, ch := range []rune(e.Text) {
+					runes = append(runes, Edit{Type: InsertAt, At: e.At + i, Data: ch})
+				}
+			}
+			for _, r := range runes {
+				ops = append(ops, c.logCRDT(r.Type, r.At, r.Data))
+				at = Transform(Edit{Type: Select, At: at}, r).At
+				mark = Transform(Edit{Type: Select, At: mark}, r).At
+			}
+		}
+		c.remember(ops)
+
+		c.tempdoc.Anchors[c.id] = c.tempdoc.Text.idBefore(at)
+		c.tempdoc.crdtRows()
+		if marked {
+			c.setMark(mark)
+		}
+		return
+	}
+	if len(edits) == 1 && edits[0].Type == InsertText {
+		c.remember([]Op{c.logPositional(edits)})
+		return
+	}
+	c.remember([]Op{c.logRange(edits)})
+}
+
+// log edits as a Range op
+func (c *Client) logRange(edits []Edit) Op {
+	op := Op{Type: Range, View: c.doc.View, Client: c.id}
+	for _, e := range edits {
+		e.Client = c.id
+		op.Edits = append(op.Edits, e)
+	}
+	c.logOp([]Op{op})
+	return c.selfOps[len(c.selfOps)-1]
+}
+
+// log edits as one positional op, or a Range op for more
+func (c *Client) logPositional(edits []Edit) Op {
+	if len(edits) > 1 {
+		return c.logRange(edits)
+	}
+	e := edits[0]
+	c.logOp([]Op{Op{Type: e.Type, At: e.At, Data: e.Data, Text: e.Text, View: c.doc.View, Client: c.id}})
+	return c.selfOps[len(c.selfOps)-1]
+}
+
+// delete what we have selected, false if nothing
+func (c *Client) deleteSelection() bool {
+	return c.replaceSelection("")
+}
+
+// put text in at our cursor, or in place of what we have selected
+func (c *Client) insertText(text string) {
+	if text == "" || c.replaceSelection(text) {
+		return
+	}
+	at := c.tempdoc.Offset(c.tempdoc.UserPos[c.id])
+	c.logEdits([]Edit{Edit{Type: InsertText, At: at, Text: text}})
+}
+
+// put text in place of what we have selected, false if nothing
+func (c *Client) replaceSelection(text string) bool {
+	lo, hi, ok := c.tempdoc.Selection(c.id)
+	if !ok {
+		return false
+	}
+
+	var edits []Edit
+	for at := lo; at < hi; at++ {
+		edits = append(edits, Edit{Type: DeleteAt, At: lo})
+	}
+	if text != "" {
+		edits = append(edits, Edit{Type: InsertText, At: lo, Text: text})
+	}
+	c.setMark(-1)
+	c.logEdits(edits)
+	return true
+}
+
+// indent the rows the selection covers by a tab, or take one level of
+// indent away from them.  false if nothing is selected
+func (c *Client) indent(out bool) bool {
+	lo, hi, ok := c.tempdoc.Selection(c.id)
+	if !ok {
+		return false
+	}
+	first, _ := c.tempdoc.posAt(lo)
+	last, _ := c.tempdoc.posAt(hi)
+	if last.X == 0 && last.Y > first.Y {
+		// ends at the start of a row, which isn't selected
+		last.Y--
+	}
+
+	var edits []Edit
+	shift := 0 // how far earlier edits moved this row
+	for y := first.Y; y <= last.Y; y++ {
+		at := c.tempdoc.Offset(Pos{Y: y}) + shift
+		if !out {
+			edits = append(edits, Edit{Type: InsertAt, At: at, Data: '\t'})
+			shift++
+			continue
+		}
+
+		row := c.tempdoc.Rows[y].Chars
+		n := 0
+		if len(row) > 0 && row[0] == '\t' {
+			n = 1
+		} else {
+			for n < TABSTOP && n < len(row) && row[n] == ' ' {
+				n++
+			}
+		}
+		for i := 0; i < n; i++ {
+			edits = append(edits, Edit{Type: DeleteAt, At: at})
+		}
+		shift -= n
+	}
+	c.logEdits(edits)
+	return true
+}
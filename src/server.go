@@ -4,125 +4,163 @@ import (
 	"bufio"
 	"encoding/gob"
 	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"net/rpc"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 var (
 	updateDelay = 250 * time.Millisecond
+
+	subscribeWait  = 5 * time.Second // longest a Subscribe is held open
+	subscribeBatch = 256             // most ops in one reply
+	noopDelay      = 1 * time.Second // stuck this long before proposing a no-op
 )
 
+const nameMax = 24 // longest name a user can go by, in runes
+
 type ViewSeq struct {
 	View uint32
 	Seq  int
+	Doc  string
+}
+
+// old replicas send entries as bare Paxages
+func init() {
+	gob.Register([]Op{})
+	gob.Register(Paxage{})
+	gob.Register(ConfigChange{})
+	gob.Register(ModeChange{})
+	gob.Register(DocChange{})
 }
 
 type Server struct {
 	listener net.Listener
 	px       *Paxos
+	net      Transport
 	mu       sync.Mutex
+	pmu      sync.Mutex // serializes proposals, guards StartSeq
+	dead     int32      // for testing
+	wire     int        // log entry version to write
 
 	// config
 	reboot  bool
-	servers []string
-	me      int
+	joining bool     // waiting to be added to a running cluster
+	seeds   []string // peers to recover from
+	addr    string   // our address as peers know it
 	port    int
+	dir     string // where to persist state, "" for none
+
+	fname         string        // the main document's file
+	saveDir       string        // where the others go
+	autosaveEvery time.Duration // 0 for never
+	timeout       time.Duration // sessions silent this long end, 0 for never
+	maxUsers      int           // in a document at once, 0 for no limit
 
 	// data
 	// Doc.UserSession  map[int]uint32 // xid of current user session
-	doc          Doc
-	CommitLog    []Op
-	UserViews    map[int]uint32 // last reported view number by user
-	CommitPoint  uint32         // the upper bound of our commit log (in absolute terms)
-	DiscardPoint uint32         // ops below this have been discarded
-	StartSeq     int            // seq number to Start paxos
-	QuerySeq     int            // seq number to Query paxos
-	ViewSeqs     []ViewSeq      // Paxos seqs -> Doc Views
+	docs     map[string]*document // by name, see docs.go
+	StartSeq int                  // seq number to Start paxos
+	QuerySeq int                  // seq number to Query paxos
+	applied  chan struct{}        // closed whenever QuerySeq moves, and on Kill
+	ViewSeqs []ViewSeq            // Paxos seqs -> Doc Views
+	Configs  []Config             // membership, oldest first
+
+	crdtApplied int // CRDT ops applied, to any document
+	crdtSnapped int // crdtApplied at the last snapshot
+
+	snap       *snapshot // latest snapshot
+	snapTime   time.Time
+	catchupSeq int // peers had applied up to here when we recovered
+	replayTo   int // Saves below here may be older than what's on disk
 
 	// handler  map[string]HandleFunc
 	// m sync.RWMutex
 }
 
-func (s *Server) Copy(args *RecoverArg, reply *RecoverReply) error {
-	if !s.reboot {
-		s.mu.Lock()
-		s.px.Lock()
-
-		reply.Srv, _ = json.Marshal(s)
-		reply.Px, _ = json.Marshal(s.px)
-		reply.Doc, _ = docToBytes(&s.doc)
+// NewServer makes replica servers[me] of a cluster whose initial members
+// are servers.
+func NewServer(fname string, reboot bool, port int, servers []string, me int, dir string) *Server {
+	s := Server{
+		reboot:  reboot,
+		wire:    wireVersion,
+		net:     conns,
+		seeds:   servers,
+		addr:    servers[me],
+		port:    port,
+		dir:     dir,
+		px:      MakePaxos(servers, me),
+		Configs: []Config{initialConfig(servers)},
+
+		fname:         fname,
+		autosaveEvery: autosaveEvery,
+		timeout:       sessionTimeout,
+		maxUsers:      MAXUSERS,
+		applied:       make(chan struct{}),
+	}
+	s.open(fname)
+	return &s
+}
 
-		reply.Err = "OK"
+// JoinServer makes a replica at addr that joins the cluster seeds belong
+// to.  It waits until somebody adds it with Reconfigure.
+func JoinServer(port int, addr string, seeds []string, dir string) *Server {
+	s := Server{
+		reboot:  true,
+		joining: true,
+		wire:    wireVersion,
+		net:     conns,
+		seeds:   seeds,
+		addr:    addr,
+		port:    port,
+		dir:     dir,
+		px:      NewPaxos(addr, nil),
 
-		s.px.Unlock()
-		s.mu.Unlock()
-	} else {
-		reply.Err = "REBOOTING"
+		autosaveEvery: autosaveEvery,
+		timeout:       sessionTimeout,
+		maxUsers:      MAXUSERS,
+		applied:       make(chan struct{}),
 	}
-
-	return nil
+	s.open("")
+	return &s
 }
 
-func (s *Server) Recover(servers []string) {
-	done := false
-	var reply RecoverReply
-	var tmp Server
-
-	for !done {
-		for i, srv := range servers {
-			if i != s.me {
-				ok := call(srv, "Server.Copy", RecoverArg{}, &reply, false)
-				if ok && reply.Err == "OK" {
-					json.Unmarshal(reply.Srv, &tmp)
-					s.px.Recover(reply.Px)
-					done = true
-					break
-				}
-			}
-			time.Sleep(updateDelay)
+func (s *Server) open(fname string) {
+	s.docs = make(map[string]*document)
+	reboot := s.reboot
+	if s.dir != "" {
+		err := s.px.SetSave(filepath.Join(s.dir, fmt.Sprintf("paxos-%d.log", s.port)))
+		if err != nil {
+			log.Fatal(err)
 		}
-	}
-
-	s.CommitLog = tmp.CommitLog
-	s.UserViews = tmp.UserViews
-	s.CommitPoint = tmp.CommitPoint
-	s.DiscardPoint = tmp.DiscardPoint
-	s.StartSeq = tmp.StartSeq
-	s.QuerySeq = tmp.QuerySeq
-	s.ViewSeqs = tmp.ViewSeqs
-
-	bytesToDoc(reply.Doc, &s.doc)
-}
 
-func NewServer(fname string, reboot bool, port int, servers []string, me int) *Server {
-	s := Server{
-		reboot:  reboot,
-		servers: servers,
-		me:      me,
-		port:    port,
-		px:      makePaxos(servers, me),
+		if !reboot && !s.loadSnapshot() && s.px.Min() > 0 {
+			// paxos already forgot instances we have no snapshot for
+			log.Println("Missing snapshot, recovering from peers")
+			reboot = true
+			s.reboot = true
+		}
 	}
 
-	if !reboot {
-		s.UserViews = make(map[int]uint32)
-		s.CommitLog = make([]Op, 0)
+	if reboot {
+		s.Recover(s.seeds)
+		s.reboot = false
+		s.joining = false
+	} else if s.snap == nil {
 		s.ViewSeqs = make([]ViewSeq, 0)
 
 		// new document, so start fresh
-		s.doc = Doc{
-			UserSeqs:    make(map[int]uint32),
-			UserPos:     make(map[int]Pos),
-			Colors:      make(map[int]int),
-			UserSession: make(map[int]uint32),
-		}
-
+		var rows []string
 		if fname != "" {
 			file, err := os.Open(fname)
 			if err != nil {
@@ -131,77 +169,150 @@ func NewServer(fname string, reboot bool, port int, servers []string, me int) *S
 			defer file.Close()
 			scanner := bufio.NewScanner(file)
 			for scanner.Scan() {
-				s.doc.Rows = append(s.doc.Rows,
-					erow{
-						Chars:  scanner.Text(),
-						Temp:   make([]bool, len(scanner.Text())),
-						Author: make([]int, len(scanner.Text())),
-					})
+				rows = append(rows, scanner.Text())
 			}
-		} else {
-			// empty first row
-			s.doc.Rows = append(s.doc.Rows,
-				erow{
-					Chars:  "",
-					Temp:   make([]bool, 0),
-					Author: make([]int, 0),
-				})
 		}
-	} else {
-		s.Recover(servers)
+		s.docs[MainDoc] = newDocument(rows, -1)
+
+		if err := s.takeSnapshot(); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	return &s
+	if s.snap != nil && !reboot {
+		// instances our WAL has past the snapshot were likely applied,
+		// and saved, before we went down
+		s.replayTo = s.px.Max() + 1
+	}
+
+	s.px.SetConfigs(s.Configs)
+	s.px.SetApplied(s.QuerySeq)
 }
 
 func (s *Server) getOp(seq int) Paxage {
 	to := 10 * time.Millisecond
-	for {
-		status, val := s.px.status(seq)
+	for !s.isdead() {
+		status, val := s.px.Status(seq)
 		if status == Decided {
-			return val.(Paxage)
+			// one we can't read isn't ours either
+			pkg, _ := DecodeEntry(val)
+			return pkg
 		}
 
-		time.Sleep(to)
-		if to < 10*time.Second {
+		s.px.Wait(seq, to)
+		if to < updateDelay {
 			to *= 2
+		} else {
+			// taking a while, maybe we missed the Decided
+			s.px.CatchUp(seq)
 		}
 	}
+	return Paxage{}
 }
 
-func (s *Server) handleOp(ops []Op) {
+// paxos value for payload v
+func (s *Server) entry(v interface{}, xid int64) interface{} {
+	s.mu.Lock()
+	wire := s.wire
+	s.mu.Unlock()
+
+	e, err := EncodeEntry(Paxage{v, xid}, wire)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return e
+}
+
+// get v decided in some instance and return which, -1 if we were
+// killed first
+func (s *Server) propose(v interface{}) int {
 	xid := rand.Int63()
-	for {
-		s.px.Start(s.StartSeq, Paxage{ops, xid})
-		pkg := s.getOp(s.StartSeq)
+	e := s.entry(v, xid)
+
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+
+	s.mu.Lock()
+	if s.StartSeq < s.QuerySeq {
+		s.StartSeq = s.QuerySeq
+	}
+	s.mu.Unlock()
+
+	for !s.isdead() {
+		seq := s.StartSeq
+		s.px.Start(seq, e)
+		pkg := s.getOp(seq)
 		s.StartSeq++
 
 		if pkg.Xid == xid {
-			break
+			return seq
 		}
 	}
+	return -1
+}
+
+func (s *Server) handleOp(ops []Op) {
+	s.propose(ops)
 }
 
 func (s *Server) Init(arg InitArg, reply *InitReply) error {
 	log.Println("Sending initial...", arg.Client)
 	s.mu.Lock()
-	session, ok := s.doc.UserSession[arg.Client]
+	d, err := s.document(arg.Doc)
+	if err != "OK" {
+		reply.Err = err
+		s.mu.Unlock()
+		return nil
+	}
+	session, ok := d.doc.UserSession[arg.Client]
+	d.hear(arg.Client)
 
-	if !ok && len(s.doc.Colors) >= MAXUSERS {
+	if !ok && s.full(d) {
 		reply.Err = "Full"
 		s.mu.Unlock()
 		return nil
 	}
 
 	if session != arg.Session {
-		// new session
-		s.handleOp([]Op{Op{Type: Init, Session: arg.Session, Client: arg.Client}})
+		// new session, don't hold the lock while paxos works
+		max := s.limit(d)
+		s.mu.Unlock()
+		// a name is drawn on everyone's status bar, so nothing that
+		// would move their cursor or change colors
+		name := []rune(strings.TrimSpace(strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, arg.Name)))
+		if len(name) > nameMax {
+			name = name[:nameMax]
+		}
+		seq := s.propose([]Op{Op{Type: Init, Session: arg.Session, Client: arg.Client, Doc: arg.Doc, Text: string(name), At: arg.Color, Max: max}})
+		if seq < 0 {
+			reply.Err = "Dead"
+			return nil
+		}
+		// wait until it's applied to see whether it got a spot
+		s.mu.Lock()
+		if !s.waitApplied(seq) {
+			reply.Err = "Dead"
+			s.mu.Unlock()
+			return nil
+		}
+		if _, ok := d.doc.Colors[arg.Client]; !ok {
+			// full by the time it was applied
+			reply.Err = "Full"
+			s.mu.Unlock()
+			return nil
+		}
 
 		// marshal document and send back
-		buf, err := docToBytes(&s.doc)
+		buf, err := docToBytes(&d.doc)
 		if err != nil {
 			log.Println("Couldn't send document", err)
 			reply.Err = "Encode"
+			s.mu.Unlock()
 			return nil
 		}
 		reply.Doc = buf
@@ -216,32 +327,119 @@ func (s *Server) Init(arg InitArg, reply *InitReply) error {
 
 // get committed but not discarded ops
 func (s *Server) Query(arg QueryArg, reply *QueryReply) error {
-	idx := arg.View
-
-	// log.Println("Sending query...", s.view-idx)
-	if idx > s.CommitPoint {
-		reply.Err = "BAD"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, err := s.document(arg.Doc)
+	if err != "OK" {
+		reply.Err = err
 		return nil
 	}
+	s.commitsFrom(d, arg.View, arg.Client, 0, reply)
+	return nil
+}
+
+// Subscribe is Query held open until something past arg.View commits
+// (or subscribeWait passes), so clients hear about ops as soon as they
+// are applied.  A reply has at most arg.Max ops, clients ask again from
+// their new view for the rest.
+func (s *Server) Subscribe(arg SubscribeArg, reply *QueryReply) error {
+	timer := time.NewTimer(subscribeWait)
+	defer timer.Stop()
 
 	s.mu.Lock()
-	if s.UserViews[arg.Client] < arg.View {
-		s.UserViews[arg.Client] = arg.View
+	defer s.mu.Unlock()
+	d, err := s.document(arg.Doc)
+	if err == "OK" {
+		d.listen(arg.Client)
+		defer d.unlisten(arg.Client)
+	}
+	for waiting := true; err == "OK" && waiting && arg.View == d.CommitPoint && !s.isdead(); {
+		ch := d.committed
+		s.mu.Unlock()
+		select {
+		case <-ch:
+		case <-timer.C:
+			waiting = false
+		}
+		s.mu.Lock()
+		// it may have been renamed or deleted meanwhile
+		d, err = s.document(arg.Doc)
+	}
+	if err != "OK" {
+		reply.Err = err
+		return nil
+	}
+
+	max := arg.Max
+	if max <= 0 || max > subscribeBatch {
+		max = subscribeBatch
+	}
+	s.commitsFrom(d, arg.View, arg.Client, max, reply)
+	return nil
+}
+
+// d's commit log from view on, at most max ops if max > 0.  must hold
+// s.mu
+func (s *Server) commitsFrom(d *document, view uint32, client int, max int, reply *QueryReply) {
+	if view > d.CommitPoint || view < d.DiscardPoint {
+		reply.Err = "BAD"
+		return
 	}
-	buf, err := json.Marshal(s.CommitLog[idx-s.DiscardPoint : s.CommitPoint-s.DiscardPoint])
-	s.mu.Unlock()
 
+	if d.UserViews[client] < view {
+		d.UserViews[client] = view
+	}
+	d.hear(client)
+	ops := d.CommitLog[view-d.DiscardPoint : d.CommitPoint-d.DiscardPoint]
+	if max > 0 && len(ops) > max {
+		ops = ops[:max]
+	}
+	buf, err := json.Marshal(ops)
 	if err != nil {
 		log.Println("Couldn't send document", err)
 		reply.Err = "Encode"
-		return nil
+		return
 	}
 	reply.Data = buf
 	reply.Err = "OK"
-	return nil
+}
+
+// SetMaxUsers limits how many users can be in a document at once, for
+// documents that weren't created with their own limit.  0 for no limit.
+// Must be called before Start.
+func (s *Server) SetMaxUsers(n int) {
+	s.maxUsers = n
+}
+
+// most users d takes, 0 for no limit.  must hold s.mu
+func (s *Server) limit(d *document) int {
+	if d.doc.MaxUsers != 0 {
+		return d.doc.MaxUsers
+	}
+	return s.maxUsers
+}
+
+// whether d has room for nobody else.  must hold s.mu
+func (s *Server) full(d *document) bool {
+	max := s.limit(d)
+	return max > 0 && len(d.doc.Colors) >= max
+}
+
+// SetMulti makes the replicas elect a stable leader, which all other
+// replicas forward ops to.  Must be called before Start.
+func (s *Server) SetMulti(on bool) {
+	s.px.SetMulti(on)
 }
 
 func (s *Server) Handle(arg OpArg, reply *OpReply) error {
+	if leader := s.px.Leader(); !arg.Forwarded && leader != "" && leader != s.addr {
+		// let the leader sequence it
+		arg.Forwarded = true
+		if s.net.Call(leader, "Server.Handle", arg, reply, false) {
+			return nil
+		}
+	}
+
 	// unmarshal commit array
 	var ops []Op
 	err := json.Unmarshal(arg.Data, &ops)
@@ -254,8 +452,20 @@ func (s *Server) Handle(arg OpArg, reply *OpReply) error {
 	// log.Printf("RECEIVED: %v\n", ops)
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if ops[0].Seq > s.doc.UserSeqs[ops[0].Client]+1 {
+	d, derr := s.document(arg.Doc)
+	if derr != "OK" {
+		s.mu.Unlock()
+		reply.Err = derr
+		return nil
+	}
+	expect := d.doc.UserSeqs[ops[0].Client]
+	d.hear(ops[0].Client)
+	s.mu.Unlock()
+	for i := range ops {
+		ops[i].Doc = arg.Doc
+	}
+
+	if ops[0].Seq > expect+1 {
 		// sequence number larger than expected
 		reply.Err = "High"
 		return nil
@@ -277,8 +487,8 @@ func (s *Server) Handle(arg OpArg, reply *OpReply) error {
 		}
 	}
 
-	if ops[len(ops)-1].Seq > s.doc.UserSeqs[ops[0].Client] {
-		// there is a new op
+	if ops[len(ops)-1].Seq > expect {
+		// there is a new op.  update drops any we already applied
 		s.handleOp(ops)
 	}
 
@@ -289,67 +499,123 @@ func (s *Server) Handle(arg OpArg, reply *OpReply) error {
 // apply log
 func (s *Server) update() {
 	var ops []Op
-	for {
-		status, val := s.px.status(s.QuerySeq)
+	waiting := time.Now() // since when we've been waiting on QuerySeq
+	bad := -1             // instance we couldn't decode
+	asked := time.Now()   // last time we asked peers for decided instances
+	for !s.isdead() {
+		status, val := s.px.Status(s.QuerySeq)
 		if status == Pending {
-			time.Sleep(updateDelay)
+			behind := s.QuerySeq < s.catchupSeq || s.px.Max() > s.QuerySeq
+			if (behind && time.Since(waiting) > updateDelay) || time.Since(asked) > noopDelay {
+				// others have moved on, or might have without us
+				// hearing.  ask them
+				asked = time.Now()
+				if s.px.CatchUp(s.QuerySeq) {
+					continue
+				}
+				if behind && time.Since(waiting) > noopDelay {
+					// nobody has it decided, propose to settle it
+					s.px.Start(s.QuerySeq, s.entry([]Op{}, 0))
+				}
+			}
+			s.px.Wait(s.QuerySeq, updateDelay)
 			continue
 		}
+		waiting = time.Now()
 
 		// get package from paxos
-		ops = (val.(Paxage)).Payload.([]Op)
+		pkg, err := DecodeEntry(val)
+		if err != nil {
+			if bad != s.QuerySeq {
+				log.Printf("Can't decode instance %d, stuck until upgraded: %v\n", s.QuerySeq, err)
+				bad = s.QuerySeq
+			}
+			time.Sleep(updateDelay)
+			continue
+		}
 		s.mu.Lock()
 
+		ops = nil
+		switch p := pkg.Payload.(type) {
+		case []Op:
+			ops = p
+		case ConfigChange:
+			s.applyConfig(p, s.QuerySeq)
+		case ModeChange:
+			ops = s.modeOps(p)
+		case DocChange:
+			s.applyDocs(p, s.QuerySeq)
+		}
+
 		var viewMax uint32
+		vs := ViewSeq{Seq: s.QuerySeq}
 
-		// append to commit log
-		for _, c := range ops {
-			if s.doc.apply(c, false) {
-				// append to commitlog if op is applicable
-				s.CommitLog = append(s.CommitLog, c)
-				s.CommitPoint++
-			}
-			if s.UserViews[c.Client] < c.View && c.Type != Init {
-				// only update UserView if not Init
-				s.UserViews[c.Client] = c.View
-			}
-			if c.View > viewMax {
-				viewMax = c.View
+		// every op in an entry is for the same document.  ones for a
+		// document that's gone are dropped
+		if len(ops) > 0 {
+			vs.Doc = ops[0].Doc
+		}
+		if d, ok := s.docs[vs.Doc]; ok && len(ops) > 0 {
+			// append to commit log
+			for _, c := range ops {
+				if d.doc.apply(c, false) {
+					if _, ok := d.UserViews[c.Client]; c.Type == Init && !ok {
+						// they'll follow the log from their Init, on
+						// every replica and not just the one they asked
+						d.UserViews[c.Client] = d.CommitPoint
+					}
+					// append to commitlog if op is applicable
+					d.CommitLog = append(d.CommitLog, c)
+					d.CommitPoint++
+					if c.Type == Save {
+						s.saveDoc(vs.Doc, d)
+					}
+					if c.Type == Quit {
+						// gone, so no longer holding up discard
+						delete(d.UserViews, c.Client)
+						delete(d.heard, c.Client)
+					}
+				}
+				if d.UserViews[c.Client] < c.View && c.Type != Init && c.Type != Quit {
+					// only update UserView if not Init
+					d.UserViews[c.Client] = c.View
+				}
+				if c.View > viewMax {
+					viewMax = c.View
+				}
 			}
+			d.wake()
+			d.discard()
 		}
 
-		s.ViewSeqs = append(s.ViewSeqs, ViewSeq{View: viewMax, Seq: s.QuerySeq})
+		vs.View = viewMax
+		s.ViewSeqs = append(s.ViewSeqs, vs)
 		s.QuerySeq++
-		if s.StartSeq < s.QuerySeq {
-			s.StartSeq = s.QuerySeq
-		}
-
-		var min uint32
-		for _, v := range s.UserViews {
-			if min == 0 {
-				min = v
-			} else if min > v {
-				min = v
-			}
-		}
-		if s.DiscardPoint < min {
-			s.CommitLog = s.CommitLog[min-s.DiscardPoint:]
-			s.DiscardPoint = min
+		s.wakeApplied()
+		if s.QuerySeq == s.replayTo {
+			s.writeReplayed()
 		}
+		s.pruneConfigs()
+		s.px.SetConfigs(s.Configs)
+		s.px.SetApplied(s.QuerySeq)
 
-		s.processDone(min)
+		s.maybeSnapshot()
+		s.processDone()
 
 		s.mu.Unlock()
-		time.Sleep(updateDelay)
 	}
 }
 
-func (s *Server) processDone(view uint32) {
+// tell paxos about instances every user of their document has seen.
+// only instances covered by the latest snapshot can be forgotten.
+func (s *Server) processDone() {
 	for {
 		if len(s.ViewSeqs) == 0 {
 			break
 		} else {
-			if s.ViewSeqs[0].View <= view {
+			vs := s.ViewSeqs[0]
+			d, ok := s.docs[vs.Doc]
+			if (!ok || vs.View <= d.minView()) && vs.Seq < s.snap.Seq {
 				s.px.Done(s.ViewSeqs[0].Seq)
 				s.ViewSeqs = s.ViewSeqs[1:]
 			} else {
@@ -359,9 +625,78 @@ func (s *Server) processDone(view uint32) {
 	}
 }
 
+// serve our RPCs and our paxos peer's
+func (s *Server) register(rpcs *rpc.Server) {
+	rpcs.Register(s)
+	rpcs.Register(s.px)
+}
+
+// Kill stops applying the log and proposing.  For testing.
+func (s *Server) Kill() {
+	atomic.StoreInt32(&s.dead, 1)
+	s.px.Kill()
+	s.mu.Lock()
+	s.wakeApplied()
+	s.mu.Unlock()
+}
+
+// wake up whoever waits for an instance to apply.  must hold s.mu
+func (s *Server) wakeApplied() {
+	close(s.applied)
+	s.applied = make(chan struct{})
+}
+
+// wait until instance seq is applied, false if we're killed first.  must
+// hold s.mu
+func (s *Server) waitApplied(seq int) bool {
+	for s.QuerySeq <= seq {
+		if s.isdead() {
+			return false
+		}
+		ch := s.applied
+		s.mu.Unlock()
+		<-ch
+		s.mu.Lock()
+	}
+	return true
+}
+
+func (s *Server) isdead() bool {
+	return atomic.LoadInt32(&s.dead) != 0
+}
+
+// State returns how many instances have been applied and a copy of the
+// main document after them.
+func (s *Server) State() (int, Doc) {
+	n, doc, _ := s.DocState(MainDoc)
+	return n, doc
+}
+
+// DocState is State for document name, false if there's no such
+// document.
+func (s *Server) DocState(name string) (int, Doc, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.docs[name]
+	if !ok {
+		return s.QuerySeq, Doc{}, false
+	}
+	return s.QuerySeq, *d.doc.dup(), true
+}
+
+// Run applies the log and, with SetMulti, elects a leader, without
+// listening for RPCs.  Start calls it.
+func (s *Server) Run() {
+	go s.update()
+	go s.gossip()
+	go s.autosave()
+	go s.expire()
+	go s.px.Run()
+}
+
 func (s *Server) Start() {
 	rpcs := rpc.NewServer()
-	rpcs.Register(s)
+	s.register(rpcs)
 
 	addr := ":" + strconv.Itoa(s.port)
 
@@ -374,14 +709,9 @@ func (s *Server) Start() {
 		}
 	}
 
-	gob.Register([]Op{})
-	gob.Register(Paxage{})
-
-	rpcs.Register(s.px)
-
 	log.Println("Listening on", s.listener.Addr().String())
 
-	go s.update()
+	s.Run()
 
 	for {
 		conn, err := s.listener.Accept()
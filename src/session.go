@@ -0,0 +1,167 @@
+package gopad
+
+// Sessions ending.
+//
+// A session starts with an Init op and ends with a Quit, which frees the
+// user's color and takes their cursor, mark and view out of the document,
+// so they stop holding up discarding the commit log.  Like Init, Quit
+// goes by session instead of Seq, and one for a session that's already
+// over does nothing.  Clients send one through Leave when they close.
+//
+// Clients that go away without leaving are noticed by the replicas.
+// Every RPC from a user counts as hearing from them, as does the whole
+// time a Subscribe or Sync of theirs is held open, and a replica
+// proposes a Quit for a session nobody has heard from in a while.  A
+// client talks to one replica at a time, so before giving up on a user a
+// replica asks the others when they last heard from them.
+
+import (
+	"log"
+	"time"
+)
+
+const sessionTimeout = 2 * time.Minute
+
+// SetSessionTimeout ends sessions nobody hears from for this long, or
+// never for 0.  Must be called before Start.
+func (s *Server) SetSessionTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+// user id's session ended.  false if it isn't their current one
+func (doc *Doc) leave(id int, session uint32) bool {
+	if cur, ok := doc.UserSession[id]; !ok || cur != session {
+		return false
+	}
+	delete(doc.UserSession, id)
+	delete(doc.UserPos, id)
+	delete(doc.Colors, id)
+	delete(doc.Names, id)
+	delete(doc.Marks, id)
+	delete(doc.Anchors, id)
+	return true
+}
+
+// we heard from user.  must hold s.mu
+func (d *document) hear(user int) {
+	if d.heard == nil {
+		d.heard = make(map[int]time.Time)
+	}
+	d.heard[user] = time.Now()
+}
+
+// user is waiting on a Subscribe or Sync, until unlisten.  must hold
+// s.mu
+func (d *document) listen(user int) {
+	d.hear(user)
+	if d.listening == nil {
+		d.listening = make(map[int]int)
+	}
+	d.listening[user]++
+}
+
+func (d *document) unlisten(user int) {
+	d.hear(user)
+	if d.listening[user]--; d.listening[user] <= 0 {
+		delete(d.listening, user)
+	}
+}
+
+// how long we haven't heard from user, false if we never have.  must
+// hold s.mu
+func (d *document) silent(user int) (time.Duration, bool) {
+	if d.listening[user] > 0 {
+		return 0, true
+	}
+	t, ok := d.heard[user]
+	if !ok {
+		return 0, false
+	}
+	return time.Since(t), true
+}
+
+// Leave ends a client's session.
+func (s *Server) Leave(arg LeaveArg, reply *LeaveReply) error {
+	s.mu.Lock()
+	_, err := s.document(arg.Doc)
+	s.mu.Unlock()
+	if err != "OK" {
+		reply.Err = err
+		return nil
+	}
+	s.handleOp([]Op{Op{Type: Quit, Client: arg.Client, Session: arg.Session, Doc: arg.Doc}})
+	reply.Err = "OK"
+	return nil
+}
+
+// Heard says how long ago we last heard from a user.
+func (s *Server) Heard(arg HeardArg, reply *HeardReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, err := s.document(arg.Doc)
+	if err != "OK" {
+		reply.Err = err
+		return nil
+	}
+	ago, ok := d.silent(arg.Client)
+	if !ok {
+		reply.Err = "None"
+		return nil
+	}
+	reply.Ago = ago
+	reply.Err = "OK"
+	return nil
+}
+
+// propose a Quit for sessions nobody has heard from in s.timeout
+func (s *Server) expire() {
+	for !s.isdead() && s.timeout > 0 {
+		time.Sleep(s.timeout / 4)
+
+		var quits []Op
+		var peers []string
+		s.mu.Lock()
+		for name, d := range s.docs {
+			for user, session := range d.doc.UserSession {
+				if ago, ok := d.silent(user); !ok {
+					// start the clock, we may just have come up
+					d.hear(user)
+				} else if ago > s.timeout {
+					quits = append(quits, Op{Type: Quit, Client: user, Session: session, Doc: name})
+				}
+			}
+		}
+		for _, p := range s.Configs[len(s.Configs)-1].members() {
+			if p != s.addr {
+				peers = append(peers, p)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, op := range quits {
+			if s.heardElsewhere(peers, op.Doc, op.Client) {
+				continue
+			}
+			log.Printf("Ending user %d's session in %q\n", op.Client, op.Doc)
+			s.handleOp([]Op{op})
+		}
+	}
+}
+
+// whether a peer heard from user within s.timeout, and if so take their
+// word for it
+func (s *Server) heardElsewhere(peers []string, doc string, user int) bool {
+	for _, p := range peers {
+		var reply HeardReply
+		if s.net.Call(p, "Server.Heard", HeardArg{Client: user, Doc: doc}, &reply, false) && reply.Err == "OK" && reply.Ago < s.timeout {
+			s.mu.Lock()
+			if d, ok := s.docs[doc]; ok {
+				d.hear(user)
+				d.heard[user] = time.Now().Add(-reply.Ago)
+			}
+			s.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+package gopad
+
+// Simulated network for tests.
+//
+// Every address gets an in-process rpc.Server, so calls still go through
+// gob like real ones.  The SimNet decides from a seeded RNG whether each
+// request or reply is lost, whether a request is delivered twice and how
+// long each leg takes; random delays reorder concurrent messages.
+// Addresses can also be split into partitions.  Dial makes connections
+// for a ConnPool instead, which a partition breaks.
+//
+// Each link, from one address to another, draws from its own RNG seeded
+// from the seed and the link, so the n-th message on a link meets the
+// same fate in every run with that seed.  Which message is n-th still
+// depends on how goroutines get scheduled, so a run repeats its faults
+// but not its exact schedule.  Tests make up for that in numbers.
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const simTimeout = 500 * time.Millisecond
+
+var errUnreachable = errors.New("unreachable")
+
+type SimNet struct {
+	mu       sync.Mutex
+	seed     int64
+	rngs     map[link]*rand.Rand
+	servers  map[string]*rpc.Server
+	clients  map[string]*rpc.Client // in-memory connection to each address
+	conns    []net.Conn
+	dialed   map[link][]net.Conn // by Dial, closed when a partition splits them
+	group    map[string]int      // partition of each address, unlisted reach everyone
+	drop     float64             // chance a request or a reply is lost
+	dup      float64             // chance a request is delivered twice
+	maxDelay time.Duration       // each leg takes up to this long
+	closed   bool
+}
+
+type link struct {
+	from, to string
+}
+
+type simEndpoint struct {
+	sn   *SimNet
+	from string
+}
+
+func NewSimNet(seed int64) *SimNet {
+	return &SimNet{
+		seed:    seed,
+		rngs:    make(map[link]*rand.Rand),
+		servers: make(map[string]*rpc.Server),
+		clients: make(map[string]*rpc.Client),
+		dialed:  make(map[link][]net.Conn),
+	}
+}
+
+// SetFaults sets how unreliable the network is.
+func (sn *SimNet) SetFaults(drop float64, dup float64, maxDelay time.Duration) {
+	sn.mu.Lock()
+	sn.drop = drop
+	sn.dup = dup
+	sn.maxDelay = maxDelay
+	sn.mu.Unlock()
+}
+
+// Partition splits the network so addresses in different groups can't
+// reach each other.  Addresses in no group still reach everyone.
+func (sn *SimNet) Partition(groups ...[]string) {
+	sn.mu.Lock()
+	sn.group = make(map[string]int)
+	for i, g := range groups {
+		for _, addr := range g {
+			sn.group[addr] = i
+		}
+	}
+	for l, cs := range sn.dialed {
+		if !sn.reachable(l.from, l.to) {
+			for _, c := range cs {
+				c.Close()
+			}
+			delete(sn.dialed, l)
+		}
+	}
+	sn.mu.Unlock()
+}
+
+// Heal undoes Partition.
+func (sn *SimNet) Heal() {
+	sn.mu.Lock()
+	sn.group = nil
+	sn.mu.Unlock()
+}
+
+// Close fails every call from now on.
+func (sn *SimNet) Close() {
+	sn.mu.Lock()
+	sn.closed = true
+	for _, c := range sn.conns {
+		c.Close()
+	}
+	for _, cs := range sn.dialed {
+		for _, c := range cs {
+			c.Close()
+		}
+	}
+	sn.mu.Unlock()
+}
+
+// Endpoint returns a Transport that makes calls from addr.
+func (sn *SimNet) Endpoint(addr string) Transport {
+	return &simEndpoint{sn, addr}
+}
+
+// AddServer serves s and its paxos peer at addr and makes them use the
+// SimNet.  Must be called before s.Run.
+func (sn *SimNet) AddServer(addr string, s *Server) {
+	rpcs := rpc.NewServer()
+	s.register(rpcs)
+	s.SetTransport(sn.Endpoint(addr))
+	sn.serve(addr, rpcs)
+}
+
+// AddPaxos serves px at addr and makes it use the SimNet.
+func (sn *SimNet) AddPaxos(addr string, px *Paxos) {
+	rpcs := rpc.NewServer()
+	rpcs.Register(px)
+	px.SetTransport(sn.Endpoint(addr))
+	sn.serve(addr, rpcs)
+}
+
+// AddService serves rcvr's methods at addr, like rpc.Register.
+func (sn *SimNet) AddService(addr string, rcvr interface{}) {
+	rpcs := rpc.NewServer()
+	rpcs.Register(rcvr)
+	sn.serve(addr, rpcs)
+}
+
+func (sn *SimNet) serve(addr string, rpcs *rpc.Server) {
+	c1, c2 := net.Pipe()
+	go rpcs.ServeConn(c1)
+
+	sn.mu.Lock()
+	sn.servers[addr] = rpcs
+	sn.clients[addr] = rpc.NewClient(c2)
+	sn.conns = append(sn.conns, c1, c2)
+	sn.mu.Unlock()
+}
+
+// Dial returns a dial function for a ConnPool at addr that connects
+// over the SimNet.  Messages on its connections aren't lost or delayed,
+// but a partition between the two ends closes them.
+func (sn *SimNet) Dial(addr string) func(string, time.Duration) (net.Conn, error) {
+	return func(to string, timeout time.Duration) (net.Conn, error) {
+		sn.mu.Lock()
+		defer sn.mu.Unlock()
+		rpcs, ok := sn.servers[to]
+		if !ok || !sn.reachable(addr, to) {
+			return nil, errUnreachable
+		}
+		c1, c2 := net.Pipe()
+		go rpcs.ServeConn(c1)
+		l := link{addr, to}
+		sn.dialed[l] = append(sn.dialed[l], c1, c2)
+		return c2, nil
+	}
+}
+
+// must hold sn.mu
+func (sn *SimNet) reachable(from string, to string) bool {
+	if sn.closed {
+		return false
+	}
+	g1, ok1 := sn.group[from]
+	g2, ok2 := sn.group[to]
+	return !ok1 || !ok2 || g1 == g2
+}
+
+// the RNG for messages from one address to another.  must hold sn.mu
+func (sn *SimNet) rand(from string, to string) *rand.Rand {
+	l := link{from, to}
+	rng, ok := sn.rngs[l]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(from + "\x00" + to))
+		rng = rand.New(rand.NewSource(sn.seed ^ int64(h.Sum64())))
+		sn.rngs[l] = rng
+	}
+	return rng
+}
+
+// must hold sn.mu
+func (sn *SimNet) delay(rng *rand.Rand) time.Duration {
+	if sn.maxDelay <= 0 {
+		return 0
+	}
+	return time.Duration(rng.Int63n(int64(sn.maxDelay)))
+}
+
+func (e *simEndpoint) Call(srv string, rpcname string, args interface{}, reply interface{}, verbose bool) bool {
+	sn := e.sn
+
+	sn.mu.Lock()
+	c, ok := sn.clients[srv]
+	ok = ok && sn.reachable(e.from, srv)
+	rng := sn.rand(e.from, srv)
+	lostReq := rng.Float64() < sn.drop
+	lostReply := rng.Float64() < sn.drop
+	twice := rng.Float64() < sn.dup
+	there, back := sn.delay(rng), sn.delay(rng)
+	sn.mu.Unlock()
+
+	time.Sleep(there)
+	if !ok || lostReq {
+		return false
+	}
+
+	if twice {
+		// nobody hears the copy's reply
+		extra := reflect.New(reflect.TypeOf(reply).Elem())
+		go c.Call(rpcname, args, extra.Interface())
+	}
+
+	// like conn.go, a reply that comes too late can't touch ours
+	tmp := reflect.New(reflect.TypeOf(reply).Elem())
+	timer := time.NewTimer(simTimeout)
+	defer timer.Stop()
+
+	rc := c.Go(rpcname, args, tmp.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-rc.Done:
+	case <-timer.C:
+		return false
+	}
+	if rc.Error != nil {
+		return false
+	}
+
+	time.Sleep(back)
+	sn.mu.Lock()
+	ok = sn.reachable(srv, e.from)
+	sn.mu.Unlock()
+	if !ok || lostReply {
+		return false
+	}
+
+	reflect.ValueOf(reply).Elem().Set(tmp.Elem())
+	return true
+}
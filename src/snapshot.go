@@ -0,0 +1,358 @@
+package gopad
+
+// Point-in-time snapshots of the server state.
+//
+// A snapshot covers every paxos instance below Seq.  The server never
+// tells paxos it is Done with an instance that is not covered by its
+// latest snapshot, so a replica that installs a peer's snapshot can
+// always pick up from snap.Seq with ordinary paxos agreement.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	snapshotEvery    = 64               // instances between snapshots
+	snapshotInterval = 10 * time.Second // or this long, if anything changed
+	snapshotChunk    = 64 * 1024        // bytes per transfer RPC
+)
+
+var errBadSnapshot = errors.New("snapshot: checksum mismatch")
+
+// everything the server derives from the paxos log
+type snapshotState struct {
+	Docs     map[string]docState
+	ViewSeqs []ViewSeq
+	Configs  []Config
+
+	// the main document, in snapshots from before there were others
+	Doc          []byte
+	CommitLog    []Op
+	UserViews    map[int]uint32
+	CommitPoint  uint32
+	DiscardPoint uint32
+	CrdtLog      []Op
+}
+
+type docState struct {
+	Doc          []byte
+	CommitLog    []Op
+	UserViews    map[int]uint32
+	CommitPoint  uint32
+	DiscardPoint uint32
+	CrdtLog      []Op
+	Created      int
+}
+
+type snapshot struct {
+	Seq  int // first paxos instance not reflected in Data
+	Sum  [sha256.Size]byte
+	Data []byte // gob encoded snapshotState
+}
+
+func (s *Server) snapshotPath() string {
+	return filepath.Join(s.dir, fmt.Sprintf("snapshot-%d.snap", s.port))
+}
+
+// take a snapshot of the current state.  must hold s.mu
+func (s *Server) takeSnapshot() error {
+	docs := make(map[string]docState)
+	for name, d := range s.docs {
+		buf, err := docToBytes(&d.doc)
+		if err != nil {
+			return err
+		}
+		docs[name] = docState{
+			Doc:          buf,
+			CommitLog:    d.CommitLog,
+			UserViews:    d.UserViews,
+			CommitPoint:  d.CommitPoint,
+			DiscardPoint: d.DiscardPoint,
+			CrdtLog:      d.CrdtLog,
+			Created:      d.Created,
+		}
+	}
+
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(snapshotState{
+		Docs:     docs,
+		ViewSeqs: s.ViewSeqs,
+		Configs:  s.Configs,
+	})
+	if err != nil {
+		return err
+	}
+
+	snap := &snapshot{
+		Seq:  s.QuerySeq,
+		Sum:  sha256.Sum256(b.Bytes()),
+		Data: b.Bytes(),
+	}
+	if err := s.saveSnapshot(snap); err != nil {
+		return err
+	}
+
+	s.snap = snap
+	s.snapTime = time.Now()
+	s.crdtSnapped = s.crdtApplied
+	return nil
+}
+
+// write a snapshot to disk, if persisting
+func (s *Server) saveSnapshot(snap *snapshot) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(snap); err != nil {
+		return err
+	}
+	return writeFileSync(s.snapshotPath(), b.Bytes())
+}
+
+// snapshot if enough has happened since the last one.  must hold s.mu
+func (s *Server) maybeSnapshot() {
+	n := s.QuerySeq - s.snap.Seq
+	if n >= snapshotEvery || (n > 0 && time.Since(s.snapTime) > snapshotInterval) {
+		if err := s.takeSnapshot(); err != nil {
+			log.Println("Couldn't take snapshot", err)
+		}
+	}
+}
+
+func decodeSnapshot(snap *snapshot) (snapshotState, error) {
+	var st snapshotState
+	if sha256.Sum256(snap.Data) != snap.Sum {
+		return st, errBadSnapshot
+	}
+	err := gob.NewDecoder(bytes.NewReader(snap.Data)).Decode(&st)
+	return st, err
+}
+
+// replace the server state with a snapshot.  must hold s.mu
+func (s *Server) installSnapshot(snap *snapshot) error {
+	st, err := decodeSnapshot(snap)
+	if err != nil {
+		return err
+	}
+
+	if st.Docs == nil {
+		st.Docs = map[string]docState{MainDoc: docState{
+			Doc:          st.Doc,
+			CommitLog:    st.CommitLog,
+			UserViews:    st.UserViews,
+			CommitPoint:  st.CommitPoint,
+			DiscardPoint: st.DiscardPoint,
+			CrdtLog:      st.CrdtLog,
+			Created:      -1,
+		}}
+	}
+
+	docs := make(map[string]*document)
+	for name, ds := range st.Docs {
+		d := &document{
+			CommitLog:    ds.CommitLog,
+			UserViews:    ds.UserViews,
+			CommitPoint:  ds.CommitPoint,
+			DiscardPoint: ds.DiscardPoint,
+			CrdtLog:      ds.CrdtLog,
+			Created:      ds.Created,
+			committed:    make(chan struct{}),
+		}
+		if err := bytesToDoc(ds.Doc, &d.doc); err != nil {
+			return err
+		}
+		if d.UserViews == nil {
+			d.UserViews = make(map[int]uint32)
+		}
+		docs[name] = d
+	}
+
+	// let anyone waiting on the old ones look again
+	for _, d := range s.docs {
+		d.wake()
+	}
+	s.docs = docs
+	s.ViewSeqs = st.ViewSeqs
+	if len(st.Configs) > 0 {
+		s.Configs = st.Configs
+	}
+
+	s.QuerySeq = snap.Seq
+	s.wakeApplied()
+	if s.StartSeq < s.QuerySeq {
+		s.StartSeq = s.QuerySeq
+	}
+	s.snap = snap
+	s.snapTime = time.Now()
+	s.crdtSnapped = s.crdtApplied
+
+	s.px.SetConfigs(s.Configs)
+	s.px.SetApplied(s.QuerySeq)
+	return nil
+}
+
+// load the snapshot on disk, returns false if there was none
+func (s *Server) loadSnapshot() bool {
+	if s.dir == "" {
+		return false
+	}
+
+	data, err := os.ReadFile(s.snapshotPath())
+	if err != nil {
+		return false
+	}
+
+	var snap snapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snap); err != nil {
+		log.Println("Bad snapshot file", err)
+		return false
+	}
+	if err := s.installSnapshot(&snap); err != nil {
+		log.Println("Bad snapshot file", err)
+		return false
+	}
+	return true
+}
+
+// describe the latest snapshot
+func (s *Server) SnapshotInfo(arg SnapshotArg, reply *SnapshotReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reboot || s.snap == nil {
+		reply.Err = "REBOOTING"
+		return nil
+	}
+
+	reply.Seq = s.snap.Seq
+	reply.Size = len(s.snap.Data)
+	reply.Sum = s.snap.Sum
+	reply.Tip = s.QuerySeq
+	reply.Err = "OK"
+	return nil
+}
+
+// send one chunk of the latest snapshot
+func (s *Server) SnapshotChunk(arg ChunkArg, reply *ChunkReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.snap == nil || s.snap.Seq != arg.Seq {
+		// moved on to a newer snapshot
+		reply.Err = "Stale"
+		return nil
+	}
+
+	if arg.Offset < 0 || arg.Offset > len(s.snap.Data) {
+		reply.Err = "Range"
+		return nil
+	}
+
+	end := arg.Offset + snapshotChunk
+	if end > len(s.snap.Data) {
+		end = len(s.snap.Data)
+	}
+
+	// copy so the reply doesn't alias the snapshot
+	reply.Data = append([]byte(nil), s.snap.Data[arg.Offset:end]...)
+	reply.Err = "OK"
+	return nil
+}
+
+// pull one whole snapshot from srv
+func (s *Server) fetchSnapshot(srv string) (*snapshot, int, bool) {
+	var info SnapshotReply
+	ok := s.net.Call(srv, "Server.SnapshotInfo", SnapshotArg{}, &info, false)
+	if !ok || info.Err != "OK" {
+		return nil, 0, false
+	}
+
+	data := make([]byte, 0, info.Size)
+	for len(data) < info.Size {
+		var reply ChunkReply
+		ok := s.net.Call(srv, "Server.SnapshotChunk", ChunkArg{Seq: info.Seq, Offset: len(data)}, &reply, false)
+		if !ok || reply.Err != "OK" || len(reply.Data) == 0 {
+			return nil, 0, false
+		}
+		data = append(data, reply.Data...)
+	}
+
+	if sha256.Sum256(data) != info.Sum {
+		log.Println("Snapshot checksum mismatch from", srv)
+		return nil, 0, false
+	}
+
+	return &snapshot{Seq: info.Seq, Sum: info.Sum, Data: data}, info.Tip, true
+}
+
+// bring this replica up to date from a peer's snapshot.  a joining
+// replica waits for one taken after it was added.
+func (s *Server) Recover(servers []string) {
+	for {
+		peers := append([]string(nil), servers...)
+		s.mu.Lock()
+		for _, c := range s.Configs {
+			peers = append(peers, c.members()...)
+		}
+		s.mu.Unlock()
+
+		for _, srv := range peers {
+			if srv == s.addr {
+				continue
+			}
+
+			snap, tip, ok := s.fetchSnapshot(srv)
+			if !ok {
+				continue
+			}
+
+			if s.joining {
+				st, err := decodeSnapshot(snap)
+				if err != nil || len(st.Configs) == 0 {
+					continue
+				}
+				if _, ok := st.Configs[len(st.Configs)-1].Peers[s.addr]; !ok {
+					continue
+				}
+			}
+
+			s.mu.Lock()
+			err := s.installSnapshot(snap)
+			if err == nil {
+				err = s.saveSnapshot(snap)
+			}
+			s.mu.Unlock()
+			if err != nil {
+				log.Println("Couldn't install snapshot", err)
+				continue
+			}
+
+			log.Printf("Installed snapshot at %d from %s\n", snap.Seq, srv)
+
+			// everything before the snapshot is covered
+			if snap.Seq > 0 {
+				s.px.Done(snap.Seq - 1)
+			}
+			if s.catchupSeq < tip {
+				s.catchupSeq = tip
+			}
+			s.mu.Lock()
+			if s.replayTo < tip {
+				s.replayTo = tip
+			}
+			s.mu.Unlock()
+			return
+		}
+		time.Sleep(updateDelay)
+	}
+}
@@ -0,0 +1,217 @@
+package term
+
+// Colors for users on the screen.
+//
+// Users get colors numbered from 1 up (Doc.Colors), as many as there are
+// users, so the palette is made up as needed instead of listed.  Each one
+// gets the next hue around the color wheel, turned by the golden angle so
+// hues stay evenly spread however many there are, in one of four shades.
+// Truecolor terminals get exactly that, so users look apart long after
+// any fixed set of colors would run out.  With 256 colors each one gets
+// the closest cell of the 6x6x6 cube that no color before it got, so no
+// two users look the same until the cube runs out; the shades make the
+// cube's few hues go further.  With only the 8 basic colors, users share
+// the 6 that aren't black or white.  Color 0 is text nobody typed, like a
+// file the server started with.
+
+import (
+	"github.com/nsf/termbox-go"
+	"math"
+	"os"
+	"strings"
+)
+
+const goldenAngle = 137.508 // degrees
+
+// saturation of text, and saturation and value of cursors, by shade
+var (
+	textShades   = []float64{1, 0.6, 0.8, 0.4}
+	cursorShades = [][2]float64{{1, 0.6}, {1, 0.4}, {0.7, 0.8}, {0.6, 0.6}}
+)
+
+// the 6 basic colors for users on 8 color terminals
+var basicColors = []termbox.Attribute{
+	termbox.ColorRed,
+	termbox.ColorGreen,
+	termbox.ColorYellow,
+	termbox.ColorBlue,
+	termbox.ColorMagenta,
+	termbox.ColorCyan,
+}
+
+// Palette turns user colors into termbox attributes for one output mode.
+type Palette struct {
+	mode    termbox.OutputMode
+	texts   *cells
+	cursors *cells
+}
+
+// NewPalette makes the palette for termbox.OutputNormal, Output256 or
+// OutputRGB.
+func NewPalette(mode termbox.OutputMode) Palette {
+	return Palette{mode: mode, texts: newCells(), cursors: newCells()}
+}
+
+// the palette for the terminal we're on, going by $TERM and $COLORTERM
+func termPalette() Palette {
+	term := os.Getenv("TERM")
+	color := os.Getenv("COLORTERM")
+	if color == "truecolor" || color == "24bit" {
+		return NewPalette(termbox.OutputRGB)
+	}
+	if strings.Contains(term, "256color") {
+		return NewPalette(termbox.Output256)
+	}
+	return NewPalette(termbox.OutputNormal)
+}
+
+// Text is what color typed looks like.
+func (p Palette) Text(color int) termbox.Attribute {
+	switch p.mode {
+	case termbox.OutputRGB:
+		if color == 0 {
+			return termbox.RGBToAttribute(255, 255, 255)
+		}
+		return trueColor(hsv(hue(color), textShades[(color-1)%len(textShades)], 1))
+	case termbox.Output256:
+		if color == 0 {
+			return 16
+		}
+		return p.texts.get(color, func(c int) [3]int {
+			return cube(hsv(hue(c), textShades[(c-1)%len(textShades)], 1))
+		})
+	}
+	if color == 0 {
+		return termbox.ColorWhite
+	}
+	return basicColors[(color-1)%len(basicColors)]
+}
+
+// Cursor is what goes behind color's cursor and selection, darker so
+// text shows on it.
+func (p Palette) Cursor(color int) termbox.Attribute {
+	switch p.mode {
+	case termbox.OutputRGB:
+		if color == 0 {
+			return termbox.RGBToAttribute(208, 208, 208)
+		}
+		sv := cursorShades[(color-1)%len(cursorShades)]
+		return trueColor(hsv(hue(color), sv[0], sv[1]))
+	case termbox.Output256:
+		if color == 0 {
+			return 253
+		}
+		return p.cursors.get(color, func(c int) [3]int {
+			sv := cursorShades[(c-1)%len(cursorShades)]
+			return cube(hsv(hue(c), sv[0], sv[1]))
+		})
+	}
+	if color == 0 {
+		return termbox.ColorWhite
+	}
+	return basicColors[(color-1)%len(basicColors)]
+}
+
+// Temp is the color of our edits the replicas haven't committed.
+func (p Palette) Temp() termbox.Attribute {
+	switch p.mode {
+	case termbox.OutputRGB:
+		return termbox.RGBToAttribute(188, 188, 188)
+	case termbox.Output256:
+		return 251
+	}
+	return termbox.ColorWhite
+}
+
+// hue of color, in degrees
+func hue(color int) float64 {
+	return math.Mod(float64(color-1)*goldenAngle, 360)
+}
+
+// the cube cells colors got, handed out in order of color so every
+// client that knows the same colors draws them the same
+type cells struct {
+	of   []termbox.Attribute // by color, from 1
+	used map[termbox.Attribute]bool
+}
+
+func newCells() *cells {
+	return &cells{used: make(map[termbox.Attribute]bool)}
+}
+
+// the cell of color, where want is where each color would go if it were free
+func (cs *cells) get(color int, want func(int) [3]int) termbox.Attribute {
+	for len(cs.of) < color {
+		cs.of = append(cs.of, cs.take(want(len(cs.of)+1)))
+	}
+	return cs.of[color-1]
+}
+
+// the free cell closest to levels.  grays are left for text nobody
+// typed and our own edits.  once there's none left, colors repeat
+func (cs *cells) take(levels [3]int) termbox.Attribute {
+	best, bestd := cell(levels), -1
+	for r := 0; r < 6; r++ {
+		for g := 0; g < 6; g++ {
+			for b := 0; b < 6; b++ {
+				a := cell([3]int{r, g, b})
+				if cs.used[a] || (r == g && g == b) {
+					continue
+				}
+				dr, dg, db := r-levels[0], g-levels[1], b-levels[2]
+				if d := dr*dr + dg*dg + db*db; bestd < 0 || d < bestd {
+					best, bestd = a, d
+				}
+			}
+		}
+	}
+	cs.used[best] = true
+	return best
+}
+
+// the attribute for red, green and blue levels of the cube, each 0 to 5
+func cell(levels [3]int) termbox.Attribute {
+	// attributes are the color number plus one
+	return termbox.Attribute(16 + 36*levels[0] + 6*levels[1] + levels[2] + 1)
+}
+
+// red, green and blue, each from 0 to 1, for hue h in degrees,
+// saturation s and value v
+func hsv(h, s, v float64) [3]float64 {
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g = c, x
+	case h < 120:
+		r, g = x, c
+	case h < 180:
+		g, b = c, x
+	case h < 240:
+		g, b = x, c
+	case h < 300:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := v - c
+	return [3]float64{r + m, g + m, b + m}
+}
+
+// the closest levels in the 256 color cube
+func cube(rgb [3]float64) [3]int {
+	var levels [3]int
+	for i, f := range rgb {
+		levels[i] = int(math.Round(f * 5))
+	}
+	return levels
+}
+
+// the attribute for rgb on a truecolor terminal
+func trueColor(rgb [3]float64) termbox.Attribute {
+	level := func(f float64) uint8 {
+		return uint8(math.Round(f * 255))
+	}
+	return termbox.RGBToAttribute(level(rgb[0]), level(rgb[1]), level(rgb[2]))
+}
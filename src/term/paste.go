@@ -0,0 +1,145 @@
+package term
+
+// Pasting and importing files.
+//
+// We turn on the terminal's bracketed paste, so pasted text comes in
+// between pasteStart and pasteEnd.  It goes out as one InsertText op
+// instead of an op per key, and so does a file imported with Ctrl-O.
+// termbox doesn't know these sequences, or the ones for Ctrl with the
+// arrows, and hands them to us as Esc followed by plain keys, so we
+// watch for them after every Esc.
+
+import (
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	pasteOn    = "\x1b[?2004h"
+	pasteOff   = "\x1b[?2004l"
+	pasteStart = "\x1b[200~"
+	pasteEnd   = "\x1b[201~"
+
+	escDelay = 25 * time.Millisecond // the rest of a sequence comes this soon after Esc
+)
+
+// the user's key presses, read ahead so we can look for pastes
+type input struct {
+	events chan termbox.Event
+	back   []termbox.Event // read ahead but not used
+}
+
+func newInput() *input {
+	in := &input{events: make(chan termbox.Event, 256)}
+	go func() {
+		for {
+			in.events <- termbox.PollEvent()
+		}
+	}()
+	return in
+}
+
+// the next event, false if none came within wait.  0 waits forever
+func (in *input) next(wait time.Duration) (termbox.Event, bool) {
+	if len(in.back) > 0 {
+		ev := in.back[0]
+		in.back = in.back[1:]
+		return ev, true
+	}
+	if wait == 0 {
+		return <-in.events, true
+	}
+	select {
+	case ev := <-in.events:
+		return ev, true
+	case <-time.After(wait):
+		return termbox.Event{}, false
+	}
+}
+
+// which of seqs the events after an Esc spell out the rest of.  "" for
+// none, and then they're left to read
+func (in *input) sequence(seqs []string) string {
+	var read []termbox.Event
+	typed := "\x1b"
+	for {
+		maybe := false
+		for _, seq := range seqs {
+			if seq == typed {
+				return seq
+			}
+			maybe = maybe || strings.HasPrefix(seq, typed)
+		}
+		if !maybe {
+			break
+		}
+
+		ev, ok := in.next(escDelay)
+		if !ok {
+			break
+		}
+		read = append(read, ev)
+		r := keyRune(ev)
+		if r == 0 {
+			break
+		}
+		typed += string(r)
+	}
+	in.back = append(read, in.back...)
+	return ""
+}
+
+// the text of a paste, after its pasteStart
+func (in *input) paste() string {
+	var sb strings.Builder
+	for {
+		ev, _ := in.next(0)
+		if ev.Type == termbox.EventKey && ev.Key == termbox.KeyEsc && in.sequence([]string{pasteEnd}) != "" {
+			return sb.String()
+		}
+		if r := keyRune(ev); r != 0 {
+			sb.WriteRune(r)
+		}
+	}
+}
+
+// the rune a key event types, 0 for none
+func keyRune(ev termbox.Event) rune {
+	if ev.Type != termbox.EventKey {
+		return 0
+	}
+	if ev.Ch != 0 {
+		return ev.Ch
+	}
+	switch ev.Key {
+	case termbox.KeyEsc:
+		return '\x1b'
+	case termbox.KeySpace:
+		return ' '
+	case termbox.KeyTab:
+		return '\t'
+	case termbox.KeyEnter, termbox.KeyCtrlJ:
+		return '\n'
+	}
+	return 0
+}
+
+// ask for a file and put what's in it in at the cursor
+func (e *editor) importFile() {
+	name, ok := e.editorPrompt("Import file: ", "")
+	if !ok || name == "" {
+		e.setStatus("")
+		return
+	}
+
+	text, err := os.ReadFile(name)
+	if err != nil {
+		e.setStatus(fmt.Sprintf("Couldn't import %s", name))
+		return
+	}
+	e.c.InsertText(strings.Replace(string(text), "\r\n", "\n", -1))
+	e.setStatus(fmt.Sprintf("Imported %s", name))
+}
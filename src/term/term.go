@@ -0,0 +1,502 @@
+package term
+
+// Package term edits a document on the terminal, on top of a gopad.Client.
+//
+// Most of these are based on a version of antirez's kilo given by
+// https://viewsourcecode.org/snaptoken/kilo/ as well as the editbox demo of termbox-go
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"fmt"
+	"github.com/mattn/go-runewidth"
+	"github.com/nsf/termbox-go"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const rosterDelay = 10 * time.Second // redraw this often for idle times
+
+// widths for drawing, going by the locale like the terminal does
+var termWidths = runewidth.NewCondition()
+
+// motions for the keys that move the cursor
+var keyMotions = map[termbox.Key]int{
+	termbox.KeyArrowLeft:  gopad.MoveLeft,
+	termbox.KeyArrowRight: gopad.MoveRight,
+	termbox.KeyArrowUp:    gopad.MoveUp,
+	termbox.KeyArrowDown:  gopad.MoveDown,
+	termbox.KeyHome:       gopad.MoveLineStart,
+	termbox.KeyEnd:        gopad.MoveLineEnd,
+}
+
+// and for keys termbox doesn't know, by what the terminal sends
+var seqMotions = map[string]int{
+	"\x1b[1;5D": gopad.MoveWordLeft,  // Ctrl-Left
+	"\x1b[1;5C": gopad.MoveWordRight, // Ctrl-Right
+	"\x1b[1;5H": gopad.MoveDocStart,  // Ctrl-Home
+	"\x1b[1;5F": gopad.MoveDocEnd,    // Ctrl-End
+}
+
+type editor struct {
+	c          *gopad.Client
+	id         int
+	doc        gopad.Doc // what we're drawing
+	roster     []gopad.Presence
+	pal        Palette
+	screenrows int
+	screencols int
+	rowoff     int
+	coloff     int
+	mu         sync.Mutex
+	status     string
+	seen       string // last c.Status() we showed
+
+	tempRUsers map[int]int // renderX for each tempPos
+	in         *input
+}
+
+// StartClient connects c and edits its document on the terminal.
+func StartClient(c *gopad.Client, testing bool) {
+	if err := c.Connect(); err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	e := &editor{c: c, id: c.ID(), tempRUsers: make(map[int]int), pal: termPalette()}
+
+	err := termbox.Init()
+	if err != nil {
+		panic(err)
+	}
+	defer termbox.Close()
+	if !testing {
+		termbox.SetInputMode(termbox.InputEsc)
+		termbox.SetOutputMode(e.pal.mode)
+		fmt.Print(pasteOn)
+		defer fmt.Print(pasteOff)
+
+		// redraw whenever others edit, and now and then for idle times
+		go func() {
+			for {
+				select {
+				case <-c.Changed():
+				case <-time.After(rosterDelay):
+				}
+				e.refreshScreen()
+			}
+		}()
+	}
+
+	e.initEditor()
+	e.in = newInput()
+
+	// what to look for after an Esc
+	seqs := []string{pasteStart}
+	for seq := range seqMotions {
+		seqs = append(seqs, seq)
+	}
+
+mainloop:
+	for {
+		e.refreshScreen()
+		ev, _ := e.in.next(0)
+		e.setStatus("")
+
+		switch ev.Type {
+		case termbox.EventKey:
+			if ev.Key == termbox.KeyEsc {
+				if seq := e.in.sequence(seqs); seq == pasteStart {
+					c.InsertText(e.in.paste())
+					continue
+				} else if seq != "" {
+					c.Move(seqMotions[seq])
+					continue
+				}
+			}
+			switch ev.Key {
+			case termbox.KeyCtrlC:
+				break mainloop
+			case termbox.KeyCtrlS:
+				// the replicas save what's committed
+				e.setStatus("Saving...")
+				go e.save()
+			case termbox.KeyCtrlO:
+				e.importFile()
+			case termbox.KeyArrowLeft,
+				termbox.KeyArrowRight,
+				termbox.KeyArrowUp,
+				termbox.KeyArrowDown,
+				termbox.KeyHome,
+				termbox.KeyEnd:
+				c.Move(keyMotions[ev.Key])
+			// case termbox.KeyPgup, termbox.KeyPgdn:
+			// 	for times := gp.screenrows; times > 0; times-- {
+			// 		var x termbox.Key
+			// 		if ev.Key == termbox.KeyPgdn {
+			// 			x = termbox.KeyArrowDown
+			// 		} else {
+			// 			x = termbox.KeyArrowUp
+			// 		}
+			// 		gp.editorMoveCursor(x, &gp.pos, true, true)
+			// 	}
+			case termbox.KeyCtrlZ:
+				if !c.Undo() {
+					e.setStatus("Nothing to undo")
+				}
+			case termbox.KeyCtrlY:
+				if !c.Redo() {
+					e.setStatus("Nothing to redo")
+				}
+			case termbox.KeyEsc:
+				c.SetMark(-1)
+			case termbox.KeyBackspace, termbox.KeyBackspace2:
+				c.Backspace()
+			case termbox.KeyDelete, termbox.KeyCtrlD:
+				c.Delete()
+			case termbox.KeyTab:
+				if !c.Indent(false) {
+					c.Type('\t')
+				}
+			case termbox.KeyCtrlU:
+				c.Indent(true)
+			case termbox.KeySpace:
+				c.Type(' ')
+			case termbox.KeyEnter:
+				c.Type('\n')
+			default:
+				if ev.Ch != 0 {
+					c.Type(ev.Ch)
+				} else if ev.Key == termbox.KeyCtrlSpace {
+					// shares its code with plain runes
+					c.ToggleMark()
+				}
+			}
+		case termbox.EventError:
+			panic(ev.Err)
+		}
+	}
+}
+
+func (e *editor) setStatus(status string) {
+	e.mu.Lock()
+	e.status = status
+	e.mu.Unlock()
+}
+
+// ask the replicas to save the document
+func (e *editor) save() {
+	if err := e.c.Save(); err != nil {
+		e.setStatus("Couldn't save")
+	} else {
+		e.setStatus("Saved!")
+	}
+	e.refreshScreen()
+}
+
+func (e *editor) editorPrompt(msg, file string) (string, bool) {
+	e.setStatus(msg)
+
+	for {
+		e.refreshScreen()
+
+		switch ev, _ := e.in.next(0); ev.Type {
+		case termbox.EventKey:
+			switch ev.Key {
+			case termbox.KeyBackspace, termbox.KeyBackspace2:
+				if file != "" {
+					// a whole rune, not its last byte
+					_, n := utf8.DecodeLastRuneInString(file)
+					file = file[:len(file)-n]
+				}
+				e.setStatus(msg + file)
+			case termbox.KeyEsc:
+				return "", false
+			case termbox.KeyEnter:
+				return file, true
+			default:
+				if ev.Ch != 0 {
+					file += string(ev.Ch)
+					e.setStatus(msg + file)
+				}
+			}
+		case termbox.EventError:
+			panic(ev.Err)
+		}
+	}
+}
+
+/*** output ***/
+
+func (e *editor) editorScroll() {
+
+	for id, pos := range e.doc.UserPos {
+		e.tempRUsers[id] = 0
+		if pos.Y < len(e.doc.Rows) {
+			e.tempRUsers[id] = cxToRx(e.doc.Rows[pos.Y].Chars, pos.X)
+		}
+	}
+
+	pos := e.doc.UserPos[e.id]
+	// reposition up
+
+	if pos.Y < e.rowoff {
+		e.rowoff = pos.Y
+	}
+
+	// reposition down
+	if pos.Y >= e.rowoff+e.screenrows {
+		e.rowoff = pos.Y - e.screenrows + 1
+	}
+
+	if e.tempRUsers[e.id] < e.coloff {
+		e.coloff = e.tempRUsers[e.id]
+	}
+
+	if e.tempRUsers[e.id] >= e.coloff+e.screencols {
+		e.coloff = e.tempRUsers[e.id] - e.screencols + 1
+	}
+}
+
+// draw a row
+func (e *editor) drawRows() {
+	const coldef = termbox.ColorDefault
+
+	i := 0
+	for ; i < e.screenrows; i++ {
+		filerow := i + e.rowoff
+		if filerow < len(e.doc.Rows) {
+
+			erow := &e.doc.Rows[filerow]
+			row := render(erow.Chars, erow.Temp, erow.Author)
+			start := e.doc.Offset(gopad.Pos{Y: filerow})
+
+			// draw gutters
+			termbox.SetCell(0, i, '~', coldef, coldef)
+
+			if len(row.Chars) > 0 {
+				for k, s := range row.Chars {
+					if k >= e.coloff && s != 0 {
+						bg := termbox.ColorDefault
+
+						// draw selections
+						at := start + rxToCx(erow.Chars, k)
+						for user := range e.doc.Marks {
+							if lo, hi, ok := e.doc.Selection(user); ok && lo <= at && at < hi {
+								bg = e.pal.Cursor(e.doc.Colors[user])
+							}
+						}
+
+						// draw other cursors
+						for user, pos := range e.doc.UserPos {
+							if user != e.id {
+								if e.tempRUsers[user]-e.coloff == k && pos.Y == filerow {
+									bg = e.pal.Cursor(e.doc.Colors[user])
+								}
+							}
+						}
+
+						if row.Temp[k] {
+							// is temp char?
+							termbox.SetCell(k+1-e.coloff, i, s, e.pal.Temp(), bg)
+						} else {
+
+							// select color based on author
+							auth := row.Author[k]
+							color := e.pal.Text(auth)
+							termbox.SetCell(k+1-e.coloff, i, s, color, bg)
+						}
+						if k+1 > e.screencols {
+							break
+						}
+					}
+				}
+
+				end := len(erow.Chars)
+				endR := len(row.Chars)
+
+				// at endpoint?
+				if endR >= e.coloff && endR < e.coloff+e.screencols {
+					for user, pos := range e.doc.UserPos {
+						if user != e.id {
+							if pos.X == end && pos.Y == filerow {
+								termbox.SetCell(endR-e.coloff+1, i, ' ', 0, e.pal.Cursor(e.doc.Colors[user]))
+							}
+						}
+					}
+				}
+			} else if e.coloff == 0 {
+				// draw cursor on empty line
+				for user, pos := range e.doc.UserPos {
+					if user != e.id {
+						if pos.Y == filerow {
+							termbox.SetCell(1, i, ' ', 0, e.pal.Cursor(e.doc.Colors[user]))
+						}
+					}
+				}
+			}
+		} else {
+			termbox.SetCell(0, i, '~', coldef, coldef)
+		}
+	}
+}
+
+func (e *editor) editorDrawStatusBar() {
+	i := e.screenrows
+
+	bg := termbox.ColorWhite
+
+	if e.doc.Colors[e.id] != 0 {
+		bg = e.pal.Text(e.doc.Colors[e.id])
+	}
+	var j int
+
+	for _, c := range e.status {
+		termbox.SetCell(j, i, c, termbox.ColorBlack, bg)
+		j++
+	}
+
+	// draw status bar
+	for ; j < e.screencols+1; j++ {
+		termbox.SetCell(j, i, ' ', termbox.ColorBlack, bg)
+	}
+
+	saved := "not saved"
+	if e.doc.Saved != 0 {
+		saved = fmt.Sprintf("saved at view %d", e.doc.Saved)
+		if e.doc.Saved != e.doc.View {
+			saved += fmt.Sprintf(" of %d", e.doc.View)
+		}
+	}
+	x := e.screencols + 1 - textWidth(saved)
+	drawText(x, i, saved, termbox.ColorBlack, bg)
+
+	// who's here, right to left, as far as there's room
+	for k := len(e.roster) - 1; k >= 0; k-- {
+		p := e.roster[k]
+		who := fmt.Sprintf(" %s:%d", p.Name, p.Line+1)
+		if p.Idle >= time.Minute {
+			who += fmt.Sprintf(" (%dm)", int(p.Idle/time.Minute))
+		}
+		who += " "
+		x -= textWidth(who) + 1
+		if x <= textWidth(e.status) {
+			break
+		}
+		// a swatch of their cursor color
+		termbox.SetCell(x, i, ' ', 0, e.pal.Cursor(p.Color))
+		drawText(x+1, i, who, termbox.ColorBlack, bg)
+	}
+}
+
+// draw s from column x on row y, returns the column after it
+func drawText(x, y int, s string, fg, bg termbox.Attribute) int {
+	for _, r := range s {
+		termbox.SetCell(x, y, r, fg, bg)
+		x += runeWidth(r, x)
+	}
+	return x
+}
+
+// columns s takes up
+func textWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		w += runeWidth(r, w)
+	}
+	return w
+}
+
+// columns rune r takes up when it starts at column rx
+func runeWidth(r rune, rx int) int {
+	if r == '\t' {
+		return gopad.TABSTOP - rx%gopad.TABSTOP
+	}
+	return termWidths.RuneWidth(r)
+}
+
+// the column rune cx of chars starts at
+func cxToRx(chars []rune, cx int) int {
+	rx := 0
+	for j := 0; j < cx && j < len(chars); j++ {
+		rx += runeWidth(chars[j], rx)
+	}
+	return rx
+}
+
+// the rune of chars at column rx
+func rxToCx(chars []rune, rx int) int {
+	cur := 0
+	cx := 0
+	for ; cx < len(chars); cx++ {
+		cur += runeWidth(chars[cx], cur)
+		if cur > rx {
+			return cx
+		}
+	}
+	return cx
+}
+
+func (e *editor) refreshScreen() {
+	doc := e.c.Snapshot()
+	status := e.c.Status()
+	roster := e.c.Roster()
+
+	e.mu.Lock()
+	e.doc = doc
+	e.roster = roster
+	if status != e.seen {
+		// something happened to the connection
+		e.seen = status
+		e.status = status
+	}
+	const coldef = termbox.ColorDefault
+	termbox.Clear(coldef, coldef)
+	e.initEditor()
+
+	e.editorScroll()
+	e.drawRows()
+	e.editorDrawStatusBar()
+
+	termbox.SetCursor(e.tempRUsers[e.id]-e.coloff+1, e.doc.UserPos[e.id].Y-e.rowoff)
+	termbox.Flush()
+	e.mu.Unlock()
+}
+
+/*** init ***/
+
+func (e *editor) initEditor() {
+	e.screencols, e.screenrows = termbox.Size()
+	e.screenrows--
+	e.screencols--
+}
+
+// a row as it looks on screen, a rune for each column
+type screenRow struct {
+	Chars  []rune
+	Temp   []bool
+	Author []int
+}
+
+// how a row with these runes looks on screen.  tabs become spaces, the
+// second column of a wide rune is 0 and combining marks are left out
+func render(chars []rune, temp []bool, author []int) *screenRow {
+	row := screenRow{}
+
+	for i, r := range chars {
+		w := runeWidth(r, len(row.Chars))
+		for j := 0; j < w; j++ {
+			c := r
+			if r == '\t' {
+				c = ' '
+			} else if j > 0 {
+				c = 0
+			}
+			row.Chars = append(row.Chars, c)
+			row.Temp = append(row.Temp, temp[i])
+			row.Author = append(row.Author, author[i])
+		}
+	}
+	return &row
+}
@@ -0,0 +1,29 @@
+package gopad
+
+// Transport is how Paxos and Server talk to their peers.  The default is
+// the shared pool of TCP connections (conn.go); tests swap in a SimNet.
+type Transport interface {
+	// Call makes an RPC and returns whether a reply came back.
+	Call(srv string, rpcname string, args interface{}, reply interface{}, verbose bool) bool
+}
+
+// SetTransport changes how this peer reaches the others.  Must be called
+// before anything is started.
+func (px *Paxos) SetTransport(t Transport) {
+	px.mu.Lock()
+	px.net = t
+	px.mu.Unlock()
+}
+
+// SetTransport changes how this replica and its paxos peer reach the
+// others.  Must be called before Run or Start.
+func (s *Server) SetTransport(t Transport) {
+	s.net = t
+	s.px.SetTransport(t)
+}
+
+// SetTransport changes how this client reaches the replicas.  Must be
+// called before Connect.
+func (c *Client) SetTransport(t Transport) {
+	c.net = t
+}
@@ -0,0 +1,163 @@
+package gopad
+
+// Undo and redo.
+//
+// Users undo their own edits, newest first, with new ops that go through
+// the log like any other.  In ModeOrdered the inverse of an edit is
+// transformed past everything applied after it, ours and everyone
+// else's, so it still hits the rune it meant to.  In ModeCRDT runes have
+// IDs: undoing an insert deletes that rune, and undoing a delete puts the
+// rune back right after its tombstone.  Redo undoes an undo.
+
+const undoMax = 256 // key presses remembered
+
+// the edits that take e back
+func inverse(e Edit) []Edit {
+	switch e.Type {
+	case InsertAt:
+		e.Type = DeleteAt
+	case DeleteAt:
+		e.Type = InsertAt
+	case InsertText:
+		// a rune at a time, so redo can put them back one by one
+		var edits []Edit
+		for _, ch := range e.Text {
+			edits = append(edits, Edit{Type: DeleteAt, At: e.At, Data: ch, Client: e.Client})
+		}
+		return edits
+	}
+	return []Edit{e}
+}
+
+// the rune at offset at, '\n' at the end of a row
+func (doc *Doc) runeAt(at int) rune {
+	pos, ok := doc.posAt(at)
+	if !ok {
+		return 0
+	}
+	row := doc.Rows[pos.Y].Chars
+	if pos.X >= len(row) {
+		return '\n'
+	}
+	return row[pos.X]
+}
+
+// Undo returns the edits that take back client's op seq, as they apply
+// to doc now, to be made in order.  False if doc has forgotten the op or
+// there's nothing left of it to take back.
+func (doc *Doc) Undo(client int, seq uint32) ([]Edit, bool) {
+	// a Range op's edits are all together, take them back last first
+	var undo []Edit
+	last := -1
+	for i := len(doc.History) - 1; i >= 0; i-- {
+		p := doc.History[i]
+		if p.Client == client && p.Seq == seq {
+			undo = append(undo, inverse(p.Edit)...)
+			if last < 0 {
+				last = i
+			}
+		} else if last >= 0 {
+			break
+		}
+	}
+	if last < 0 {
+		return nil, false
+	}
+	// then past everything since
+	var since []Edit
+	for _, q := range doc.History[last+1:] {
+		since = append(since, q.Edit)
+	}
+	undo, _ = transformSeq(undo, since)
+
+	var edits []Edit
+	for _, e := range undo {
+		if e.Type == InsertAt || e.Type == DeleteAt {
+			edits = append(edits, e)
+		}
+	}
+	return edits, len(edits) > 0
+}
+
+// remember the ops a key press made, forgetting what was undone
+func (c *Client) remember(ops []Op) {
+	c.undos = append(c.undos, ops)
+	if len(c.undos) > undoMax {
+		c.undos = c.undos[1:]
+	}
+	c.redos = nil
+}
+
+// Undo takes back our last edit, false if there's nothing to undo.
+func (c *Client) Undo() bool {
+	var ok bool
+	c.edit(func() { ok = c.takeBackLast(&c.undos, &c.redos) })
+	return ok
+}
+
+// Redo makes the last edit we undid again, false if there's none.
+func (c *Client) Redo() bool {
+	var ok bool
+	c.edit(func() { ok = c.takeBackLast(&c.redos, &c.undos) })
+	return ok
+}
+
+// take back the last key press in from, pushing what that took onto to
+func (c *Client) takeBackLast(from *[][]Op, to *[][]Op) bool {
+	for len(*from) > 0 {
+		step := (*from)[len(*from)-1]
+		*from = (*from)[:len(*from)-1]
+
+		var done []Op
+		for i := len(step) - 1; i >= 0; i-- {
+			if op, ok := c.takeBack(step[i]); ok {
+				done = append(done, op)
+			}
+		}
+		if len(done) > 0 {
+			*to = append(*to, done)
+			return true
+		}
+		// others already undid it for us, try the one before
+	}
+	return false
+}
+
+// log the op that takes back our op
+func (c *Client) takeBack(op Op) (Op, bool) {
+	switch op.Type {
+	case CrdtInsert:
+		if i, ok := c.tempdoc.Text.find(op.ID); !ok || i < 0 || c.tempdoc.Text.Elems[i].Dead {
+			return Op{}, false
+		}
+		return c.logCRDTOp(Op{Type: CrdtDelete, ID: op.ID, Data: op.Data}), true
+	case CrdtDelete:
+		id := ElemID{Clock: c.tempdoc.Text.Clock + 1, Client: c.id}
+		c.renamed(op.ID, id)
+		return c.logCRDTOp(Op{Type: CrdtInsert, ID: id, Ref: op.ID, Data: op.Data}), true
+	}
+
+	if c.tempdoc.Mode == ModeCRDT {
+		// from before the switch
+		return Op{}, false
+	}
+	edits, ok := c.tempdoc.Undo(c.id, op.Seq)
+	if !ok {
+		return Op{}, false
+	}
+	return c.logPositional(edits), true
+}
+
+// a rune we put back is a new one, so steps that name the old one name
+// it instead
+func (c *Client) renamed(old ElemID, id ElemID) {
+	for _, steps := range [][][]Op{c.undos, c.redos} {
+		for _, step := range steps {
+			for i := range step {
+				if step[i].ID == old {
+					step[i].ID = id
+				}
+			}
+		}
+	}
+}
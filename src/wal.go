@@ -0,0 +1,262 @@
+package gopad
+
+// Append-only acceptor log for Paxos.
+//
+// Every record is framed as
+//
+//	[4 byte length][4 byte crc32][gob payload]
+//
+// and fsync'd before the caller replies to anyone.  A torn record at the
+// tail (crash in the middle of a write) fails the checksum and is cut off
+// on the next open.  A record that passes the checksum but won't decode
+// isn't torn, so the log is left alone and opening it fails.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	walPrepare = iota
+	walAccept
+	walDecided
+	walDone
+	walCheckpoint
+	walPromise
+)
+
+// rewrite the log once this many records have piled up since the last
+// compaction
+const walCompactEvery = 1024
+
+type walState struct {
+	Stati       map[int]Fate
+	Hiprepare   map[int]int
+	Hiaccept    map[int]int
+	Val         map[int]interface{}
+	Done        map[string]int
+	Hi          int
+	Lo          int
+	Promise     int
+	PromiseFrom int
+}
+
+type walRecord struct {
+	Type  int
+	Seq   int
+	N     int
+	Val   interface{}
+	Peer  string // whose Done, for walDone
+	State *walState
+}
+
+type wal struct {
+	path  string
+	f     *os.File
+	count int // records appended since last compaction
+}
+
+var errBadRecord = errors.New("wal: bad record")
+
+// open the log at path, creating it if needed, and return every intact
+// record in it
+func openWAL(path string) (*wal, []walRecord, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	var recs []walRecord
+	var off int64
+	for {
+		r, n, err := readRecord(f, st.Size()-off)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errBadRecord {
+			// the end, or a torn tail
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("wal: record at %d of %s: %v", off, path, err)
+		}
+		recs = append(recs, r)
+		off += n
+	}
+
+	// drop anything after the last good record
+	if err := f.Truncate(off); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return &wal{path: path, f: f, count: len(recs)}, recs, nil
+}
+
+// read the next record from r, which has left bytes to go
+func readRecord(r io.Reader, left int64) (walRecord, int64, error) {
+	var rec walRecord
+	var hdr [8]byte
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return rec, 0, err
+	}
+	size := binary.BigEndian.Uint32(hdr[0:4])
+	sum := binary.BigEndian.Uint32(hdr[4:8])
+	if int64(size) > left-int64(len(hdr)) {
+		// a torn or garbled header, don't trust it with an allocation
+		return rec, 0, errBadRecord
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return rec, 0, err
+	}
+	if crc32.ChecksumIEEE(buf) != sum {
+		return rec, 0, errBadRecord
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&rec); err != nil {
+		// not io.ErrUnexpectedEOF, which would pass for a torn tail
+		return rec, 0, fmt.Errorf("decode: %v", err)
+	}
+	return rec, int64(len(hdr)) + int64(size), nil
+}
+
+func encodeRecord(rec walRecord) ([]byte, error) {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(rec); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 8+payload.Len())
+	binary.BigEndian.PutUint32(buf[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(buf[8:], payload.Bytes())
+	return buf, nil
+}
+
+// append a record and wait for it to hit the disk
+func (w *wal) append(rec walRecord) error {
+	buf, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(buf); err != nil {
+		return err
+	}
+	w.count++
+	return w.f.Sync()
+}
+
+// replace the whole log with a single state record
+func (w *wal) compact(state *walState) error {
+	buf, err := encodeRecord(walRecord{Type: walCheckpoint, State: state})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileSync(w.path, buf); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	w.f.Close()
+	w.f = f
+	w.count = 1
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.f.Close()
+}
+
+// temp files older than this are left from a crash, not being written
+const staleTemp = time.Minute
+
+// atomically replace filename with data: write a temp file, fsync it,
+// rename it over the original and fsync the directory.  the file keeps
+// its mode, or gets 0666 like os.Create would
+func writeFileSync(filename string, data []byte) (err error) {
+	removeStaleTemps(filename)
+
+	mode := os.FileMode(0666)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	// replicas sharing a directory save the same files
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+"-tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// remove temp files for filename that a crash kept writeFileSync from
+// renaming.  ones that are new may be another replica's, still writing
+func removeStaleTemps(filename string) {
+	dir, prefix := filepath.Dir(filename), filepath.Base(filename)+"-tmp"
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		// CreateTemp puts digits after the prefix
+		rest := strings.TrimPrefix(e.Name(), prefix)
+		if rest == e.Name() || rest == "" || strings.Trim(rest, "0123456789") != "" {
+			continue
+		}
+		if fi, err := e.Info(); err == nil && time.Since(fi.ModTime()) > staleTemp {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
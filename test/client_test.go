@@ -0,0 +1,159 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"testing"
+	"time"
+)
+
+// two bots editing through the Client API see each other's names, edits
+// and cursors
+func TestClient(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+	s := gopad.NewServer("", false, 0, []string{"s0"}, 0, "")
+	sn.AddServer("s0", s)
+	s.Run()
+	defer s.Kill()
+
+	connect := func(user int, doc string, name string, color int) (*gopad.Client, error) {
+		c := gopad.NewClient(user, doc, []string{"s0"})
+		c.SetTransport(sn.Endpoint("c" + string(rune('0'+user))))
+		c.SetName(name)
+		c.SetColor(color)
+		return c, c.Connect()
+	}
+	// wait for ok to hold, on c's changes or every so often since our
+	// ops committing doesn't change what we see
+	wait := func(c *gopad.Client, what string, ok func() bool) {
+		deadline := time.After(5 * time.Second)
+		for !ok() {
+			select {
+			case <-c.Changed():
+			case <-time.After(50 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("%d never saw %s, has %q", c.ID(), what, c.Text())
+			}
+		}
+	}
+	text := func(c *gopad.Client, want string) {
+		wait(c, "text "+want, func() bool { return c.Text() == want })
+	}
+
+	if _, err := connect(3, "nope", "", 0); err == nil {
+		t.Fatal("connected to a document that doesn't exist")
+	}
+
+	c1, err := connect(1, gopad.MainDoc, " ann\x1b\a ", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	// wants ann's color, so gets the first free one
+	c2, err := connect(2, gopad.MainDoc, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	wait(c1, "c2 in the roster", func() bool { return len(c1.Roster()) == 2 })
+	want := []gopad.Presence{{User: 1, Name: "ann", Color: 2}, {User: 2, Name: "user 2", Color: 1}}
+	for i, p := range c1.Roster() {
+		if p.Idle > 5*time.Second || p.Idle < 0 {
+			t.Fatalf("%s idle for %v", p.Name, p.Idle)
+		}
+		if p.Idle = 0; p != want[i] {
+			t.Fatalf("roster has %+v, want %+v", p, want[i])
+		}
+	}
+
+	c1.InsertText("hello world")
+	if c1.Text() != "hello world" || c1.Cursor() != 11 {
+		t.Fatalf("c1 has %q with its cursor at %d", c1.Text(), c1.Cursor())
+	}
+	text(c2, "hello world")
+
+	// c2 goes after "hello" and c1 sees it there
+	c2.MoveTo(5)
+	wait(c1, "c2's cursor", func() bool { return c1.Cursors()[2] == 5 })
+
+	c2.Type(',')
+	c2.Type('\n')
+	wait(c1, "c2 on the second line", func() bool { return c1.Roster()[1].Line == 1 })
+	c2.Backspace()
+	text(c1, "hello, world")
+	text(c2, "hello, world")
+
+	// c1's paste goes as one edit, and so does its undo
+	if !c1.Undo() {
+		t.Fatal("nothing to undo")
+	}
+	text(c1, ",")
+	text(c2, ",")
+	if c2.Undo(); !c2.Redo() {
+		t.Fatal("nothing to redo")
+	}
+
+	c2.Edit(gopad.Edit{Type: gopad.InsertText, At: 0, Text: "ab"},
+		gopad.Edit{Type: gopad.DeleteAt, At: 9})
+	text(c1, "ab,")
+	if doc := c1.Committed(); doc.String() != "ab," {
+		t.Fatalf("committed %q", doc.String())
+	}
+}
+
+// a client cut off from its replica mid-edit moves on to another, and
+// its pending edits commit there once each
+func TestClientFailover(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+	servers := []string{"s0", "s1", "s2"}
+	var ss []*gopad.Server
+	for i, addr := range servers {
+		s := gopad.NewServer("", false, 0, servers, i, "")
+		sn.AddServer(addr, s)
+		s.Run()
+		defer s.Kill()
+		ss = append(ss, s)
+	}
+
+	c := gopad.NewClient(1, gopad.MainDoc, servers)
+	c.SetTransport(sn.Endpoint("c1"))
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	committed := func(want string) {
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			doc := c.Committed()
+			if doc.String() == want {
+				return
+			}
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("committed %q, wanted %q", doc.String(), want)
+			}
+		}
+	}
+	c.InsertText("ab")
+	committed("ab")
+
+	// s0 goes away with c's next edits still to be sent
+	c.Type('c')
+	sn.Partition([]string{"s0"}, []string{"s1", "s2", "c1"})
+	c.Type('d')
+	c.Type('e')
+	if c.Text() != "abcde" {
+		t.Fatalf("c has %q", c.Text())
+	}
+	committed("abcde")
+	waitDocs(t, ss[1:], func(doc gopad.Doc) bool { return doc.String() == "abcde" })
+	if st := c.Status(); st != "Switched to s1" {
+		t.Fatalf("status is %q", st)
+	}
+
+	// and nothing comes in twice once s0 is back
+	sn.Heal()
+	waitDocs(t, ss, func(doc gopad.Doc) bool { return doc.String() == "abcde" })
+}
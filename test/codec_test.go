@@ -0,0 +1,106 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+func TestEntryRoundTrip(t *testing.T) {
+	ops := []gopad.Op{
+		{Type: gopad.Insert, Data: 'x', Seq: 2, Client: 1, Session: 7},
+		{Type: gopad.Newline, Seq: 3, Client: 1, Session: 7},
+	}
+	change := gopad.ConfigChange{Num: 1, Add: []string{"localhost:6063"}}
+
+	for _, p := range []gopad.Paxage{
+		{Payload: ops, Xid: 42},
+		{Payload: []gopad.Op{}, Xid: 0},
+		{Payload: change, Xid: -5},
+	} {
+		for _, version := range []int{0, 1} {
+			v, err := gopad.EncodeEntry(p, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := gopad.DecodeEntry(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, p) {
+				t.Fatalf("version %d: got %#v, want %#v", version, got, p)
+			}
+		}
+	}
+}
+
+func TestEntryNewerVersion(t *testing.T) {
+	v, err := gopad.EncodeEntry(gopad.Paxage{Payload: []gopad.Op{}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := v.([]byte)
+
+	b[0] = 2
+	if _, err := gopad.DecodeEntry(b); err == nil {
+		t.Fatal("decoded an entry from a newer version")
+	}
+
+	b[0], b[1] = 1, 99
+	if _, err := gopad.DecodeEntry(b); err == nil {
+		t.Fatal("decoded an unknown entry type")
+	}
+}
+
+// Op and DoneArgs as builds before the codec sent them
+type oldOp struct {
+	Type    int
+	Data    rune
+	Move    uint16 // termbox key
+	View    uint32
+	Seq     uint32
+	Client  int
+	Session uint32
+}
+
+type oldDoneArgs struct {
+	Num int
+	Me  int // index into peers
+}
+
+// round trip x through gob into y, the way an RPC from an older build
+// arrives
+func regob(t *testing.T, x interface{}, y interface{}) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(x); err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewDecoder(&b).Decode(y); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOldRPCs(t *testing.T) {
+	var args gopad.DoneArgs
+	regob(t, oldDoneArgs{Num: 5, Me: 1}, &args)
+	px := gopad.MakePaxos([]string{"a", "b", "c"}, 0)
+	px.ReplyDone(args, &gopad.DoneReply{})
+	if px.DoneSeqs["b"] != 5 {
+		t.Fatalf("done from an old b went to %v", px.DoneSeqs)
+	}
+
+	e := startEditing(t)
+	doc := e.send(1, gopad.Op{Type: gopad.InsertText, At: 0, Text: "ab", View: 2})
+	e.send(1, gopad.Op{Type: gopad.Move, Motion: gopad.MoveLineStart, View: doc.View})
+
+	// an arrow key from an older build is a motion
+	var op gopad.Op
+	regob(t, oldOp{Type: gopad.Move, Move: 0xFFFF - 21}, &op)
+	doc = e.send(1, op)
+	if pos := doc.UserPos[1]; pos != (gopad.Pos{X: 1}) {
+		t.Fatalf("cursor at %+v after the right arrow", pos)
+	}
+}
@@ -0,0 +1,116 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"testing"
+	"time"
+)
+
+// answers calls to Echo.Echo and Echo.Sleep
+type Echo int
+
+func (e *Echo) Echo(arg string, reply *string) error {
+	*reply = arg
+	return nil
+}
+
+func (e *Echo) Sleep(d time.Duration, reply *bool) error {
+	time.Sleep(d)
+	*reply = true
+	return nil
+}
+
+func echo(t *testing.T, pool *gopad.ConnPool, want bool) {
+	var reply string
+	if ok := pool.Call("a", "Echo.Echo", "hi", &reply, false); ok != want || (ok && reply != "hi") {
+		t.Fatalf("call got %v %q, wanted %v", ok, reply, want)
+	}
+}
+
+func checkStats(t *testing.T, pool *gopad.ConnPool, want gopad.ConnStats) {
+	st := pool.Stats()
+	st.Latency = 0
+	if st != want {
+		t.Fatalf("stats are %+v, wanted %+v", st, want)
+	}
+}
+
+// a connection is kept, redialed once it breaks, and not dialed again
+// while backing off from a failed dial
+func TestConnRedial(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+	sn.AddService("a", new(Echo))
+	pool := gopad.NewConnPool(time.Second, sn.Dial("c"))
+
+	echo(t, pool, true)
+	echo(t, pool, true)
+	checkStats(t, pool, gopad.ConnStats{Dials: 1, Calls: 2})
+
+	// the connection breaks, then redialing fails
+	sn.Partition([]string{"a"}, []string{"c"})
+	echo(t, pool, false)
+	echo(t, pool, false)
+	checkStats(t, pool, gopad.ConnStats{Dials: 2, DialFailures: 1, Calls: 4, CallFailures: 2})
+
+	// too soon to try again even once it's back
+	sn.Heal()
+	echo(t, pool, false)
+	checkStats(t, pool, gopad.ConnStats{Dials: 2, DialFailures: 1, Calls: 5, CallFailures: 3})
+
+	time.Sleep(100 * time.Millisecond)
+	echo(t, pool, true)
+	checkStats(t, pool, gopad.ConnStats{Dials: 3, DialFailures: 1, Calls: 6, CallFailures: 3})
+}
+
+// a call that times out gives up on itself and not on the calls sharing
+// its connection
+func TestConnTimeout(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+	sn.AddService("a", new(Echo))
+	pool := gopad.NewConnPool(200*time.Millisecond, sn.Dial("c"))
+
+	slow := make(chan bool)
+	go func() {
+		var reply bool
+		slow <- pool.Call("a", "Echo.Sleep", 2*time.Second, &reply, false)
+	}()
+
+	// still waiting when the slow one times out
+	time.Sleep(100 * time.Millisecond)
+	var reply bool
+	if !pool.Call("a", "Echo.Sleep", 180*time.Millisecond, &reply, false) || !reply {
+		t.Fatal("call sharing the connection failed")
+	}
+	if <-slow {
+		t.Fatal("slow call didn't time out")
+	}
+
+	echo(t, pool, true)
+	checkStats(t, pool, gopad.ConnStats{Dials: 1, Calls: 3, CallFailures: 1, Timeouts: 1})
+}
+
+// a peer that stops answering without closing the connection is dropped
+// after hungAfter timeouts in a row and redialed after a backoff
+func TestConnHung(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+	sn.AddService("a", new(Echo))
+	pool := gopad.NewConnPool(50*time.Millisecond, sn.Dial("c"))
+
+	var reply bool
+	for i := 0; i < 3; i++ {
+		if pool.Call("a", "Echo.Sleep", time.Second, &reply, false) {
+			t.Fatal("hung call came back")
+		}
+	}
+	checkStats(t, pool, gopad.ConnStats{Dials: 1, Calls: 3, CallFailures: 3, Timeouts: 3, Hung: 1})
+
+	// backing off, then a new connection
+	echo(t, pool, false)
+	time.Sleep(100 * time.Millisecond)
+	echo(t, pool, true)
+	checkStats(t, pool, gopad.ConnStats{Dials: 2, Calls: 5, CallFailures: 4, Timeouts: 3, Hung: 1})
+}
@@ -0,0 +1,87 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// replicas on both sides of a partition take CRDT ops and agree once it
+// heals
+func TestCRDTPartition(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+
+	servers := []string{"s0", "s1", "s2"}
+	var ss []*gopad.Server
+	for i, addr := range servers {
+		s := gopad.NewServer("", false, 0, servers, i, "")
+		sn.AddServer(addr, s)
+		s.Run()
+		defer s.Kill()
+		ss = append(ss, s)
+	}
+	tr := sn.Endpoint("c")
+
+	var mr gopad.ModeReply
+	if !tr.Call("s0", "Server.SetMode", gopad.ModeArg{Mode: gopad.ModeCRDT}, &mr, false) || mr.Err != "OK" {
+		t.Fatal("set mode failed", mr.Err)
+	}
+	waitDocs(t, ss, func(doc gopad.Doc) bool { return doc.Mode == gopad.ModeCRDT })
+
+	// c1 is stuck with s0 while c2 types into the majority
+	sn.Partition([]string{"s0"}, []string{"s1", "s2"})
+	var c1, c2 []gopad.Op
+	for i, ch := range "abc" {
+		id := gopad.ElemID{Clock: uint64(i + 1), Client: 1}
+		c1 = append(c1, gopad.Op{Type: gopad.CrdtInsert, ID: id, Ref: gopad.ElemID{Clock: uint64(i), Client: 1}, Data: ch, Client: 1, Seq: uint32(i + 1)})
+	}
+	for i, ch := range "xyz" {
+		id := gopad.ElemID{Clock: uint64(i + 1), Client: 2}
+		c2 = append(c2, gopad.Op{Type: gopad.CrdtInsert, ID: id, Ref: gopad.ElemID{Clock: uint64(i), Client: 2}, Data: ch, Client: 2, Seq: uint32(i + 1)})
+	}
+	c1[0].Ref = gopad.ElemID{}
+	c2[0].Ref = gopad.ElemID{}
+	c2 = append(c2, gopad.Op{Type: gopad.CrdtDelete, ID: gopad.ElemID{Clock: 2, Client: 2}, Client: 2, Seq: 4})
+
+	// out of order, to be held until they can apply
+	merge(t, tr, "s0", []gopad.Op{c1[2], c1[1]})
+	merge(t, tr, "s0", c1[:1])
+	merge(t, tr, "s1", c2)
+
+	waitDocs(t, ss[:1], func(doc gopad.Doc) bool { return string(doc.Rows[0].Chars) == "abc" })
+	waitDocs(t, ss[1:], func(doc gopad.Doc) bool { return string(doc.Rows[0].Chars) == "xz" })
+
+	// runs after the same rune go newest first, ties by client
+	sn.Heal()
+	waitDocs(t, ss, func(doc gopad.Doc) bool { return string(doc.Rows[0].Chars) == "xzabc" })
+}
+
+func merge(t *testing.T, tr gopad.Transport, srv string, ops []gopad.Op) {
+	buf, _ := json.Marshal(ops)
+	var reply gopad.MergeReply
+	if !tr.Call(srv, "Server.Merge", gopad.MergeArg{Data: buf}, &reply, false) || reply.Err != "OK" {
+		t.Fatal("merge failed", reply.Err)
+	}
+}
+
+func waitDocs(t *testing.T, ss []*gopad.Server, ok func(gopad.Doc) bool) {
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(20 * time.Millisecond) {
+		all := true
+		for _, s := range ss {
+			if _, doc := s.State(); !ok(doc) {
+				all = false
+			}
+		}
+		if all {
+			return
+		}
+	}
+	for i, s := range ss {
+		_, doc := s.State()
+		t.Logf("s%d: mode %d rows %+v", i, doc.Mode, doc.Rows)
+	}
+	t.Fatal("replicas never got there")
+}
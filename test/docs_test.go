@@ -0,0 +1,94 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// documents are created, edited apart from each other, renamed and
+// deleted on every replica
+func TestDocs(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+
+	servers := []string{"s0", "s1", "s2"}
+	var ss []*gopad.Server
+	for i, addr := range servers {
+		s := gopad.NewServer("", false, 0, servers, i, "")
+		sn.AddServer(addr, s)
+		s.Run()
+		defer s.Kill()
+		ss = append(ss, s)
+	}
+	tr := sn.Endpoint("c")
+
+	docCall := func(rpcname string, arg gopad.DocArg, want gopad.Err) gopad.DocReply {
+		var reply gopad.DocReply
+		if !tr.Call("s1", rpcname, arg, &reply, false) || reply.Err != want {
+			t.Fatalf("%s %+v: got %q, want %q", rpcname, arg, reply.Err, want)
+		}
+		return reply
+	}
+
+	docCall("Server.CreateDoc", gopad.DocArg{Name: "notes/a", Rows: []string{"hi", "there"}}, "OK")
+	docCall("Server.CreateDoc", gopad.DocArg{Name: "notes/a"}, "Exists")
+	if r := docCall("Server.ListDocs", gopad.DocArg{}, "OK"); !reflect.DeepEqual(r.Names, []string{gopad.MainDoc, "notes/a"}) {
+		t.Fatalf("listed %q", r.Names)
+	}
+
+	// edit through another replica
+	var ir gopad.InitReply
+	if !tr.Call("s0", "Server.Init", gopad.InitArg{Client: 1, Session: 1, Doc: "notes/a"}, &ir, false) || ir.Err != "OK" {
+		t.Fatal("init failed", ir.Err)
+	}
+	buf, _ := json.Marshal([]gopad.Op{{Type: gopad.InsertAt, At: 2, Data: '!', Client: 1, Session: 1, Seq: 2, View: 1}})
+	// Init may not be applied yet when it returns
+	var reply gopad.OpReply
+	for reply.Err = "High"; reply.Err == "High"; time.Sleep(10 * time.Millisecond) {
+		if !tr.Call("s0", "Server.Handle", gopad.OpArg{Data: buf, Doc: "notes/a"}, &reply, false) {
+			t.Fatal("handle failed")
+		}
+	}
+	if reply.Err != "OK" {
+		t.Fatal("handle failed", reply.Err)
+	}
+	waitDoc := func(name string, ok func(gopad.Doc, bool) bool) {
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(20 * time.Millisecond) {
+			all := true
+			for _, s := range ss {
+				if _, doc, found := s.DocState(name); !ok(doc, found) {
+					all = false
+				}
+			}
+			if all {
+				return
+			}
+		}
+		t.Fatalf("replicas never agreed on %q", name)
+	}
+	waitDoc("notes/a", func(doc gopad.Doc, found bool) bool {
+		return found && len(doc.Rows) == 2 && string(doc.Rows[0].Chars) == "hi!"
+	})
+	if _, doc := ss[2].State(); len(doc.Rows) != 1 || string(doc.Rows[0].Chars) != "" || len(doc.Colors) != 0 {
+		t.Fatalf("main document changed: %+v", doc)
+	}
+
+	docCall("Server.RenameDoc", gopad.DocArg{Name: "notes/a", To: "b"}, "OK")
+	docCall("Server.RenameDoc", gopad.DocArg{Name: "notes/a", To: "c"}, "NoDoc")
+	waitDoc("b", func(doc gopad.Doc, found bool) bool { return found && string(doc.Rows[0].Chars) == "hi!" })
+	var qr gopad.QueryReply
+	if !tr.Call("s2", "Server.Query", gopad.QueryArg{View: 0, Client: 1, Doc: "notes/a"}, &qr, false) || qr.Err != "NoDoc" {
+		t.Fatalf("query of old name got %q", qr.Err)
+	}
+
+	docCall("Server.DeleteDoc", gopad.DocArg{Name: gopad.MainDoc}, "Name")
+	docCall("Server.DeleteDoc", gopad.DocArg{Name: "b"}, "OK")
+	waitDoc("b", func(doc gopad.Doc, found bool) bool { return !found })
+	if r := docCall("Server.ListDocs", gopad.DocArg{}, "OK"); !reflect.DeepEqual(r.Names, []string{gopad.MainDoc}) {
+		t.Fatalf("listed %q", r.Names)
+	}
+}
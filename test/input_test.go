@@ -1,13 +1,25 @@
 package testing
 
-import "github.com/ilnaes/gopad/src"
+import (
+	"github.com/ilnaes/gopad-old/src"
+	"github.com/ilnaes/gopad-old/src/term"
+)
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 func TestInput(t *testing.T) {
-	s := gopad.NewServer("")
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err != nil {
+		t.Skip("needs a terminal")
+	} else {
+		tty.Close()
+	}
+
+	s := gopad.NewServer("", false, 6060, []string{"localhost:6060"}, 0, "")
 	go s.Start()
 
-	gopad.StartClient(1, "localhost", 6060, true)
+	term.StartClient(gopad.NewClient(1, gopad.MainDoc, []string{"localhost:6060", "localhost:6061", "localhost:6062"}), true)
 
 }
@@ -0,0 +1,303 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func applyEdit(s []rune, e gopad.Edit) []rune {
+	switch e.Type {
+	case gopad.InsertAt:
+		return append(s[:e.At:e.At], append([]rune{e.Data}, s[e.At:]...)...)
+	case gopad.DeleteAt:
+		return append(s[:e.At:e.At], s[e.At+1:]...)
+	case gopad.InsertText:
+		return append(s[:e.At:e.At], append([]rune(e.Text), s[e.At:]...)...)
+	}
+	return s
+}
+
+func randomEdit(rng *rand.Rand, n int, client int) gopad.Edit {
+	switch {
+	case n > 0 && rng.Intn(3) == 0:
+		return gopad.Edit{Type: gopad.DeleteAt, At: rng.Intn(n), Client: client}
+	case rng.Intn(2) == 0:
+		text := strings.Repeat(string(rune('a'+rng.Intn(3))), 1+rng.Intn(2)) + "\nb"[:rng.Intn(3)]
+		return gopad.Edit{Type: gopad.InsertText, At: rng.Intn(n + 1), Text: text, Client: client}
+	}
+	return gopad.Edit{Type: gopad.InsertAt, At: rng.Intn(n + 1), Data: rune('a' + rng.Intn(3)), Client: client}
+}
+
+// a replica with users 1 and 2 in the main document, to send it ops
+// directly
+type editing struct {
+	t   *testing.T
+	s   *gopad.Server
+	tr  gopad.Transport
+	seq map[int]uint32
+}
+
+func startEditing(t *testing.T) *editing {
+	sn := gopad.NewSimNet(1)
+	s := gopad.NewServer("", false, 0, []string{"s0"}, 0, "")
+	sn.AddServer("s0", s)
+	s.Run()
+	t.Cleanup(func() {
+		s.Kill()
+		sn.Close()
+	})
+
+	e := &editing{t: t, s: s, tr: sn.Endpoint("c"), seq: map[int]uint32{1: 1, 2: 1}}
+	for c := 1; c <= 2; c++ {
+		var ir gopad.InitReply
+		if !e.tr.Call("s0", "Server.Init", gopad.InitArg{Client: c, Session: 1}, &ir, false) || ir.Err != "OK" {
+			t.Fatal("init failed", ir.Err)
+		}
+	}
+	return e
+}
+
+// send ops from user c, numbered after their last, and return the
+// document once they're applied
+func (e *editing) send(c int, ops ...gopad.Op) gopad.Doc {
+	for i := range ops {
+		e.seq[c]++
+		ops[i].Client, ops[i].Session, ops[i].Seq = c, 1, e.seq[c]
+	}
+	buf, _ := json.Marshal(ops)
+	var reply gopad.OpReply
+	if !e.tr.Call("s0", "Server.Handle", gopad.OpArg{Data: buf}, &reply, false) || reply.Err != "OK" {
+		e.t.Fatal("handle failed", reply.Err)
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if _, doc := e.s.State(); doc.UserSeqs[c] >= e.seq[c] {
+			return doc
+		}
+	}
+	e.t.Fatal("never applied")
+	return gopad.Doc{}
+}
+
+// a then b' and b then a' end up the same
+func TestTransformConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		s := []rune(strings.Repeat("x", rng.Intn(5)))
+		a := randomEdit(rng, len(s), 1+rng.Intn(2))
+		b := randomEdit(rng, len(s), 1+rng.Intn(2))
+
+		ab := applyEdit(applyEdit(append([]rune{}, s...), a), gopad.Transform(b, a))
+		ba := applyEdit(applyEdit(append([]rune{}, s...), b), gopad.Transform(a, b))
+		if string(ab) != string(ba) {
+			t.Fatalf("%q with %+v and %+v: %q != %q", string(s), a, b, string(ab), string(ba))
+		}
+	}
+}
+
+// concurrent batches on one line land where they were meant to,
+// whichever commits first
+func TestConcurrentEdits(t *testing.T) {
+	for _, first := range []int{1, 2} {
+		e := startEditing(t)
+
+		var ops []gopad.Op
+		for i, ch := range "hello world" {
+			ops = append(ops, gopad.Op{Type: gopad.InsertAt, At: i, Data: ch, View: 2})
+		}
+		base := e.send(1, ops...).View
+
+		// both made against "hello world"
+		batches := map[int][]gopad.Op{
+			1: {{Type: gopad.InsertAt, At: 5, Data: ',', View: base}},
+			2: {{Type: gopad.DeleteAt, At: 10, View: base}, {Type: gopad.InsertAt, At: 10, Data: 'D', View: base}, {Type: gopad.InsertAt, At: 11, Data: '!', View: base}},
+		}
+		e.send(first, batches[first]...)
+		doc := e.send(3-first, batches[3-first]...)
+		if got := string(doc.Rows[0].Chars); got != "hello, worlD!" {
+			t.Fatalf("%d first: got %q", first, got)
+		}
+	}
+}
+
+// a user's undo takes back their own edit, wherever others' edits moved
+// it, and redo puts it back
+func TestUndo(t *testing.T) {
+	e := startEditing(t)
+	op := func(x gopad.Edit, view uint32) gopad.Op {
+		return gopad.Op{Type: x.Type, At: x.At, Data: x.Data, View: view}
+	}
+	undo := func(doc gopad.Doc, which uint32) gopad.Op {
+		edits, ok := doc.Undo(1, which)
+		if !ok || len(edits) != 1 {
+			t.Fatalf("nothing to undo for %d", which)
+		}
+		return op(edits[0], doc.View)
+	}
+
+	var ops []gopad.Op
+	for i, ch := range "abc" {
+		ops = append(ops, gopad.Op{Type: gopad.InsertAt, At: i, Data: ch, View: 2})
+	}
+	e.send(1, ops...)
+	// c1 deletes the 'c' before it sees the 'X'
+	e.send(2, gopad.Op{Type: gopad.InsertAt, At: 0, Data: 'X', View: 5})
+	doc := e.send(1, gopad.Op{Type: gopad.DeleteAt, At: 2, View: 5})
+	if got := string(doc.Rows[0].Chars); got != "Xab" {
+		t.Fatalf("got %q", got)
+	}
+
+	// take back the 'b' and the delete
+	doc = e.send(1, undo(doc, 3))
+	if got := string(doc.Rows[0].Chars); got != "Xa" {
+		t.Fatalf("after undoing b got %q", got)
+	}
+	doc = e.send(1, undo(doc, 5))
+	if got := string(doc.Rows[0].Chars); got != "Xac" {
+		t.Fatalf("after undoing the delete got %q", got)
+	}
+
+	// redo is undoing the undo
+	doc = e.send(1, undo(doc, 6))
+	if got := string(doc.Rows[0].Chars); got != "Xabc" {
+		t.Fatalf("after redo got %q", got)
+	}
+
+	// nothing to take back from an op somebody else undid
+	doc = e.send(2, gopad.Op{Type: gopad.DeleteAt, At: 1, View: doc.View})
+	if _, ok := doc.Undo(1, 2); ok {
+		t.Fatal("undid an insert that's gone")
+	}
+}
+
+// undoing a paste longer than historyMax takes all of it back, and
+// redo puts all of it in again
+func TestUndoLongPaste(t *testing.T) {
+	e := startEditing(t)
+
+	doc := e.send(1, gopad.Op{Type: gopad.InsertText, At: 0, Text: "[]", View: 2})
+	n := 1500
+	doc = e.send(1, gopad.Op{Type: gopad.InsertText, At: 1, Text: strings.Repeat("x", n), View: doc.View})
+	pasted := e.seq[1]
+
+	undo, ok := doc.Undo(1, pasted)
+	if !ok || len(undo) != n {
+		t.Fatalf("undo gave %d edits", len(undo))
+	}
+	doc = e.send(1, gopad.Op{Type: gopad.Range, Edits: undo, View: doc.View})
+	if got := string(doc.Rows[0].Chars); got != "[]" {
+		t.Fatalf("%d runes left after undo", len(doc.Rows[0].Chars))
+	}
+
+	redo, ok := doc.Undo(1, e.seq[1])
+	if !ok || len(redo) != n {
+		t.Fatalf("redo gave %d edits", len(redo))
+	}
+	doc = e.send(1, gopad.Op{Type: gopad.Range, Edits: redo, View: doc.View})
+	if got := string(doc.Rows[0].Chars); got != "["+strings.Repeat("x", n)+"]" {
+		t.Fatalf("%d runes after redo", len(doc.Rows[0].Chars))
+	}
+}
+
+// a Range op replaces a selection in one go, other users' edits and
+// marks move past it, and undo takes all of it back
+func TestRange(t *testing.T) {
+	e := startEditing(t)
+
+	var ops []gopad.Op
+	for i, ch := range "hello world" {
+		ops = append(ops, gopad.Op{Type: gopad.InsertAt, At: i, Data: ch, View: 2})
+	}
+	base := e.send(1, ops...).View
+
+	// c1 replaces "hello" while c2 adds a '!' and marks "world"
+	var edits []gopad.Edit
+	for i := 0; i < 5; i++ {
+		edits = append(edits, gopad.Edit{Type: gopad.DeleteAt, At: 0, Client: 1})
+	}
+	for i, ch := range "HEY" {
+		edits = append(edits, gopad.Edit{Type: gopad.InsertAt, At: i, Data: ch, Client: 1})
+	}
+	e.send(1, gopad.Op{Type: gopad.Range, Edits: edits, View: base})
+	replaced := e.seq[1]
+	doc := e.send(2, gopad.Op{Type: gopad.InsertAt, At: 11, Data: '!', View: base},
+		gopad.Op{Type: gopad.Select, At: 6, View: base})
+	if got := string(doc.Rows[0].Chars); got != "HEY world!" {
+		t.Fatalf("got %q", got)
+	}
+	if doc.Marks[2] != 4 {
+		t.Fatalf("mark at %d, not before world", doc.Marks[2])
+	}
+
+	undo, ok := doc.Undo(1, replaced)
+	if !ok || len(undo) != len(edits) {
+		t.Fatalf("undo gave %v", undo)
+	}
+	doc = e.send(1, gopad.Op{Type: gopad.Range, Edits: undo, View: doc.View})
+	if got := string(doc.Rows[0].Chars); got != "hello world!" {
+		t.Fatalf("after undo got %q", got)
+	}
+	if doc.Marks[2] != 6 {
+		t.Fatalf("mark at %d after undo", doc.Marks[2])
+	}
+
+	doc = e.send(2, gopad.Op{Type: gopad.Select, At: -1, View: doc.View})
+	if _, ok := doc.Marks[2]; ok {
+		t.Fatal("mark not cleared")
+	}
+}
+
+// a Range op with more edits than a Doc remembers still makes all of
+// them, and so does the op after it in the same batch
+func TestLongRange(t *testing.T) {
+	e := startEditing(t)
+
+	n := 1500
+	base := e.send(1, gopad.Op{Type: gopad.InsertText, At: 0, Text: strings.Repeat("x", n) + "end", View: 2}).View
+
+	var edits []gopad.Edit
+	for i := 0; i < n; i++ {
+		edits = append(edits, gopad.Edit{Type: gopad.DeleteAt, At: 0, Client: 1})
+	}
+	doc := e.send(1, gopad.Op{Type: gopad.Range, Edits: edits, View: base},
+		gopad.Op{Type: gopad.InsertAt, At: 3, Data: '!', View: base})
+	if got := string(doc.Rows[0].Chars); got != "end!" {
+		t.Fatalf("%d runes left, wanted %q", len(doc.Rows[0].Chars), "end!")
+	}
+}
+
+// pasted text goes in with one op, and pushes other users' cursors along
+// rows and down
+func TestInsertText(t *testing.T) {
+	e := startEditing(t)
+
+	doc := e.send(1, gopad.Op{Type: gopad.InsertText, At: 0, Text: "hello world", View: 2})
+	// c2's cursor ends up before the 'w'
+	doc = e.send(2, gopad.Op{Type: gopad.InsertAt, At: 5, Data: ',', View: doc.View})
+	view := doc.View
+	// c1 pastes before c2's comma without having seen it
+	doc = e.send(1, gopad.Op{Type: gopad.InsertText, At: 2, Text: "y\nthere\n", View: view - 1})
+
+	var rows []string
+	for _, row := range doc.Rows {
+		rows = append(rows, string(row.Chars))
+	}
+	if got := strings.Join(rows, "\n"); got != "hey\nthere\nllo, world" {
+		t.Fatalf("got %q", got)
+	}
+	if doc.View != view+1 {
+		t.Fatalf("paste took %d views", doc.View-view)
+	}
+	if pos := doc.UserPos[2]; pos != (gopad.Pos{X: 4, Y: 2}) {
+		t.Fatalf("c2's cursor at %+v", pos)
+	}
+
+	undo, ok := doc.Undo(1, 3)
+	if !ok || len(undo) != len("y\nthere\n") {
+		t.Fatalf("undo gave %v", undo)
+	}
+}
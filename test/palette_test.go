@@ -0,0 +1,52 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src/term"
+
+import (
+	"github.com/nsf/termbox-go"
+	"testing"
+)
+
+// no two users share a text or cursor color, whichever order they show
+// up in: in the 256 color cube until it runs out, and on truecolor
+// terminals well past that
+func TestPaletteDistinct(t *testing.T) {
+	const n = 200
+	for _, mode := range []termbox.OutputMode{termbox.Output256, termbox.OutputRGB} {
+		p := term.NewPalette(mode)
+		text := make(map[termbox.Attribute]int)
+		cursor := make(map[termbox.Attribute]int)
+		for c := n; c >= 1; c-- {
+			a, b := p.Text(c), p.Cursor(c)
+			if mode == termbox.Output256 && (a < 17 || a > 232 || b < 17 || b > 232) {
+				t.Fatalf("color %d: %d %d not in the cube", c, a-1, b-1)
+			}
+			if other, ok := text[a]; ok {
+				t.Fatalf("mode %d: colors %d and %d have the same text", mode, c, other)
+			}
+			if other, ok := cursor[b]; ok {
+				t.Fatalf("mode %d: colors %d and %d have the same cursor", mode, c, other)
+			}
+			text[a], cursor[b] = c, c
+		}
+
+		// a client that heard of them in order draws them the same
+		q := term.NewPalette(mode)
+		for c := 1; c <= n; c++ {
+			if q.Text(c) != p.Text(c) || q.Cursor(c) != p.Cursor(c) {
+				t.Fatalf("mode %d: color %d differs between clients", mode, c)
+			}
+		}
+	}
+
+	// truecolor goes on where the cube can't
+	p := term.NewPalette(termbox.OutputRGB)
+	seen := make(map[termbox.Attribute]bool)
+	for c := 1; c <= 1000; c++ {
+		if a := p.Text(c); seen[a] {
+			t.Fatalf("color %d repeats", c)
+		} else {
+			seen[a] = true
+		}
+	}
+}
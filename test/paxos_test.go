@@ -0,0 +1,648 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// start npaxos peers on local ports.  peer hung, if any, takes
+// connections but never answers.
+func makePeers(t testing.TB, npaxos int, hung int) []*gopad.Paxos {
+	pxa, _ := startPeers(t, npaxos, hung)
+	return pxa
+}
+
+// same, but also return their addresses
+func startPeers(t testing.TB, npaxos int, hung int) ([]*gopad.Paxos, []string) {
+	var ls []net.Listener
+	var peers []string
+	for i := 0; i < npaxos; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ls = append(ls, l)
+		peers = append(peers, l.Addr().String())
+	}
+
+	var pxa []*gopad.Paxos
+	for i := 0; i < npaxos; i++ {
+		px := gopad.MakePaxos(peers, i)
+		rpcs := rpc.NewServer()
+		rpcs.Register(px)
+		go func(l net.Listener, hung bool) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				if !hung {
+					go rpcs.ServeConn(conn)
+				}
+			}
+		}(ls[i], i == hung)
+		pxa = append(pxa, px)
+	}
+
+	t.Cleanup(func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	})
+	return pxa, peers
+}
+
+// wait for every peer to decide seq and check they all agree
+func waitAgree(t *testing.T, pxa []*gopad.Paxos, seq int) interface{} {
+	to := 10 * time.Millisecond
+	for iters := 0; iters < 30; iters++ {
+		var v interface{}
+		decided := 0
+		for i, px := range pxa {
+			fate, v1 := px.Status(seq)
+			if fate == gopad.Decided {
+				if decided > 0 && v1 != v {
+					t.Fatalf("seq %d: peer %d decided %v, others %v", seq, i, v1, v)
+				}
+				v = v1
+				decided++
+			}
+		}
+		if decided == len(pxa) {
+			return v
+		}
+		time.Sleep(to)
+		if to < time.Second {
+			to *= 2
+		}
+	}
+	t.Fatalf("seq %d: not every peer decided", seq)
+	return nil
+}
+
+func TestConcurrentProposers(t *testing.T) {
+	for _, npaxos := range []int{3, 5} {
+		rng := rand.New(rand.NewSource(int64(npaxos)))
+		pxa := makePeers(t, npaxos, -1)
+
+		for seq := 0; seq < 20; seq++ {
+			proposed := make(map[interface{}]bool)
+			var wg sync.WaitGroup
+
+			// a random, non-empty set of peers all propose at once
+			for i := range pxa {
+				if i != 0 && rng.Intn(2) == 0 {
+					continue
+				}
+				v := fmt.Sprintf("%d-%d", seq, i)
+				proposed[v] = true
+				delay := time.Duration(rng.Intn(5)) * time.Millisecond
+
+				wg.Add(1)
+				go func(px *gopad.Paxos) {
+					defer wg.Done()
+					time.Sleep(delay)
+					px.Start(seq, v)
+				}(pxa[i])
+			}
+			wg.Wait()
+
+			v := waitAgree(t, pxa, seq)
+			if !proposed[v] {
+				t.Fatalf("seq %d: decided %v which nobody proposed", seq, v)
+			}
+		}
+	}
+}
+
+func TestConcurrentProposersLeader(t *testing.T) {
+	pxa := makePeers(t, 3, -1)
+	for _, px := range pxa {
+		px.SetMulti(true)
+		go px.Run()
+	}
+
+	for seq := 0; seq < 20; seq++ {
+		proposed := make(map[interface{}]bool)
+		for i, px := range pxa {
+			v := fmt.Sprintf("%d-%d", seq, i)
+			proposed[v] = true
+			px.Start(seq, v)
+		}
+
+		v := waitAgree(t, pxa, seq)
+		if !proposed[v] {
+			t.Fatalf("seq %d: decided %v which nobody proposed", seq, v)
+		}
+		time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
+	}
+}
+
+// npaxos peers running Multi-Paxos over a SimNet
+func startLeaders(t *testing.T, npaxos int) (*gopad.SimNet, []*gopad.Paxos, []string) {
+	sn := gopad.NewSimNet(1)
+	var pxa []*gopad.Paxos
+	var peers []string
+	for i := 0; i < npaxos; i++ {
+		peers = append(peers, fmt.Sprintf("p%d", i))
+	}
+	for i, addr := range peers {
+		px := gopad.MakePaxos(peers, i)
+		px.SetMulti(true)
+		sn.AddPaxos(addr, px)
+		pxa = append(pxa, px)
+	}
+	for _, px := range pxa {
+		go px.Run()
+	}
+	t.Cleanup(func() {
+		for _, px := range pxa {
+			px.Kill()
+		}
+		sn.Close()
+	})
+	return sn, pxa, peers
+}
+
+// wait for every peer in pxa to follow the same leader, other than
+// the ones in not
+func waitLeader(t *testing.T, pxa []*gopad.Paxos, not ...string) string {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		leader := pxa[0].Leader()
+		for _, px := range pxa[1:] {
+			if px.Leader() != leader {
+				leader = ""
+			}
+		}
+		for _, s := range not {
+			if leader == s {
+				leader = ""
+			}
+		}
+		if leader != "" {
+			return leader
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no leader other than %v", not)
+	return ""
+}
+
+func peerIndex(peers []string, addr string) int {
+	for i, p := range peers {
+		if p == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// peers agree on one leader, keep it while it heartbeats, and the rest
+// take over only after a partitioned leader's lease runs out
+func TestLeaderLease(t *testing.T) {
+	sn, pxa, peers := startLeaders(t, 3)
+	old := waitLeader(t, pxa)
+
+	// it stays put
+	time.Sleep(1500 * time.Millisecond)
+	for i, px := range pxa {
+		if px.Leader() != old {
+			t.Fatalf("peer %d follows %q, not %q", i, px.Leader(), old)
+		}
+	}
+
+	var rest []*gopad.Paxos
+	var others []string
+	for i, addr := range peers {
+		if addr != old {
+			rest = append(rest, pxa[i])
+			others = append(others, addr)
+		}
+	}
+	sn.Partition([]string{old}, others)
+	cut := time.Now()
+
+	// still leased for a while
+	time.Sleep(400 * time.Millisecond)
+	for _, px := range rest {
+		if l := px.Leader(); l != old {
+			t.Fatalf("followed %q only %v after the partition", l, time.Since(cut))
+		}
+	}
+
+	leader := waitLeader(t, rest, old)
+	if d := time.Since(cut); d < 500*time.Millisecond {
+		t.Fatalf("%s took over after %v", leader, d)
+	}
+
+	// the majority keeps deciding under it.  followers hand their ops
+	// to the leader, like the server does, since proposing themselves
+	// would depose it
+	lead := pxa[peerIndex(peers, leader)]
+	for seq := 0; seq < 5; seq++ {
+		lead.Start(seq, seq)
+		waitAgree(t, rest, seq)
+	}
+
+	// the old leader finds out once healed
+	sn.Heal()
+	if l := waitLeader(t, pxa); l != leader {
+		t.Fatalf("everyone follows %q after healing, not %q", l, leader)
+	}
+}
+
+// a dead leader stops heartbeating and somebody else is elected
+func TestLeaderKill(t *testing.T) {
+	_, pxa, peers := startLeaders(t, 5)
+	old := waitLeader(t, pxa)
+
+	var rest []*gopad.Paxos
+	for i, addr := range peers {
+		if addr == old {
+			pxa[i].Kill()
+		} else {
+			rest = append(rest, pxa[i])
+		}
+	}
+	leader := waitLeader(t, rest, old)
+
+	lead := pxa[peerIndex(peers, leader)]
+	for seq := 0; seq < 5; seq++ {
+		lead.Start(seq, seq)
+		if v := waitAgree(t, rest, seq); v != seq {
+			t.Fatalf("seq %d: decided %v under %s", seq, v, leader)
+		}
+	}
+}
+
+// replace peer 0 with peer 3 from instance 5 on
+func TestMembershipChange(t *testing.T) {
+	pxa, peers := startPeers(t, 4, -1)
+
+	configs := []gopad.Config{
+		{Num: 0, From: 0, Peers: map[string]int{peers[0]: 0, peers[1]: 1, peers[2]: 2}, NextID: 3},
+		{Num: 1, From: 5, Peers: map[string]int{peers[1]: 1, peers[2]: 2, peers[3]: 3}, NextID: 4},
+	}
+	for _, px := range pxa {
+		px.SetConfigs(configs)
+	}
+
+	// the new peer proposes in both configs, the old one in neither
+	for seq := 0; seq < 10; seq++ {
+		pxa[1+seq%3].Start(seq, seq)
+		if v := waitAgree(t, pxa[1:], seq); v != seq {
+			t.Fatalf("seq %d: decided %v", seq, v)
+		}
+	}
+
+	// peer 0 is gone so it shouldn't hold back Min(), but peer 3 should
+	pxa[1].Done(9)
+	pxa[2].Done(9)
+	if min := pxa[1].Min(); min != 0 {
+		t.Fatalf("Min() is %d before the new peer is done", min)
+	}
+	pxa[3].Done(9)
+	pxa[1].Done(9)
+	pxa[2].Done(9)
+	for i, px := range pxa[1:] {
+		if min := px.Min(); min != 10 {
+			t.Fatalf("peer %d: Min() is %d, want 10", i+1, min)
+		}
+	}
+}
+
+// a peer that missed every Decided learns them from the others
+func TestCatchUp(t *testing.T) {
+	pxa := makePeers(t, 3, 2)
+
+	for seq := 0; seq < 5; seq++ {
+		pxa[0].Start(seq, seq)
+		waitAgree(t, pxa[:2], seq)
+	}
+	if fate, _ := pxa[2].Status(0); fate == gopad.Decided {
+		t.Fatal("hung peer heard about seq 0")
+	}
+
+	if !pxa[2].CatchUp(0) {
+		t.Fatal("CatchUp didn't learn seq 0")
+	}
+	for seq := 0; seq < 5; seq++ {
+		if fate, v := pxa[2].Status(seq); fate != gopad.Decided || v != seq {
+			t.Fatalf("seq %d: %v %v after CatchUp", seq, fate, v)
+		}
+	}
+}
+
+// an accept from an earlier round that shows up after the instance was
+// decided, or a Start that raced the decision, can't change the value
+func TestLateAccept(t *testing.T) {
+	pxa := makePeers(t, 3, -1)
+
+	pxa[0].Start(0, "first")
+	waitAgree(t, pxa, 0)
+	var reply gopad.AcceptReply
+	pxa[1].Accept(gopad.AcceptArgs{Seq: 0, N: 1 << 30, Val: "late"}, &reply)
+	pxa[1].Start(0, "again")
+	time.Sleep(100 * time.Millisecond)
+
+	for i, px := range pxa {
+		if fate, v := px.Status(0); fate != gopad.Decided || v != "first" {
+			t.Fatalf("peer %d: %v %v", i, fate, v)
+		}
+	}
+}
+
+// a peer that saves to path, as it comes back up
+func restart(t *testing.T, path string) *gopad.Paxos {
+	px := gopad.MakePaxos([]string{"a", "b", "c"}, 0)
+	if err := px.SetSave(path); err != nil {
+		t.Fatal(err)
+	}
+	return px
+}
+
+// what px says it accepted for seq when asked with ballot n
+func accepted(px *gopad.Paxos, seq int, n int) (int, interface{}) {
+	var reply gopad.PrepareReply
+	px.Prepare(gopad.PrepareArgs{Seq: seq, N: n}, &reply)
+	return reply.High, reply.Val
+}
+
+// promises, accepts and decisions all survive a restart
+func TestWALRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paxos.log")
+	px := restart(t, path)
+	var ar gopad.AcceptReply
+	px.Prepare(gopad.PrepareArgs{Seq: 0, N: 5}, &gopad.PrepareReply{})
+	px.Accept(gopad.AcceptArgs{Seq: 1, N: 3, Val: "one"}, &ar)
+	px.Decided(gopad.DecidedArgs{Seq: 2, Val: "two"}, &gopad.DecidedReply{})
+	px.Accept(gopad.AcceptArgs{Seq: 2, N: 1 << 20, Val: "late"}, &ar)
+	px.Kill()
+
+	px = restart(t, path)
+	var pr gopad.PrepareReply
+	px.Prepare(gopad.PrepareArgs{Seq: 0, N: 4}, &pr)
+	if pr.Accepted {
+		t.Fatal("broke a promise made before restarting")
+	}
+	if n, v := accepted(px, 1, 10); n != 3 || v != "one" {
+		t.Fatalf("seq 1: accepted %v at %d after restarting", v, n)
+	}
+	if fate, v := px.Status(2); fate != gopad.Decided || v != "two" {
+		t.Fatalf("seq 2: %v %v after restarting", fate, v)
+	}
+}
+
+// a record cut short by a crash, or that doesn't match its checksum or
+// size, is dropped along with anything after it, and the log goes on from there
+func TestWALTorn(t *testing.T) {
+	damage := map[string]func(b []byte) []byte{
+		"torn":     func(b []byte) []byte { return b[:len(b)-3] },
+		"checksum": func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b },
+		"size": func(b []byte) []byte {
+			// the last record says it's 4GiB long
+			last := 0
+			for off := 0; off < len(b); off += 8 + int(binary.BigEndian.Uint32(b[off:])) {
+				last = off
+			}
+			binary.BigEndian.PutUint32(b[last:], 0xffffffff)
+			return b
+		},
+	}
+	for name, f := range damage {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "paxos.log")
+			px := restart(t, path)
+			var ar gopad.AcceptReply
+			px.Accept(gopad.AcceptArgs{Seq: 0, N: 1, Val: "zero"}, &ar)
+			px.Accept(gopad.AcceptArgs{Seq: 1, N: 1, Val: "one"}, &ar)
+			px.Kill()
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, f(b), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			px = restart(t, path)
+			if n, v := accepted(px, 0, 10); n != 1 || v != "zero" {
+				t.Fatalf("seq 0: accepted %v at %d", v, n)
+			}
+			if n, v := accepted(px, 1, 10); n != 0 || v != nil {
+				t.Fatalf("seq 1: accepted %v at %d from a bad record", v, n)
+			}
+			px.Accept(gopad.AcceptArgs{Seq: 2, N: 10, Val: "two"}, &ar)
+			px.Kill()
+
+			px = restart(t, path)
+			if n, v := accepted(px, 2, 20); n != 10 || v != "two" {
+				t.Fatalf("seq 2: accepted %v at %d after the bad record", v, n)
+			}
+		})
+	}
+}
+
+// a record that passes its checksum but won't decode fails the open
+// instead of being cut off with everything after it
+func TestWALUndecodable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paxos.log")
+	px := restart(t, path)
+	var ar gopad.AcceptReply
+	px.Accept(gopad.AcceptArgs{Seq: 0, N: 1, Val: "zero"}, &ar)
+	px.Kill()
+
+	junk := []byte("not gob")
+	rec := make([]byte, 8, 8+len(junk))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(junk)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(junk))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, append(rec, junk...)...)
+	if err := os.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gopad.MakePaxos([]string{"a", "b", "c"}, 0).SetSave(path); err == nil {
+		t.Fatal("opened a log with a bad record")
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, b) {
+		t.Fatalf("log went from %d to %d bytes", len(b), len(after))
+	}
+}
+
+// the log is checkpointed as it grows even while nothing is done, and
+// everything in it survives
+func TestWALCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paxos.log")
+	px := restart(t, path)
+	var ar gopad.AcceptReply
+	n := 2500
+	for seq := 0; seq < n; seq++ {
+		px.Accept(gopad.AcceptArgs{Seq: seq, N: 1, Val: seq}, &ar)
+	}
+	px.Kill()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := 0
+	for off := 0; off < len(b); off += 8 + int(binary.BigEndian.Uint32(b[off:])) {
+		recs++
+	}
+	if recs > 1025 {
+		t.Fatalf("%d records in the log", recs)
+	}
+
+	px = restart(t, path)
+	for _, seq := range []int{0, n / 2, n - 1} {
+		if k, v := accepted(px, seq, 10); k != 1 || v != seq {
+			t.Fatalf("seq %d: accepted %v at %d after restarting", seq, v, k)
+		}
+	}
+}
+
+// serves a peer's snapshot, damaging the first chunk if bad
+type SnapshotPeer struct {
+	s      *gopad.Server
+	bad    bool
+	mu     sync.Mutex
+	chunks []int // size of each chunk sent
+}
+
+func (p *SnapshotPeer) SnapshotInfo(arg gopad.SnapshotArg, reply *gopad.SnapshotReply) error {
+	return p.s.SnapshotInfo(arg, reply)
+}
+
+func (p *SnapshotPeer) SnapshotChunk(arg gopad.ChunkArg, reply *gopad.ChunkReply) error {
+	err := p.s.SnapshotChunk(arg, reply)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bad && arg.Offset == 0 && len(reply.Data) > 0 {
+		reply.Data[0] ^= 0xff
+	}
+	p.chunks = append(p.chunks, len(reply.Data))
+	return err
+}
+
+// serve p on a local port and return the address
+func servePeer(t *testing.T, p *SnapshotPeer) string {
+	rpcs := rpc.NewServer()
+	rpcs.RegisterName("Server", p)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// a rebooted replica pulls a snapshot bigger than one chunk in pieces,
+// and turns down one that doesn't match its checksum
+func TestSnapshotTransfer(t *testing.T) {
+	var rows []string
+	for i := 0; i < 3000; i++ {
+		rows = append(rows, fmt.Sprintf("%d %s", i, strings.Repeat("x", 60)))
+	}
+	main := filepath.Join(t.TempDir(), "main.txt")
+	if err := os.WriteFile(main, []byte(strings.Join(rows, "\n")+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	s0 := gopad.NewServer(main, false, 0, []string{"s0"}, 0, "")
+	defer s0.Kill()
+
+	bad := &SnapshotPeer{s: s0, bad: true}
+	good := &SnapshotPeer{s: s0}
+	servers := []string{servePeer(t, bad), servePeer(t, good), "s1"}
+	s1 := gopad.NewServer("", true, 0, servers, 2, "")
+	defer s1.Kill()
+
+	if len(bad.chunks) == 0 {
+		t.Fatal("never asked the bad peer")
+	}
+	if len(good.chunks) < 2 {
+		t.Fatalf("sent in %d chunks", len(good.chunks))
+	}
+	for _, n := range good.chunks {
+		if n > 64*1024 {
+			t.Fatalf("sent a chunk of %d bytes", n)
+		}
+	}
+
+	_, want := s0.State()
+	_, got := s1.State()
+	if len(got.Rows) != len(want.Rows) {
+		t.Fatalf("%d rows, want %d", len(got.Rows), len(want.Rows))
+	}
+	for i := range want.Rows {
+		if string(got.Rows[i].Chars) != string(want.Rows[i].Chars) {
+			t.Fatalf("row %d is %q, want %q", i, string(got.Rows[i].Chars), string(want.Rows[i].Chars))
+		}
+	}
+}
+
+// time for peer 0 to get a value decided
+func benchAgreement(b *testing.B, npaxos int, hung int, fanOut bool) {
+	pxa := makePeers(b, npaxos, hung)
+	for _, px := range pxa {
+		px.SetFanOut(fanOut)
+	}
+
+	b.ResetTimer()
+	for seq := 0; seq < b.N; seq++ {
+		pxa[0].Start(seq, seq)
+		for {
+			if fate, _ := pxa[0].Status(seq); fate == gopad.Decided {
+				break
+			}
+			time.Sleep(50 * time.Microsecond)
+		}
+	}
+}
+
+// against calling peers one after another, as it used to
+func BenchmarkAgreement3(b *testing.B) {
+	b.Run("FanOut", func(b *testing.B) { benchAgreement(b, 3, -1, true) })
+	b.Run("OneByOne", func(b *testing.B) { benchAgreement(b, 3, -1, false) })
+}
+
+func BenchmarkAgreement5(b *testing.B) {
+	b.Run("FanOut", func(b *testing.B) { benchAgreement(b, 5, -1, true) })
+	b.Run("OneByOne", func(b *testing.B) { benchAgreement(b, 5, -1, false) })
+}
+
+// a peer that never answers shouldn't slow down the majority
+func BenchmarkAgreement3Hung(b *testing.B) {
+	benchAgreement(b, 3, 2, true)
+}
+
+func BenchmarkAgreement5Hung(b *testing.B) {
+	benchAgreement(b, 5, 4, true)
+}
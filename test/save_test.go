@@ -0,0 +1,171 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a Save has every replica write the committed document, replacing the
+// whole file, and autosave catches later edits
+func TestSave(t *testing.T) {
+	tmp := t.TempDir()
+	main := filepath.Join(tmp, "main.txt")
+	if err := os.WriteFile(main, []byte("hello\nthere world\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+
+	servers := []string{"s0", "s1", "s2"}
+	var dirs []string
+	for i, addr := range servers {
+		s := gopad.NewServer(main, false, 0, servers, i, "")
+		dirs = append(dirs, filepath.Join(tmp, addr))
+		s.SetSaveDir(dirs[i])
+		s.SetAutosave(100 * time.Millisecond)
+		sn.AddServer(addr, s)
+		s.Run()
+		defer s.Kill()
+	}
+	tr := sn.Endpoint("c")
+
+	var dr gopad.DocReply
+	if !tr.Call("s0", "Server.CreateDoc", gopad.DocArg{Name: "notes/a", Rows: []string{"one"}}, &dr, false) || dr.Err != "OK" {
+		t.Fatal("create failed", dr.Err)
+	}
+	if !tr.Call("s0", "Server.CreateDoc", gopad.DocArg{Name: "../a"}, &dr, false) || dr.Err != "Name" {
+		t.Fatal("created a document outside the save directory", dr.Err)
+	}
+
+	var ir gopad.InitReply
+	if !tr.Call("s1", "Server.Init", gopad.InitArg{Client: 1, Session: 1}, &ir, false) || ir.Err != "OK" {
+		t.Fatal("init failed", ir.Err)
+	}
+	// drop " there" from the main document
+	var ops []gopad.Op
+	for i := 0; i < 6; i++ {
+		ops = append(ops, gopad.Op{Type: gopad.DeleteAt, At: 6, Client: 1, Session: 1, Seq: uint32(i + 2), View: 1})
+	}
+	buf, _ := json.Marshal(ops)
+	var reply gopad.OpReply
+	for reply.Err = "High"; reply.Err == "High"; time.Sleep(10 * time.Millisecond) {
+		if !tr.Call("s1", "Server.Handle", gopad.OpArg{Data: buf}, &reply, false) {
+			t.Fatal("handle failed")
+		}
+	}
+
+	var sr gopad.SaveReply
+	if !tr.Call("s2", "Server.Save", gopad.SaveArg{}, &sr, false) || sr.Err != "OK" {
+		t.Fatal("save failed", sr.Err)
+	}
+	if sr.View < 8 {
+		// an autosave may have beaten it
+		t.Fatalf("saved at view %d, want 8 or later", sr.View)
+	}
+	if got, _ := os.ReadFile(main); string(got) != "hello\nworld\n" {
+		t.Fatalf("saved %q", got)
+	}
+
+	// nobody asked, but it changed
+	var ir2 gopad.InitReply
+	if !tr.Call("s1", "Server.Init", gopad.InitArg{Client: 1, Session: 1, Doc: "notes/a"}, &ir2, false) || ir2.Err != "OK" {
+		t.Fatal("init failed", ir2.Err)
+	}
+	buf, _ = json.Marshal([]gopad.Op{{Type: gopad.InsertAt, At: 3, Data: '!', Client: 1, Session: 1, Seq: 2, View: 1}})
+	for reply.Err = "High"; reply.Err == "High"; time.Sleep(10 * time.Millisecond) {
+		if !tr.Call("s1", "Server.Handle", gopad.OpArg{Data: buf, Doc: "notes/a"}, &reply, false) {
+			t.Fatal("handle failed")
+		}
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, "notes", "a")
+		for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+			if got, _ := os.ReadFile(path); string(got) == "one!\n" {
+				break
+			} else if time.Since(start) > 10*time.Second {
+				t.Fatalf("%s has %q", path, got)
+			}
+		}
+	}
+}
+
+// a save keeps the file's mode and clears out temp files a crash left,
+// and a replica that restarts ends up with the last save on disk
+func TestSaveRestart(t *testing.T) {
+	tmp := t.TempDir()
+	main := filepath.Join(tmp, "main.txt")
+	state := filepath.Join(tmp, "state")
+	if err := os.WriteFile(main, []byte("a\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(main, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(state, 0777); err != nil {
+		t.Fatal(err)
+	}
+	stale := main + "-tmp123"
+	os.WriteFile(stale, []byte("crashed"), 0600)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(stale, old, old)
+
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+	start := func() *gopad.Server {
+		s := gopad.NewServer(main, false, 0, []string{"s0"}, 0, state)
+		sn.AddServer("s0", s)
+		s.Run()
+		return s
+	}
+	s := start()
+	tr := sn.Endpoint("c")
+
+	var ir gopad.InitReply
+	if !tr.Call("s0", "Server.Init", gopad.InitArg{Client: 1, Session: 1}, &ir, false) || ir.Err != "OK" {
+		t.Fatal("init failed", ir.Err)
+	}
+	var sr gopad.SaveReply
+	if !tr.Call("s0", "Server.Save", gopad.SaveArg{}, &sr, false) || sr.Err != "OK" {
+		t.Fatal("save failed", sr.Err)
+	}
+	buf, _ := json.Marshal([]gopad.Op{{Type: gopad.InsertAt, At: 0, Data: 'b', Client: 1, Session: 1, Seq: 2, View: 1}})
+	var reply gopad.OpReply
+	for reply.Err = "High"; reply.Err == "High"; time.Sleep(10 * time.Millisecond) {
+		if !tr.Call("s0", "Server.Handle", gopad.OpArg{Data: buf}, &reply, false) {
+			t.Fatal("handle failed")
+		}
+	}
+	if !tr.Call("s0", "Server.Save", gopad.SaveArg{}, &sr, false) || sr.Err != "OK" {
+		t.Fatal("save failed", sr.Err)
+	}
+
+	fi, err := os.Stat(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("mode is %v after saving", fi.Mode())
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatal("stale temp file is still there")
+	}
+
+	// replaying both saves leaves the second on disk
+	s.Kill()
+	os.Remove(main)
+	s = start()
+	defer s.Kill()
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		if got, _ := os.ReadFile(main); string(got) == "ba\n" {
+			break
+		} else if time.Since(start) > 10*time.Second {
+			t.Fatalf("main has %q after restarting", got)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"testing"
+	"time"
+)
+
+// users that close leave right away, ones that go quiet are timed out,
+// and either way their color goes to the next one to join
+func TestSession(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+	s := gopad.NewServer("", false, 0, []string{"s0"}, 0, "")
+	s.SetSessionTimeout(400 * time.Millisecond)
+	sn.AddServer("s0", s)
+	s.Run()
+	defer s.Kill()
+
+	connect := func(user int, color int) *gopad.Client {
+		c := gopad.NewClient(user, gopad.MainDoc, []string{"s0"})
+		c.SetTransport(sn.Endpoint("c" + string(rune('0'+user))))
+		c.SetColor(color)
+		if err := c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	// wait for the replica's document to look right
+	state := func(what string, ok func(doc gopad.Doc) bool) gopad.Doc {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(20 * time.Millisecond) {
+			if _, doc := s.State(); ok(doc) {
+				return doc
+			}
+		}
+		_, doc := s.State()
+		t.Fatalf("never saw %s, colors are %v", what, doc.Colors)
+		return doc
+	}
+
+	c1 := connect(1, 1)
+	defer c1.Close()
+	c2 := connect(2, 2)
+	c2.InsertText("bye")
+
+	// the edit goes through before c2 does
+	c2.Close()
+	doc := state("c2 leave", func(doc gopad.Doc) bool { return len(doc.Colors) == 1 })
+	if _, ok := doc.UserPos[2]; ok || string(doc.Rows[0].Chars) != "bye" {
+		t.Fatalf("after c2 left: %q, cursors %v", string(doc.Rows[0].Chars), doc.UserPos)
+	}
+	for start := time.Now(); len(c1.Roster()) != 1; time.Sleep(20 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("c1 still has %v", c1.Roster())
+		}
+	}
+
+	// c3 gets the color c2 gave up
+	c3 := connect(3, 0)
+	defer c3.Close()
+	if doc := state("c3", func(doc gopad.Doc) bool { return len(doc.Colors) == 2 }); doc.Colors[3] != 2 {
+		t.Fatalf("c3 got color %d", doc.Colors[3])
+	}
+
+	// user 4 joins and never says anything again
+	var ir gopad.InitReply
+	if !sn.Endpoint("c4").Call("s0", "Server.Init", gopad.InitArg{Client: 4, Session: 1}, &ir, false) || ir.Err != "OK" {
+		t.Fatal("init failed", ir.Err)
+	}
+	state("user 4 join", func(doc gopad.Doc) bool { return doc.Colors[4] == 3 })
+	doc = state("user 4 time out", func(doc gopad.Doc) bool { _, ok := doc.Colors[4]; return !ok })
+	if _, ok := doc.Colors[1]; !ok {
+		t.Fatal("timed out c1 too")
+	}
+}
+
+// with no limit on the server everybody gets their own color, and a
+// document made with a limit of its own turns away the one too many
+func TestMaxUsers(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+	s := gopad.NewServer("", false, 0, []string{"s0"}, 0, "")
+	s.SetMaxUsers(0)
+	sn.AddServer("s0", s)
+	s.Run()
+	defer s.Kill()
+
+	tr := sn.Endpoint("c")
+	init := func(doc string, user int, session uint32) string {
+		var ir gopad.InitReply
+		if !tr.Call("s0", "Server.Init", gopad.InitArg{Client: user, Session: session, Doc: doc}, &ir, false) {
+			t.Fatal("init failed")
+		}
+		return string(ir.Err)
+	}
+
+	for user := 1; user <= 2*gopad.MAXUSERS; user++ {
+		if err := init(gopad.MainDoc, user, 1); err != "OK" {
+			t.Fatalf("user %d: %s", user, err)
+		}
+	}
+	if _, doc := s.State(); len(doc.Colors) != 2*gopad.MAXUSERS {
+		t.Fatalf("colors are %v", doc.Colors)
+	} else {
+		seen := map[int]bool{}
+		for _, c := range doc.Colors {
+			if seen[c] {
+				t.Fatalf("color %d twice in %v", c, doc.Colors)
+			}
+			seen[c] = true
+		}
+	}
+
+	var dr gopad.DocReply
+	if !tr.Call("s0", "Server.CreateDoc", gopad.DocArg{Name: "small", MaxUsers: 2}, &dr, false) || dr.Err != "OK" {
+		t.Fatal("create failed", dr.Err)
+	}
+	for user, want := range []string{"OK", "OK", "Full"} {
+		if err := init("small", user+1, 1); err != want {
+			t.Fatalf("user %d got %s, wanted %s", user+1, err, want)
+		}
+	}
+	// a new session for someone already in isn't joining
+	if err := init("small", 1, 2); err != "OK" {
+		t.Fatalf("user 1 came back to %s", err)
+	}
+
+	// users that all find room before any of them is in still only
+	// fill the spots there are
+	if !tr.Call("s0", "Server.CreateDoc", gopad.DocArg{Name: "race", MaxUsers: 2}, &dr, false) || dr.Err != "OK" {
+		t.Fatal("create failed", dr.Err)
+	}
+	errs := make(chan string)
+	for user := 1; user <= 6; user++ {
+		go func(user int) { errs <- init("race", user, 1) }(user)
+	}
+	joined := 0
+	for i := 0; i < 6; i++ {
+		if err := <-errs; err == "OK" {
+			joined++
+		} else if err != "Full" {
+			t.Fatalf("init got %s", err)
+		}
+	}
+	if _, doc, _ := s.DocState("race"); joined != 2 || len(doc.Colors) != 2 {
+		t.Fatalf("%d joined, colors are %v", joined, doc.Colors)
+	}
+}
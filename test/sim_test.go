@@ -0,0 +1,231 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var scenarios = flag.Int("scenarios", 1000, "randomized editing scenarios for TestSimEditing")
+
+var simSeed = flag.Int64("seed", -1, "just this scenario for TestSimEditing")
+
+const simParallel = 50 // scenarios run at once, they mostly wait
+
+// paxos peers over an unreliable simulated network still agree
+func TestSimPaxos(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	sn.SetFaults(0.1, 0.1, 2*time.Millisecond)
+	defer sn.Close()
+
+	peers := []string{"p0", "p1", "p2", "p3", "p4"}
+	var pxa []*gopad.Paxos
+	for i, addr := range peers {
+		px := gopad.MakePaxos(peers, i)
+		sn.AddPaxos(addr, px)
+		pxa = append(pxa, px)
+	}
+	defer func() {
+		for _, px := range pxa {
+			px.Kill()
+		}
+	}()
+
+	for seq := 0; seq < 20; seq++ {
+		if seq == 10 {
+			sn.Partition(peers[:2], peers[2:])
+		}
+		for i, px := range pxa {
+			px.Start(seq, fmt.Sprintf("%d-%d", seq, i))
+		}
+		waitAgree(t, pxa[2:], seq)
+	}
+
+	// the minority catches up once healed
+	sn.Heal()
+	for seq := 0; seq < 20; seq++ {
+		pxa[0].CatchUp(seq)
+		pxa[1].CatchUp(seq)
+		waitAgree(t, pxa, seq)
+	}
+}
+
+// random keystrokes from several clients through random replicas, with
+// an unreliable network and a partition along the way.  one seed again
+// is go test -run SimEditing -seed 42
+func TestSimEditing(t *testing.T) {
+	if *simSeed >= 0 {
+		runScenario(t, *simSeed)
+		return
+	}
+	n := *scenarios
+	if testing.Short() {
+		n = 20
+	}
+	seeds := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < simParallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seed := range seeds {
+				runScenario(t, seed)
+			}
+		}()
+	}
+	for seed := int64(0); seed < int64(n) && !t.Failed(); seed++ {
+		seeds <- seed
+	}
+	close(seeds)
+	wg.Wait()
+}
+
+var simMotions = []int{
+	gopad.MoveLeft, gopad.MoveRight, gopad.MoveUp, gopad.MoveDown,
+	gopad.MoveWordLeft, gopad.MoveWordRight, gopad.MoveLineStart,
+	gopad.MoveLineEnd, gopad.MoveDocStart, gopad.MoveDocEnd,
+}
+
+func randomOp(rng *rand.Rand) gopad.Op {
+	switch r := rng.Intn(13); {
+	case r < 5:
+		return gopad.Op{Type: gopad.Insert, Data: rune('a' + rng.Intn(26))}
+	case r < 6:
+		return gopad.Op{Type: gopad.Newline}
+	case r < 8:
+		return gopad.Op{Type: gopad.Delete}
+	case r < 9:
+		return gopad.Op{Type: gopad.InsertAt, At: rng.Intn(20), Data: rune('A' + rng.Intn(26))}
+	case r < 10:
+		return gopad.Op{Type: gopad.DeleteAt, At: rng.Intn(20)}
+	case r < 11:
+		return gopad.Op{Type: gopad.Move, Motion: gopad.MoveTo, At: rng.Intn(20)}
+	default:
+		return gopad.Op{Type: gopad.Move, Motion: simMotions[rng.Intn(len(simMotions))]}
+	}
+}
+
+// keep sending to random replicas until one takes it
+func simSend(tr gopad.Transport, rng *rand.Rand, servers []string, rpcname string, arg interface{}, ok func() bool, reply interface{}) {
+	for !ok() {
+		tr.Call(servers[rng.Intn(len(servers))], rpcname, arg, reply, false)
+		if !ok() {
+			time.Sleep(time.Duration(rng.Intn(5)) * time.Millisecond)
+		}
+	}
+}
+
+func runScenario(t *testing.T, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	sn := gopad.NewSimNet(seed)
+	sn.SetFaults(0.05, 0.05, 3*time.Millisecond)
+	defer sn.Close()
+
+	servers := []string{"s0", "s1", "s2"}
+	var ss []*gopad.Server
+	multi := rng.Intn(2) == 0
+	for i, addr := range servers {
+		s := gopad.NewServer("", false, 0, servers, i, "")
+		sn.AddServer(addr, s)
+		s.SetMulti(multi)
+		s.Run()
+		ss = append(ss, s)
+	}
+	defer func() {
+		for _, s := range ss {
+			s.Kill()
+		}
+	}()
+
+	nclients := 1 + rng.Intn(gopad.MAXUSERS)
+	nops := 10 + rng.Intn(30)
+	var wg sync.WaitGroup
+	for c := 1; c <= nclients; c++ {
+		wg.Add(1)
+		go func(c int, rng *rand.Rand) {
+			defer wg.Done()
+			tr := sn.Endpoint(fmt.Sprintf("c%d", c))
+
+			var ir gopad.InitReply
+			initArg := gopad.InitArg{Client: c, Session: 1}
+			simSend(tr, rng, servers, "Server.Init", initArg,
+				func() bool { return ir.Err == "OK" || ir.Err == "Duplicate" }, &ir)
+
+			// Init is the client's op 1
+			for seq := 2; seq < nops+2; seq++ {
+				op := randomOp(rng)
+				op.Client = c
+				op.Session = 1
+				op.Seq = uint32(seq)
+				buf, _ := json.Marshal([]gopad.Op{op})
+
+				var reply gopad.OpReply
+				simSend(tr, rng, servers, "Server.Handle", gopad.OpArg{Data: buf},
+					func() bool { return reply.Err == "OK" }, &reply)
+			}
+		}(c, rand.New(rand.NewSource(seed*100+int64(c))))
+	}
+
+	// cut one replica off for a while
+	go func() {
+		time.Sleep(time.Duration(rng.Intn(50)) * time.Millisecond)
+		i := rng.Intn(len(servers))
+		var rest []string
+		for j, addr := range servers {
+			if j != i {
+				rest = append(rest, addr)
+			}
+		}
+		sn.Partition([]string{servers[i]}, rest)
+		time.Sleep(time.Duration(50+rng.Intn(250)) * time.Millisecond)
+		sn.Heal()
+	}()
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(60 * time.Second):
+		t.Errorf("seed %d: clients never finished", seed)
+		return
+	}
+	sn.Heal()
+
+	// every replica has every op and the same document
+	var docs []gopad.Doc
+	var applied []int
+	for start := time.Now(); time.Since(start) < 20*time.Second; time.Sleep(50 * time.Millisecond) {
+		docs, applied = nil, nil
+		for _, s := range ss {
+			n, doc := s.State()
+			docs = append(docs, doc)
+			applied = append(applied, n)
+		}
+
+		same := true
+		for i := range docs {
+			for c := 1; c <= nclients; c++ {
+				if docs[i].UserSeqs[c] != uint32(nops+1) {
+					same = false
+				}
+			}
+			if applied[i] != applied[0] || !reflect.DeepEqual(docs[i], docs[0]) {
+				same = false
+			}
+		}
+		if same {
+			return
+		}
+	}
+	t.Errorf("seed %d: replicas never converged, applied %v\n%+v", seed, applied, docs)
+}
@@ -0,0 +1,89 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Subscribe returns as soon as an op commits and resumes from the view
+// it's given
+func TestSubscribe(t *testing.T) {
+	sn := gopad.NewSimNet(1)
+	defer sn.Close()
+
+	s := gopad.NewServer("", false, 0, []string{"s0"}, 0, "")
+	sn.AddServer("s0", s)
+	s.Run()
+	defer s.Kill()
+	tr := sn.Endpoint("c1")
+
+	var ir gopad.InitReply
+	if !tr.Call("s0", "Server.Init", gopad.InitArg{Client: 1, Session: 1}, &ir, false) || ir.Err != "OK" {
+		t.Fatal("init failed", ir.Err)
+	}
+
+	type result struct {
+		ops []gopad.Op
+		at  time.Time
+	}
+	subscribe := func(view uint32, max int) chan result {
+		ch := make(chan result, 1)
+		go func() {
+			var reply gopad.QueryReply
+			if !tr.Call("s0", "Server.Subscribe", gopad.SubscribeArg{View: view, Client: 1, Max: max}, &reply, false) || reply.Err != "OK" {
+				t.Error("subscribe failed", reply.Err)
+			}
+			var ops []gopad.Op
+			json.Unmarshal(reply.Data, &ops)
+			ch <- result{ops, time.Now()}
+		}()
+		return ch
+	}
+
+	// Init may not be applied yet when it returns
+	r := <-subscribe(0, 0)
+	if len(r.ops) != 1 || r.ops[0].Type != gopad.Init {
+		t.Fatalf("got %+v, want the Init", r.ops)
+	}
+	view := uint32(1)
+
+	ch := subscribe(view, 0)
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Fatal("returned with nothing new")
+	default:
+	}
+
+	var ops []gopad.Op
+	for i := 0; i < 5; i++ {
+		ops = append(ops, gopad.Op{Type: gopad.Insert, Data: rune('a' + i), Client: 1, Session: 1, Seq: uint32(i + 2)})
+	}
+	buf, _ := json.Marshal(ops)
+	var reply gopad.OpReply
+	if !tr.Call("s0", "Server.Handle", gopad.OpArg{Data: buf}, &reply, false) || reply.Err != "OK" {
+		t.Fatal("handle failed", reply.Err)
+	}
+	sent := time.Now()
+
+	r = <-ch
+	if len(r.ops) != 5 {
+		t.Fatalf("got %d ops, want 5", len(r.ops))
+	}
+	if d := r.at.Sub(sent); d > 100*time.Millisecond {
+		t.Fatalf("took %v after commit", d)
+	}
+
+	// a small batch, then the rest from where it stopped
+	r = <-subscribe(view, 2)
+	if len(r.ops) != 2 || r.ops[0].Data != 'a' {
+		t.Fatalf("got %+v", r.ops)
+	}
+	r = <-subscribe(view+2, 0)
+	if len(r.ops) != 3 || r.ops[0].Data != 'c' {
+		t.Fatalf("got %+v", r.ops)
+	}
+}
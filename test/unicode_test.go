@@ -0,0 +1,82 @@
+package testing
+
+import "github.com/ilnaes/gopad-old/src"
+
+import "testing"
+
+// two users editing rows with wide runes and combining marks: offsets
+// and cursors count runes, and moving between rows keeps the screen
+// column
+func TestUnicode(t *testing.T) {
+	e := startEditing(t)
+	rows := func(doc gopad.Doc) []string {
+		var out []string
+		for _, row := range doc.Rows {
+			if len(row.Temp) != len(row.Chars) || len(row.Author) != len(row.Chars) {
+				t.Fatalf("row %q has %d temps and %d authors", string(row.Chars), len(row.Temp), len(row.Author))
+			}
+			out = append(out, string(row.Chars))
+		}
+		return out
+	}
+
+	doc := e.send(1, gopad.Op{Type: gopad.InsertText, Text: "日本語 cafe\u0301\nabcdefghij", View: 2})
+	base := doc.View
+
+	// both made against the same view: c2 puts a 'Z' after "café"
+	// while c1 deletes the '本'
+	e.send(2, gopad.Op{Type: gopad.InsertAt, At: 9, Data: 'Z', View: base})
+	doc = e.send(1, gopad.Op{Type: gopad.DeleteAt, At: 1, View: base})
+	if got := rows(doc); got[0] != "日語 cafe\u0301Z" || got[1] != "abcdefghij" {
+		t.Fatalf("got %q", got)
+	}
+	if pos := doc.UserPos[2]; pos != (gopad.Pos{X: 9, Y: 0}) {
+		t.Fatalf("c2's cursor at %+v", pos)
+	}
+
+	// c2 goes left past the 'Z' and the accented e as one, then down.
+	// "日語 caf" is 8 columns wide
+	doc = e.send(2, gopad.Op{Type: gopad.Move, Motion: gopad.MoveLeft, View: doc.View},
+		gopad.Op{Type: gopad.Move, Motion: gopad.MoveLeft, View: doc.View})
+	if pos := doc.UserPos[2]; pos != (gopad.Pos{X: 6, Y: 0}) {
+		t.Fatalf("c2's cursor at %+v after going left", pos)
+	}
+	doc = e.send(2, gopad.Op{Type: gopad.Move, Motion: gopad.MoveDown, View: doc.View})
+	if pos := doc.UserPos[2]; pos != (gopad.Pos{X: 8, Y: 1}) {
+		t.Fatalf("c2's cursor at %+v after going down", pos)
+	}
+
+	// and back up from column 1 lands before the '日', which covers it
+	doc = e.send(2, gopad.Op{Type: gopad.Move, Motion: gopad.MoveLineStart, View: doc.View},
+		gopad.Op{Type: gopad.Move, Motion: gopad.MoveRight, View: doc.View},
+		gopad.Op{Type: gopad.Move, Motion: gopad.MoveUp, View: doc.View})
+	if pos := doc.UserPos[2]; pos != (gopad.Pos{X: 0, Y: 0}) {
+		t.Fatalf("c2's cursor at %+v after going up", pos)
+	}
+
+	// by word, the accent is part of one
+	doc = e.send(2, gopad.Op{Type: gopad.Move, Motion: gopad.MoveWordRight, View: doc.View})
+	if pos := doc.UserPos[2]; pos != (gopad.Pos{X: 3, Y: 0}) {
+		t.Fatalf("c2's cursor at %+v after a word", pos)
+	}
+	doc = e.send(2, gopad.Op{Type: gopad.Move, Motion: gopad.MoveWordRight, View: doc.View})
+	if pos := doc.UserPos[2]; pos != (gopad.Pos{X: 0, Y: 1}) {
+		t.Fatalf("c2's cursor at %+v after two words", pos)
+	}
+
+	// c2 goes to just before the 'c' while c1 puts a rune in front of it
+	base = doc.View
+	e.send(1, gopad.Op{Type: gopad.InsertAt, At: 0, Data: 'x', View: base})
+	doc = e.send(2, gopad.Op{Type: gopad.Move, Motion: gopad.MoveTo, At: 3, View: base})
+	if pos := doc.UserPos[2]; pos != (gopad.Pos{X: 4, Y: 0}) {
+		t.Fatalf("c2's cursor at %+v after moving to the c", pos)
+	}
+
+	// '±' is one column or two depending on the locale, but it's always
+	// one to the replicas so they agree on where cursors go
+	doc = e.send(2, gopad.Op{Type: gopad.InsertText, At: 21, Text: "\n±±\nabc", View: doc.View})
+	doc = e.send(2, gopad.Op{Type: gopad.Move, Motion: gopad.MoveUp, View: doc.View})
+	if pos := doc.UserPos[2]; pos != (gopad.Pos{X: 2, Y: 2}) {
+		t.Fatalf("c2's cursor at %+v after going up to the ±s", pos)
+	}
+}